@@ -5,41 +5,217 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
-	"log"
+	"fmt"
 	"net"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/jecoz/flexi"
 	"github.com/jecoz/flexi/fargate"
+	"github.com/jecoz/flexi/logger"
+	"github.com/jecoz/flexi/metrics"
+	"github.com/jecoz/flexi/styx"
+	"github.com/jecoz/flexi/trace"
 )
 
+func decodeFile(path string, v interface{}) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return json.NewDecoder(f).Decode(v)
+}
+
 func main() {
 	port := flag.String("port", "9pfs", "Server listening port")
 	mtpt := flag.String("m", "pmnt", "Remote processes mount point")
+	maxRemotes := flag.Int("max-remotes", 0, "Maximum number of active remotes (0 means unlimited)")
+	maxUserRemotes := flag.Int("max-user-remotes", 0, "Maximum number of active remotes per 9p user (0 means unlimited)")
+	spawnRate := flag.Int("spawn-rate", 0, "Maximum number of spawns per minute (0 means unlimited)")
+	queue := flag.Int("queue", 0, "Maximum number of concurrent spawns, queueing the others (0 disables the queue)")
+	queueRetries := flag.Int("queue-retries", 5, "Maximum spawn attempts on retryable failures, when the queue is enabled")
+	queueBackoff := flag.Duration("queue-backoff", 5*time.Second, "Initial backoff between queued spawn attempts")
+	metricsAddr := flag.String("metrics", "", "Address of the HTTP listener exposing Prometheus metrics (disabled if empty)")
+	warm := flag.String("warm", "", "Path to a JSON file containing the list of warm pool specs")
+	templates := flag.String("templates", "", "Directory containing the spawn templates, as name.json files (defaults to <m>/templates)")
+	jobRetention := flag.Duration("job-retention", flexi.DefaultJobRetention, "How long finished jobs are kept in the jobs directory")
+	jobTimeout := flag.Duration("job-timeout", flexi.DefaultJobTimeout, "Maximum time workers are given to complete a job")
+	mapWorkers := flag.Int("map-workers", flexi.DefaultMapWorkers, "Maximum number of workers a map job runs at once")
+	mapRetries := flag.Int("map-retries", 0, "Number of times failed map job items are run again")
+	spawnTimeout := flag.Duration("spawn-timeout", flexi.SpawnTimeout, "Maximum time a spawn attempt is allowed to take")
+	mountTimeout := flag.Duration("mount-timeout", flexi.SpawnTimeout, "Maximum time mounting a spawned process is allowed to take")
+	killTimeout := flag.Duration("kill-timeout", time.Duration(flexi.DefaultSpawnPolicy.KillTimeout), "Maximum time killing a remote process is allowed to take")
+	mountRetries := flag.Int("mount-retries", flexi.DefaultSpawnPolicy.MountRetry.Attempts, "Maximum mount attempts of each spawned process")
+	backendRetries := flag.Int("backend-retries", flexi.DefaultSpawnPolicy.BackendRetry.Attempts, "Maximum attempts of throttled or not yet consistent backend calls")
+	probeTimeout := flag.Duration("probe-timeout", time.Duration(flexi.DefaultSpawnPolicy.Probe.Timeout), "Maximum time spawned processes are given to start serving 9p before being mounted")
+	notify := flag.String("notify", "", "Path to a JSON file containing the list of notification targets")
+	notifyAllow := flag.String("notify-allow", "", "Comma separated list of the webhook URL prefixes spawn payloads can notify, besides the configured targets")
+	notifyRetries := flag.Int("notify-retries", 5, "Maximum delivery attempts of each notification")
+	liveness := flag.Duration("liveness", 0, "Interval between the liveness checks of remote processes (0 disables them)")
+	reconcile := flag.String("reconcile", "", "What to do with the backend processes flexi does not know about: report, kill or adopt (disabled if empty)")
+	reconcileInterval := flag.Duration("reconcile-interval", 0, "Interval between reconciliation passes after the one at startup (0 means startup only)")
+	clusters := flag.String("clusters", "", "Comma separated list of the ECS clusters checked for orphaned tasks, in addition to the ones of the restored tasks")
+	startedBy := flag.String("started-by", fargate.DefaultStartedBy, "Value of the startedBy field of the ECS tasks spawned")
+	orphanAge := flag.Duration("orphan-age", flexi.DefaultOrphanAge, "Minimum age of the unknown backend processes considered orphans")
+	instance := flag.String("instance", "", "Identifier of this server in the metadata of the spawned processes (defaults to the host name)")
+	namespaces := flag.String("namespaces", "", "Path to a JSON file containing the list of namespaces created at startup")
+	logLevel := flag.String("log-level", "info", "Minimum log level (debug, info, error). The debug level traces each 9p request")
+	logJSON := flag.Bool("log-json", false, "Encode log lines as JSON objects")
+	traceTo := flag.String("trace", "", "Trace exporter: stdout, an OTLP/HTTP traces endpoint or a file path (disabled if empty)")
+	maxFileSize := flag.Int64("max-file-size", 0, "Maximum size of the files created by clients (0 means 1MiB, or unlimited with -spill-dir)")
+	spillDir := flag.String("spill-dir", "", "Directory where files created by clients are stored once they grow past -spill-size (files are kept in memory if empty)")
+	spillSize := flag.Int64("spill-size", 0, "Size after which created files are moved to -spill-dir (0 means 1MiB)")
 	flag.Parse()
 
+	level, err := logger.ParseLevel(*logLevel)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error * %v\n", err)
+		os.Exit(1)
+	}
+	log := logger.New(os.Stderr, level, *logJSON)
+	// flush is called before exiting, as os.Exit skips
+	// deferred calls.
+	flush := func() {}
+	exitf := func(msg string, err error) {
+		log.Error(msg, "error", err)
+		flush()
+		os.Exit(1)
+	}
+
+	if *traceTo != "" {
+		e, c, err := trace.Open(*traceTo, "flexi", log.With("component", "trace"))
+		if err != nil {
+			exitf("unable to open trace exporter", err)
+		}
+		flush = func() {
+			if err := c.Close(); err != nil {
+				log.Error("unable to flush traces", "error", err)
+			}
+		}
+		defer flush()
+		trace.SetExporter(e)
+	}
+
 	addr := net.JoinHostPort("", *port)
 	ln, err := net.Listen("tcp", addr)
 	if err != nil {
-		log.Printf("error * %v", err)
-		os.Exit(1)
+		exitf("unable to listen", err)
+	}
+
+	if *metricsAddr != "" {
+		go func() {
+			if err := metrics.ListenAndServe(*metricsAddr, metrics.Default); err != nil {
+				log.Error("metrics listener", "error", err)
+			}
+		}()
 	}
 
 	sig := make(chan os.Signal, 1)
 	signal.Notify(sig, os.Interrupt)
 	go func() {
 		s := <-sig
-		log.Printf("%v <- signal received\n", s)
+		log.Info("signal received", "signal", s)
 		ln.Close()
 	}()
 
 	n := filepath.Join(*mtpt, "n")
 	b := filepath.Join(*mtpt, "backup")
-	s := &fargate.Fargate{BackupDir: b, Backup: true}
-	if err := flexi.ServeFlexi(ln, n, s); err != nil {
-		log.Printf("flexi server error * %v", err)
+	s := &fargate.Fargate{BackupDir: b, Backup: true, StartedBy: *startedBy}
+	if *clusters != "" {
+		s.Clusters = strings.Split(*clusters, ",")
+	}
+	srv := &flexi.Srv{
+		Mtpt: n,
+		Ln:   ln,
+		S:    s,
+		Log:  log,
+		// Defaults to the host name.
+		Instance: *instance,
+		// fargate is the only backend available, namespaces
+		// can refer to it by name.
+		Spawners: map[string]flexi.Spawner{"fargate": s},
+		Files: styx.Files{
+			MaxSize:   *maxFileSize,
+			SpillDir:  *spillDir,
+			SpillSize: *spillSize,
+		},
+		Limits: flexi.Limits{
+			MaxRemotes:        *maxRemotes,
+			MaxRemotesPerUser: *maxUserRemotes,
+			SpawnsPerMinute:   *spawnRate,
+		},
+	}
+	if *queue > 0 {
+		srv.Queue = &flexi.SpawnQueue{
+			MaxInflight: *queue,
+			Retry: flexi.Backoff{
+				Attempts: *queueRetries,
+				Initial:  flexi.Duration(*queueBackoff),
+				Max:      flexi.Duration(time.Minute * 2),
+			},
+		}
+	}
+	if *templates == "" {
+		*templates = filepath.Join(*mtpt, "templates")
+	}
+	if err := os.MkdirAll(*templates, os.ModePerm); err != nil {
+		exitf("unable to create templates directory", err)
+	}
+	srv.Templates = &flexi.Templates{Dir: *templates}
+	srv.Jobs = &flexi.Jobs{
+		Retention: *jobRetention,
+		Timeout:   *jobTimeout,
+		Workers:   *mapWorkers,
+		Retries:   *mapRetries,
+	}
+	srv.Liveness = *liveness
+	srv.SpawnPolicy = flexi.SpawnPolicy{
+		SpawnTimeout: flexi.Duration(*spawnTimeout),
+		MountTimeout: flexi.Duration(*mountTimeout),
+		KillTimeout:  flexi.Duration(*killTimeout),
+		BackendRetry: flexi.RetryPolicy{Attempts: *backendRetries},
+		MountRetry:   flexi.RetryPolicy{Attempts: *mountRetries},
+		Probe:        flexi.Probe{Timeout: flexi.Duration(*probeTimeout)},
+	}
+	if *reconcile != "" {
+		srv.Reconcile = &flexi.Reconcile{
+			Policy:   *reconcile,
+			Interval: *reconcileInterval,
+			MinAge:   *orphanAge,
+		}
+	}
+	if *notify != "" {
+		n := &flexi.Notifier{
+			Retry: flexi.Backoff{Attempts: *notifyRetries, Max: flexi.Duration(time.Minute)},
+			Log:   log.With("component", "notify"),
+		}
+		if *notifyAllow != "" {
+			n.AllowURLs = strings.Split(*notifyAllow, ",")
+		}
+		if err := decodeFile(*notify, &n.Targets); err != nil {
+			exitf("unable to decode notification targets", err)
+		}
+		srv.Notifier = n
+	}
+	if *namespaces != "" {
+		if err := decodeFile(*namespaces, &srv.Namespaces); err != nil {
+			exitf("unable to decode namespace specs", err)
+		}
+	}
+	if *warm != "" {
+		var specs []flexi.WarmSpec
+		if err := decodeFile(*warm, &specs); err != nil {
+			exitf("unable to decode warm pool specs", err)
+		}
+		srv.Warm = &flexi.WarmPool{Specs: specs}
+	}
+	if err := srv.Run(); err != nil {
+		log.Error("flexi server error", "error", err)
 	}
 }
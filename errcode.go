@@ -0,0 +1,93 @@
+// SPDX-FileCopyrightText: 2020 jecoz
+//
+// SPDX-License-Identifier: BSD-3-Clause
+
+package flexi
+
+import (
+	"context"
+	"errors"
+)
+
+// Code classifies failures, so that clients can decide whether
+// retrying makes sense.
+type Code string
+
+const (
+	CodeInvalidInput       Code = "invalid_input"
+	CodeQuota              Code = "quota"
+	CodeCapacity           Code = "capacity"
+	CodeBackendUnavailable Code = "backend_unavailable"
+	CodeMountFailed        Code = "mount_failed"
+	CodeTimeout            Code = "timeout"
+	CodeInternal           Code = "internal"
+)
+
+// Retryable reports whether failures with code c might not occur
+// when the operation is tried again later on.
+func (c Code) Retryable() bool {
+	switch c {
+	case CodeQuota, CodeCapacity, CodeBackendUnavailable, CodeMountFailed, CodeTimeout:
+		return true
+	default:
+		return false
+	}
+}
+
+// Error attaches a Code to an error.
+type Error struct {
+	code Code
+	err  error
+}
+
+// WithCode returns err with code attached. Returns nil if err
+// is nil.
+func WithCode(code Code, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &Error{code: code, err: err}
+}
+
+func (e *Error) Error() string { return e.err.Error() }
+func (e *Error) Unwrap() error { return e.err }
+func (e *Error) Code() Code    { return e.code }
+
+// CodeOf returns the code of err. Errors carry their code when
+// they, or any error they wrap, implement Code() Code. Otherwise
+// quota errors, deadlines and temporary errors are recognized,
+// while anything else is an internal error.
+func CodeOf(err error) Code {
+	var c interface{ Code() Code }
+	switch {
+	case err == nil:
+		return ""
+	case errors.As(err, &c):
+		return c.Code()
+	case errors.Is(err, ErrQuota):
+		return CodeQuota
+	case errors.Is(err, context.DeadlineExceeded):
+		return CodeTimeout
+	}
+	var t interface{ Temporary() bool }
+	if errors.As(err, &t) && t.Temporary() {
+		return CodeBackendUnavailable
+	}
+	return CodeInternal
+}
+
+// codedError prefixes the message of an error with its code.
+type codedError struct{ err error }
+
+func (e *codedError) Error() string { return string(CodeOf(e.err)) + ": " + e.err.Error() }
+func (e *codedError) Unwrap() error { return e.err }
+
+// publicError returns err with its message prefixed by its code.
+// Use it on the errors returned to 9p clients, which receive only
+// the error message.
+func publicError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &codedError{err}
+}
@@ -0,0 +1,49 @@
+// SPDX-FileCopyrightText: 2020 jecoz
+//
+// SPDX-License-Identifier: BSD-3-Clause
+
+package flexi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestCodeOf(t *testing.T) {
+	tt := []struct {
+		err       error
+		code      Code
+		retryable bool
+	}{
+		{nil, "", false},
+		{errors.New("boom"), CodeInternal, false},
+		{fmt.Errorf("add remote: %w", ErrQuota), CodeQuota, true},
+		{fmt.Errorf("spawn: %w", context.DeadlineExceeded), CodeTimeout, true},
+		{temporary{}, CodeBackendUnavailable, true},
+		{WithCode(CodeInvalidInput, fmt.Errorf("wrapped: %w", ErrQuota)), CodeInvalidInput, false},
+		{fmt.Errorf("spawn: %w", WithCode(CodeCapacity, errors.New("no capacity"))), CodeCapacity, true},
+	}
+	for i, v := range tt {
+		if code := CodeOf(v.err); code != v.code {
+			t.Fatalf("%d: unexpected code: wanted %q, found %q", i, v.code, code)
+		}
+		if retryable := IsRetryable(v.err); retryable != v.retryable {
+			t.Fatalf("%d: unexpected retryable: wanted %v, found %v", i, v.retryable, retryable)
+		}
+	}
+}
+
+func TestPublicError(t *testing.T) {
+	err := publicError(fmt.Errorf("add remote: %w", ErrQuota))
+	if have, want := err.Error(), "quota: add remote: quota exceeded"; have != want {
+		t.Fatalf("unexpected message: wanted %q, found %q", want, have)
+	}
+	if !errors.Is(err, ErrQuota) {
+		t.Fatal("public errors should wrap the original one")
+	}
+	if publicError(nil) != nil {
+		t.Fatal("expected a nil error")
+	}
+}
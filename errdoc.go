@@ -0,0 +1,79 @@
+// SPDX-FileCopyrightText: 2020 jecoz
+//
+// SPDX-License-Identifier: BSD-3-Clause
+
+package flexi
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// ErrorDoc is the content of err files, both of processes and of
+// the remotes and jobs of flexi. It is rewritten each time an error
+// is recorded.
+type ErrorDoc struct {
+	// Error is the message of the last error.
+	Error  string       `json:"error"`
+	Errors []ErrorEntry `json:"errors"`
+}
+
+// ErrorEntry is an error recorded in an ErrorDoc.
+type ErrorEntry struct {
+	Message string    `json:"message"`
+	Code    Code      `json:"code,omitempty"`
+	Time    time.Time `json:"time"`
+	Stack   string    `json:"stack,omitempty"`
+}
+
+// newErrorEntry returns the entry describing err.
+func newErrorEntry(err error) ErrorEntry {
+	e := ErrorEntry{Message: err.Error(), Code: CodeOf(err), Time: time.Now().UTC()}
+	var p *PanicError
+	if errors.As(err, &p) {
+		e.Stack = string(p.Stack)
+	}
+	return e
+}
+
+// Add records err in d.
+func (d *ErrorDoc) Add(err error) {
+	e := newErrorEntry(err)
+	d.Error = e.Message
+	d.Errors = append(d.Errors, e)
+}
+
+// errorValue returns the error document containing err only.
+func errorValue(err error) json.RawMessage {
+	var d ErrorDoc
+	d.Add(err)
+	b, _ := json.Marshal(&d)
+	return b
+}
+
+// errorMessage returns the last error message of the error
+// document b, or b itself if it is not an error document.
+func errorMessage(b []byte) string {
+	var d ErrorDoc
+	if err := json.Unmarshal(b, &d); err == nil && d.Error != "" {
+		return d.Error
+	}
+	return string(bytes.TrimSpace(b))
+}
+
+// docError returns the last error of the error document b, with
+// its code.
+func docError(b []byte) error {
+	var d ErrorDoc
+	if err := json.Unmarshal(b, &d); err != nil || len(d.Errors) == 0 {
+		return errors.New(errorMessage(b))
+	}
+	last := d.Errors[len(d.Errors)-1]
+	err := errors.New(last.Message)
+	if last.Code == "" {
+		return err
+	}
+	return WithCode(last.Code, err)
+}
@@ -16,12 +16,27 @@ import (
 	"os/signal"
 
 	"github.com/jecoz/flexi"
+	"github.com/jecoz/flexi/logger"
+	"github.com/jecoz/flexi/metrics"
+	"github.com/jecoz/flexi/trace"
 )
 
 func main() {
 	port := flag.String("port", "9pfs", "Server listening port")
+	metricsAddr := flag.String("metrics", "", "Address of the HTTP listener exposing Prometheus metrics (disabled if empty)")
+	traceTo := flag.String("trace", "", "Trace exporter: stdout, an OTLP/HTTP traces endpoint or a file path (disabled if empty)")
 	flag.Parse()
 
+	if *traceTo != "" {
+		e, c, err := trace.Open(*traceTo, "echo64", logger.Default)
+		if err != nil {
+			log.Printf("error * %v", err)
+			os.Exit(1)
+		}
+		defer c.Close()
+		trace.SetExporter(e)
+	}
+
 	addr := net.JoinHostPort("", *port)
 	ln, err := net.Listen("tcp", addr)
 	if err != nil {
@@ -29,6 +44,14 @@ func main() {
 		os.Exit(1)
 	}
 
+	if *metricsAddr != "" {
+		go func() {
+			if err := metrics.ListenAndServe(*metricsAddr, metrics.Default); err != nil {
+				log.Printf("error * metrics listener: %v", err)
+			}
+		}()
+	}
+
 	sig := make(chan os.Signal, 1)
 	signal.Notify(sig, os.Interrupt)
 	go func() {
@@ -0,0 +1,131 @@
+// SPDX-FileCopyrightText: 2020 jecoz
+//
+// SPDX-License-Identifier: BSD-3-Clause
+
+package fargate
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/jecoz/flexi"
+	"github.com/jecoz/flexi/fs"
+)
+
+// lsTimeout limits the time Ls spends checking the tasks of the
+// backups.
+const lsTimeout = time.Minute
+
+// backup is a remote process stored in BackupDir.
+type backup struct {
+	name string
+	rp   *flexi.RemoteProcess
+	c    Container
+}
+
+// readBackup decodes the backup stored in f. The name of the
+// returned backup is set even on error, when known.
+func readBackup(f fs.File) (*backup, error) {
+	b := new(backup)
+	info, err := f.Stat()
+	if err != nil {
+		return b, fmt.Errorf("stat: %w", err)
+	}
+	b.name = info.Name()
+	rwc, err := f.Open()
+	if err != nil {
+		return b, fmt.Errorf("open: %w", err)
+	}
+	defer rwc.Close()
+
+	b.rp = new(flexi.RemoteProcess)
+	if err := json.NewDecoder(rwc).Decode(b.rp); err != nil {
+		return b, fmt.Errorf("decode remote process: %w", err)
+	}
+	if err := json.Unmarshal(b.rp.Spawned, &b.c); err != nil {
+		return b, fmt.Errorf("decode container: %w", err)
+	}
+	if b.c.Name == "" || b.c.Cluster == "" {
+		return b, errors.New("container name or cluster missing")
+	}
+	return b, nil
+}
+
+func (f *Fargate) quarantineDir() string {
+	if f.QuarantineDir == "" {
+		return filepath.Clean(f.BackupDir) + ".quarantine"
+	}
+	return f.QuarantineDir
+}
+
+// quarantine moves the backup called name out of BackupDir.
+func (f *Fargate) quarantine(name, reason string) flexi.Skipped {
+	s := flexi.Skipped{Name: name, Reason: reason}
+	if name == "" {
+		return s
+	}
+	dir := f.quarantineDir()
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		s.Reason += fmt.Sprintf(" (quarantine: %v)", err)
+		return s
+	}
+	path := filepath.Join(dir, name)
+	if err := os.Rename(filepath.Join(f.BackupDir, name), path); err != nil {
+		s.Reason += fmt.Sprintf(" (quarantine: %v)", err)
+		return s
+	}
+	s.Quarantine = path
+	return s
+}
+
+// staleBackups returns, by name, the backups whose task is no
+// longer running along with the reason. Backups whose task cannot
+// be checked are not considered stale.
+func (f *Fargate) staleBackups(ctx context.Context, backups []*backup) map[string]string {
+	byCluster := make(map[string][]*backup)
+	for _, b := range backups {
+		byCluster[b.c.Cluster] = append(byCluster[b.c.Cluster], b)
+	}
+	stale := make(map[string]string)
+	for cluster, bs := range byCluster {
+		arns := make([]*string, len(bs))
+		for i, b := range bs {
+			arns[i] = stringPtr(b.c.Name)
+		}
+		tasks, failures, err := f.describeTasks(ctx, cluster, arns)
+		if err != nil {
+			continue
+		}
+		reasons := make(map[string]string)
+		for _, t := range tasks {
+			if deref(t.LastStatus) == ecs.DesiredStatusStopped || deref(t.DesiredStatus) == ecs.DesiredStatusStopped {
+				reasons[deref(t.TaskArn)] = strings.TrimSuffix("task stopped: "+deref(t.StoppedReason), ": ")
+			}
+		}
+		for _, v := range failures {
+			if deref(v.Reason) == "MISSING" {
+				reasons[deref(v.Arn)] = "task not found"
+			}
+		}
+		for _, b := range bs {
+			if reason, ok := reasons[b.c.Name]; ok {
+				stale[b.name] = reason
+			}
+		}
+	}
+	return stale
+}
+
+func deref(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
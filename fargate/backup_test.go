@@ -0,0 +1,91 @@
+// SPDX-FileCopyrightText: 2020 jecoz
+//
+// SPDX-License-Identifier: BSD-3-Clause
+
+package fargate
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jecoz/flexi"
+	"github.com/jecoz/flexi/file"
+)
+
+func TestLs_Corrupt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flexi-backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	backup := filepath.Join(dir, "backup")
+	if err := os.MkdirAll(backup, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range map[string]string{
+		"garbage":   "{",
+		"unencoded": `{"id": 1, "addr": "10.0.0.1:564", "name": "x", "spawned": {"name": "x"}}`,
+	} {
+		if err := ioutil.WriteFile(filepath.Join(backup, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f := &Fargate{BackupDir: backup}
+	rps, err := f.Ls()
+	if len(rps) != 0 {
+		t.Fatalf("have %d remote processes, want none", len(rps))
+	}
+	var serr *flexi.SkippedError
+	if !errors.As(err, &serr) || len(serr.Skipped) != 2 {
+		t.Fatalf("have error %v, want 2 skipped entries", err)
+	}
+	for _, v := range serr.Skipped {
+		if v.Quarantine != filepath.Join(dir, "backup.quarantine", v.Name) {
+			t.Fatalf("%v quarantined at %q", v.Name, v.Quarantine)
+		}
+		if _, err := os.Stat(v.Quarantine); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flexi-backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	c := &Container{Addr: "10.0.0.1:564", Name: "arn:task/x", Cluster: "c"}
+	spawned, err := json.Marshal(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &Fargate{BackupDir: dir, Backup: true}
+	rp := &flexi.RemoteProcess{ID: -1, Addr: c.Addr, Name: c.Name, Warm: true, Spawned: spawned}
+	if err := f.store(c, rp); err != nil {
+		t.Fatal(err)
+	}
+	rp.ID, rp.Warm = 3, false
+	if err := f.Store(rp); err != nil {
+		t.Fatal(err)
+	}
+
+	files := file.LsDisk(dir)()
+	if len(files) != 1 {
+		t.Fatalf("have %d backups, want 1", len(files))
+	}
+	b, err := readBackup(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.rp.ID != 3 || b.rp.Warm {
+		t.Fatalf("unexpected backup: %+v", b.rp)
+	}
+}
@@ -0,0 +1,84 @@
+// SPDX-FileCopyrightText: 2020 jecoz
+//
+// SPDX-License-Identifier: BSD-3-Clause
+
+package fargate
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jecoz/flexi"
+)
+
+// decodeStrict decodes b into v, rejecting unknown fields.
+func decodeStrict(b []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
+}
+
+// TestExamples decodes the examples in the testdata directory,
+// checking the fargate tasks they contain.
+func TestExamples(t *testing.T) {
+	paths, err := filepath.Glob("../testdata/*.json.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) == 0 {
+		t.Fatal("no examples found")
+	}
+	for _, path := range paths {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var tasks []json.RawMessage
+		switch name := filepath.Base(path); {
+		case strings.HasPrefix(name, "input."):
+			tasks = append(tasks, b)
+		case name == "namespaces.json.example":
+			var specs []flexi.NamespaceSpec
+			if err := decodeStrict(b, &specs); err != nil {
+				t.Fatalf("%v: %v", name, err)
+			}
+			for _, v := range specs {
+				if v.Template != nil {
+					tasks = append(tasks, v.Template)
+				}
+			}
+		case name == "warm.json.example":
+			var specs []flexi.WarmSpec
+			if err := decodeStrict(b, &specs); err != nil {
+				t.Fatalf("%v: %v", name, err)
+			}
+			for _, v := range specs {
+				tasks = append(tasks, v.Payload)
+			}
+		case name == "notify.json.example":
+			var targets []flexi.NotifyTarget
+			if err := decodeStrict(b, &targets); err != nil {
+				t.Fatalf("%v: %v", name, err)
+			}
+		case name == "pipeline.json.example":
+			var p flexi.Pipeline
+			if err := decodeStrict(b, &p); err != nil {
+				t.Fatalf("%v: %v", name, err)
+			}
+			if _, err := p.Order(); err != nil {
+				t.Fatalf("%v: %v", name, err)
+			}
+		default:
+			t.Fatalf("%v: unknown example", name)
+		}
+		for i, v := range tasks {
+			if _, err := DecodeTask(bytes.NewReader(v)); err != nil {
+				t.Fatalf("%v: task %d: %v", filepath.Base(path), i, err)
+			}
+		}
+	}
+}
@@ -8,18 +8,26 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/aws/aws-sdk-go/service/ecs"
 	"github.com/jecoz/flexi"
 	"github.com/jecoz/flexi/file"
+	"github.com/jecoz/flexi/logger"
+	"github.com/jecoz/flexi/trace"
 )
 
 const LastStatusPollInterval = time.Millisecond * time.Duration(500)
@@ -31,8 +39,44 @@ type Fargate struct {
 	// using Ls.
 	BackupDir string
 	Backup    bool
-	sess      *session.Session
-	client    *ecs.ECS
+	// QuarantineDir is where Ls moves the backups that cannot
+	// be restored. Defaults to BackupDir with the .quarantine
+	// suffix.
+	QuarantineDir string
+	// StartedBy is the startedBy field of the tasks spawned,
+	// used to list the running ones. Running further filters
+	// them by their flexi instance tag. Defaults to
+	// DefaultStartedBy.
+	StartedBy string
+	// Clusters are checked for running tasks by Running, along
+	// with the ones used by the tasks spawned or restored.
+	Clusters []string
+
+	sess   *session.Session
+	client *ecs.ECS
+
+	mu       sync.Mutex
+	clusters map[string]bool
+}
+
+// DefaultStartedBy is the default value of Fargate.StartedBy.
+const DefaultStartedBy = "flexi"
+
+func (f *Fargate) startedBy() string {
+	if f.StartedBy == "" {
+		return DefaultStartedBy
+	}
+	return f.StartedBy
+}
+
+// useCluster records that cluster contains tasks spawned by f.
+func (f *Fargate) useCluster(cluster string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.clusters == nil {
+		f.clusters = make(map[string]bool)
+	}
+	f.clusters[cluster] = true
 }
 
 func (f *Fargate) lazySession() *session.Session {
@@ -88,7 +132,7 @@ func (f *Fargate) waitRunningTask(ctx context.Context, cluster, arn string) (tas
 			if *task.LastStatus == ecs.DesiredStatusRunning {
 				return
 			}
-			// TODO: we could log each time we retry.
+			logger.FromContext(ctx).Debug("waiting for task to be running", "arn", arn, "status", *task.LastStatus)
 		case <-ctx.Done():
 			if !timer.Stop() {
 				<-timer.C
@@ -100,11 +144,89 @@ func (f *Fargate) waitRunningTask(ctx context.Context, cluster, arn string) (tas
 	}
 }
 
+// TaskFailure is returned when ECS refuses to run a task.
+type TaskFailure struct {
+	Reason string
+	Detail string
+}
+
+func (e *TaskFailure) Error() string {
+	if e.Detail == "" {
+		return fmt.Sprintf("run task: %s", e.Reason)
+	}
+	return fmt.Sprintf("run task: %s (%s)", e.Reason, e.Detail)
+}
+
+// Temporary reports whether the failure is caused by a lack of
+// capacity, in which case it makes sense to try again later.
+func (e *TaskFailure) Temporary() bool {
+	return strings.HasPrefix(e.Reason, "RESOURCE:") || strings.Contains(strings.ToLower(e.Reason), "capacity")
+}
+
+// Code returns the flexi error code of the failure.
+func (e *TaskFailure) Code() flexi.Code {
+	if e.Temporary() {
+		return flexi.CodeCapacity
+	}
+	return flexi.CodeInternal
+}
+
+func newTaskFailure(f *ecs.Failure) *TaskFailure {
+	e := &TaskFailure{}
+	if f.Reason != nil {
+		e.Reason = *f.Reason
+	}
+	if f.Detail != nil {
+		e.Detail = *f.Detail
+	}
+	return e
+}
+
+// apiError wraps the errors returned by the AWS APIs, so that
+// flexi can tell whether they are worth retrying.
+type apiError struct {
+	err error
+}
+
+func (e *apiError) Error() string { return e.err.Error() }
+func (e *apiError) Unwrap() error { return e.err }
+func (e *apiError) Temporary() bool {
+	return request.IsErrorThrottle(e.err) || request.IsErrorRetryable(e.err)
+}
+
+// throttled reports whether err is a throttled API call. Unlike
+// other temporary failures, such calls were not executed and can
+// be safely repeated.
+func throttled(err error) bool {
+	var aerr *apiError
+	return errors.As(err, &aerr) && request.IsErrorThrottle(aerr.err)
+}
+
+// Code returns the flexi error code of the failure.
+func (e *apiError) Code() flexi.Code {
+	if e.Temporary() {
+		return flexi.CodeBackendUnavailable
+	}
+	var aerr awserr.Error
+	if errors.As(e.err, &aerr) {
+		switch aerr.Code() {
+		case ecs.ErrCodeInvalidParameterException, ecs.ErrCodeClientException,
+			ecs.ErrCodeClusterNotFoundException, request.InvalidParameterErrCode,
+			request.ParamRequiredErrCode:
+			return flexi.CodeInvalidInput
+		}
+	}
+	return flexi.CodeInternal
+}
+
 type RunTaskInput struct {
 	Cluster        string
 	TaskDefinition string
 	Subnets        []string
 	SecurityGroups []string
+	StartedBy      string
+	Group          string
+	Tags           []*ecs.Tag
 }
 
 func (f *Fargate) RunTask(ctx context.Context, p RunTaskInput) (*ecs.Task, error) {
@@ -112,6 +234,7 @@ func (f *Fargate) RunTask(ctx context.Context, p RunTaskInput) (*ecs.Task, error
 		Cluster:        stringPtr(p.Cluster),
 		LaunchType:     stringPtr(ecs.LaunchTypeFargate),
 		TaskDefinition: stringPtr(p.TaskDefinition),
+		StartedBy:      stringPtr(p.StartedBy),
 		NetworkConfiguration: &ecs.NetworkConfiguration{
 			AwsvpcConfiguration: &ecs.AwsVpcConfiguration{
 				AssignPublicIp: stringPtr(ecs.AssignPublicIpEnabled),
@@ -120,16 +243,26 @@ func (f *Fargate) RunTask(ctx context.Context, p RunTaskInput) (*ecs.Task, error
 			},
 		},
 	}
+	if p.Group != "" {
+		input.Group = stringPtr(p.Group)
+	}
+	if len(p.Tags) > 0 {
+		input.Tags = p.Tags
+	}
 	if err := input.Validate(); err != nil {
 		return nil, err
 	}
-	resp, err := f.lazyClient().RunTaskWithContext(ctx, input)
+	// RunTask is not idempotent: a request whose response was
+	// lost might have started a task already. Throttled calls
+	// are retried by Spawn instead.
+	noRetry := func(r *request.Request) { r.Retryer = client.NoOpRetryer{} }
+	resp, err := f.lazyClient().RunTaskWithContext(ctx, input, noRetry)
 	if err != nil {
-		return nil, err
+		return nil, &apiError{err}
 	}
 	if len(resp.Tasks) == 0 {
 		if len(resp.Failures) > 0 {
-			return nil, fmt.Errorf("run task: %v", resp.Failures[0].String())
+			return nil, newTaskFailure(resp.Failures[0])
 		}
 		return nil, fmt.Errorf("run task: unable to fulfil request")
 	}
@@ -149,6 +282,10 @@ func (f *Fargate) StopTask(ctx context.Context, cluster, arn string) error {
 	return err
 }
 
+// errNoPublicIP is returned while the network interface of a
+// task has no public IP associated yet.
+var errNoPublicIP = errors.New("network interface has no public ip yet")
+
 func describeNetworkInterface(ctx context.Context, sess *session.Session, eni string) (*ec2.NetworkInterface, error) {
 	// NOTE: this function uses EC2. If more functions like this are needed,
 	// extract them into a separte ec2 package.
@@ -160,14 +297,42 @@ func describeNetworkInterface(ctx context.Context, sess *session.Session, eni st
 	}
 	resp, err := ec2.New(sess).DescribeNetworkInterfacesWithContext(ctx, input)
 	if err != nil {
-		return nil, err
+		return nil, &apiError{err}
 	}
 	if len(resp.NetworkInterfaces) == 0 {
-		return nil, fmt.Errorf("no interface found for %v", eni)
+		return nil, fmt.Errorf("no interface found for %v: %w", eni, errENINotFound)
 	}
 	return resp.NetworkInterfaces[0], nil
 }
 
+// errENINotFound is returned when EC2 does not know about a
+// network interface, which happens right after ECS attaches it.
+var errENINotFound = errors.New("network interface not found")
+
+// publicIP returns the public IP of the network interface eni,
+// retrying while EC2 does not know about it yet.
+func publicIP(ctx context.Context, sess *session.Session, eni string, retry flexi.RetryPolicy) (ip string, err error) {
+	notReady := func(err error) bool {
+		var aerr awserr.Error
+		if errors.As(err, &aerr) && strings.HasSuffix(aerr.Code(), ".NotFound") {
+			return true
+		}
+		return errors.Is(err, errENINotFound) || errors.Is(err, errNoPublicIP) || flexi.IsRetryable(err)
+	}
+	err = retry.Do(ctx, notReady, func(attempt int) error {
+		ifi, err := describeNetworkInterface(ctx, sess, eni)
+		if err != nil {
+			return err
+		}
+		if ifi.Association == nil || ifi.Association.PublicIp == nil {
+			return errNoPublicIP
+		}
+		ip = *ifi.Association.PublicIp
+		return nil
+	})
+	return ip, err
+}
+
 func eniFromTask(task *ecs.Task) (string, error) {
 	if len(task.Attachments) == 0 {
 		return "", fmt.Errorf("missing task attachments")
@@ -195,20 +360,48 @@ func eniFromTask(task *ecs.Task) (string, error) {
 	return eni, nil
 }
 
+// Validate checks that r contains a valid Task.
+func (f *Fargate) Validate(r io.Reader) error {
+	_, err := DecodeTask(r)
+	return err
+}
+
 func (f *Fargate) Spawn(ctx context.Context, r io.Reader, id int) (*flexi.RemoteProcess, error) {
-	var t Task
-	if err := json.NewDecoder(r).Decode(&t); err != nil {
-		return nil, fmt.Errorf("decoding task: %w", err)
-	}
-	task, err := f.RunTask(ctx, RunTaskInput{
-		Cluster:        t.Image.Cluster,
-		TaskDefinition: t.Image.Name,
-		Subnets:        t.Image.Subnets,
-		SecurityGroups: t.Image.SecurityGroups,
+	t, err := DecodeTask(r)
+	if err != nil {
+		return nil, err
+	}
+	meta := flexi.MetadataFromContext(ctx)
+	tags, err := taskTags(meta.Labels())
+	if err != nil {
+		return nil, err
+	}
+	policy := flexi.SpawnPolicyFromContext(ctx)
+
+	_, span := trace.Start(ctx, "fargate.RunTask", "cluster", t.Image.Cluster, "task_definition", t.Image.Name)
+	var task *ecs.Task
+	err = policy.BackendRetry.Do(ctx, throttled, func(attempt int) error {
+		var err error
+		task, err = f.RunTask(ctx, RunTaskInput{
+			Cluster:        t.Image.Cluster,
+			TaskDefinition: t.Image.Name,
+			Subnets:        t.Image.Subnets,
+			SecurityGroups: t.Image.SecurityGroups,
+			StartedBy:      f.startedBy(),
+			Group:          taskGroup(meta),
+			Tags:           tags,
+		})
+		if err != nil && throttled(err) {
+			logger.FromContext(ctx).Debug("run task failed, retrying", "attempt", attempt, "error", err)
+		}
+		return err
 	})
+	span.SetError(err)
+	span.Finish()
 	if err != nil {
 		return nil, err
 	}
+	f.useCluster(t.Image.Cluster)
 
 	// If an error occours from this point on, we need to
 	// stop the task too.
@@ -219,13 +412,18 @@ func (f *Fargate) Spawn(ctx context.Context, r io.Reader, id int) (*flexi.Remote
 		}
 		// Even though the original context was invalidated, we need to
 		// ensure we're not leaking resources.
-		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(policy.KillTimeout))
 		defer cancel()
 
 		f.StopTask(ctx, t.Image.Cluster, *task.TaskArn)
 	}()
 
-	if task, err = f.waitRunningTask(ctx, t.Image.Cluster, *task.TaskArn); err != nil {
+	logger.FromContext(ctx).Debug("task started", "arn", *task.TaskArn, "cluster", t.Image.Cluster)
+	_, span = trace.Start(ctx, "fargate.waitRunningTask", "arn", *task.TaskArn)
+	task, err = f.waitRunningTask(ctx, t.Image.Cluster, *task.TaskArn)
+	span.SetError(err)
+	span.Finish()
+	if err != nil {
 		return nil, err
 	}
 
@@ -233,12 +431,15 @@ func (f *Fargate) Spawn(ctx context.Context, r io.Reader, id int) (*flexi.Remote
 	if err != nil {
 		return nil, err
 	}
-	ifi, err := describeNetworkInterface(ctx, f.lazySession(), eni)
+	_, span = trace.Start(ctx, "fargate.describeNetworkInterface", "eni", eni)
+	ip, err := publicIP(ctx, f.lazySession(), eni, policy.BackendRetry)
+	span.SetError(err)
+	span.Finish()
 	if err != nil {
 		return nil, err
 	}
 
-	addr := net.JoinHostPort(*ifi.Association.PublicIp, t.Image.Service)
+	addr := net.JoinHostPort(ip, t.Image.Service)
 	name := *task.TaskArn
 
 	c := &Container{Addr: addr, Name: name, Cluster: t.Image.Cluster}
@@ -247,28 +448,44 @@ func (f *Fargate) Spawn(ctx context.Context, r io.Reader, id int) (*flexi.Remote
 		return nil, err
 	}
 	rp := &flexi.RemoteProcess{
-		ID:      id,
-		Addr:    addr,
-		Name:    name,
-		Spawned: b.Bytes(),
+		ID:        id,
+		Addr:      addr,
+		Name:      name,
+		Namespace: flexi.NamespaceFromContext(ctx),
+		StartedAt: startedAt(task),
+		Warm:      meta.Pool != "",
+		Spawned:   b.Bytes(),
+	}
+	if err := f.store(c, rp); err != nil {
+		return nil, err
 	}
-	if !f.Backup {
-		undo = false
-		return rp, nil
+
+	undo = false
+	return rp, nil
+}
+
+// Store replaces the backup of rp, if Backup is set.
+func (f *Fargate) Store(rp *flexi.RemoteProcess) error {
+	var c Container
+	if err := json.Unmarshal(rp.Spawned, &c); err != nil {
+		return fmt.Errorf("decode container: %w", err)
 	}
+	return f.store(&c, rp)
+}
 
+func (f *Fargate) store(c *Container, rp *flexi.RemoteProcess) error {
+	if !f.Backup {
+		return nil
+	}
 	bk, err := f.CreateBackup(c)
 	if err != nil {
-		return nil, fmt.Errorf("create backup file: %w", err)
+		return fmt.Errorf("create backup file: %w", err)
 	}
-	defer bk.Close()
-
 	if err = json.NewEncoder(bk).Encode(rp); err != nil {
-		return nil, fmt.Errorf("encode remote process: %w", err)
+		bk.Close()
+		return fmt.Errorf("encode remote process: %w", err)
 	}
-
-	undo = false
-	return rp, nil
+	return bk.Close()
 }
 
 func (f *Fargate) CreateBackup(c *Container) (io.ReadWriteCloser, error) {
@@ -296,21 +513,38 @@ func (f *Fargate) Kill(ctx context.Context, r io.Reader) error {
 	return nil
 }
 
+// Ls returns the remote processes stored in BackupDir whose task
+// is still running. Corrupt backups and the ones of stopped tasks
+// are moved to QuarantineDir and reported with a
+// *flexi.SkippedError.
 func (f *Fargate) Ls() ([]*flexi.RemoteProcess, error) {
 	files := file.LsDisk(f.BackupDir)()
-	rp := make([]*flexi.RemoteProcess, 0, len(files))
-	for i, v := range files {
-		rwc, err := v.Open()
+	skipped := new(flexi.SkippedError)
+	backups := make([]*backup, 0, len(files))
+	for _, v := range files {
+		b, err := readBackup(v)
 		if err != nil {
-			return nil, fmt.Errorf("Ls file %d: open error: %w", i, err)
+			skipped.Skipped = append(skipped.Skipped, f.quarantine(b.name, err.Error()))
+			continue
 		}
-		defer rwc.Close()
+		f.useCluster(b.c.Cluster)
+		backups = append(backups, b)
+	}
 
-		var r flexi.RemoteProcess
-		if err := json.NewDecoder(rwc).Decode(&r); err != nil {
-			return nil, fmt.Errorf("Ls file %d: %w", i, err)
+	ctx, cancel := context.WithTimeout(context.Background(), lsTimeout)
+	defer cancel()
+	stale := f.staleBackups(ctx, backups)
+
+	rp := make([]*flexi.RemoteProcess, 0, len(backups))
+	for _, b := range backups {
+		if reason, ok := stale[b.name]; ok {
+			skipped.Skipped = append(skipped.Skipped, f.quarantine(b.name, reason))
+			continue
 		}
-		rp = append(rp, &r)
+		rp = append(rp, b.rp)
+	}
+	if len(skipped.Skipped) > 0 {
+		return rp, skipped
 	}
 	return rp, nil
 }
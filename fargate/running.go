@@ -0,0 +1,176 @@
+// SPDX-FileCopyrightText: 2020 jecoz
+//
+// SPDX-License-Identifier: BSD-3-Clause
+
+package fargate
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/jecoz/flexi"
+)
+
+func startedAt(task *ecs.Task) time.Time {
+	switch {
+	case task.StartedAt != nil:
+		return *task.StartedAt
+	case task.CreatedAt != nil:
+		return *task.CreatedAt
+	default:
+		return time.Time{}
+	}
+}
+
+// clusterList returns the clusters Running should look into.
+func (f *Fargate) clusterList() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	set := make(map[string]bool, len(f.Clusters)+len(f.clusters))
+	for _, v := range f.Clusters {
+		set[v] = true
+	}
+	for k := range f.clusters {
+		set[k] = true
+	}
+	clusters := make([]string, 0, len(set))
+	for k := range set {
+		clusters = append(clusters, k)
+	}
+	sort.Strings(clusters)
+	return clusters
+}
+
+// listTasks returns the ARNs of the tasks of cluster started by f
+// that are supposed to be running.
+func (f *Fargate) listTasks(ctx context.Context, cluster string) ([]*string, error) {
+	input := &ecs.ListTasksInput{
+		Cluster:       stringPtr(cluster),
+		StartedBy:     stringPtr(f.startedBy()),
+		DesiredStatus: stringPtr(ecs.DesiredStatusRunning),
+	}
+	var arns []*string
+	err := f.lazyClient().ListTasksPagesWithContext(ctx, input, func(page *ecs.ListTasksOutput, last bool) bool {
+		arns = append(arns, page.TaskArns...)
+		return true
+	})
+	if err != nil {
+		return nil, &apiError{err}
+	}
+	return arns, nil
+}
+
+// servicePort returns the first port exposed by the container of
+// the task definition arn.
+func (f *Fargate) servicePort(ctx context.Context, arn string) (string, error) {
+	resp, err := f.lazyClient().DescribeTaskDefinitionWithContext(ctx, &ecs.DescribeTaskDefinitionInput{
+		TaskDefinition: stringPtr(arn),
+	})
+	if err != nil {
+		return "", &apiError{err}
+	}
+	for _, c := range resp.TaskDefinition.ContainerDefinitions {
+		for _, m := range c.PortMappings {
+			if m.ContainerPort != nil {
+				return strconv.FormatInt(*m.ContainerPort, 10), nil
+			}
+		}
+	}
+	return "", fmt.Errorf("task definition %v exposes no port", arn)
+}
+
+// Running returns the tasks started by f that are running on the
+// clusters it knows about, including the ones flexi lost track of.
+// Only the tasks tagged with the flexi instance found in ctx are
+// returned, as other servers might share the clusters. Their
+// address is left empty when it cannot be found.
+func (f *Fargate) Running(ctx context.Context) ([]*flexi.RemoteProcess, error) {
+	instance := flexi.MetadataFromContext(ctx).Instance
+	if instance == "" {
+		return nil, errors.New("running tasks: flexi instance unknown")
+	}
+	var running []*flexi.RemoteProcess
+	ports := make(map[string]string)
+	for _, cluster := range f.clusterList() {
+		arns, err := f.listTasks(ctx, cluster)
+		if err != nil {
+			return nil, fmt.Errorf("list tasks of %v: %w", cluster, err)
+		}
+		tasks, _, err := f.describeTasks(ctx, cluster, arns)
+		if err != nil {
+			return nil, err
+		}
+		for _, task := range tasks {
+			if tag(task.Tags, flexi.LabelPrefix+"instance") != instance {
+				continue
+			}
+			rp, err := f.remoteProcess(ctx, cluster, task, ports)
+			if err != nil {
+				return nil, err
+			}
+			running = append(running, rp)
+		}
+	}
+	return running, nil
+}
+
+// describeTasks describes the tasks arns of cluster, along with
+// the failures of the ones that could not be described.
+func (f *Fargate) describeTasks(ctx context.Context, cluster string, arns []*string) ([]*ecs.Task, []*ecs.Failure, error) {
+	var tasks []*ecs.Task
+	var failures []*ecs.Failure
+	// DescribeTasks accepts up to 100 tasks at once.
+	for len(arns) > 0 {
+		n := len(arns)
+		if n > 100 {
+			n = 100
+		}
+		resp, err := f.lazyClient().DescribeTasksWithContext(ctx, &ecs.DescribeTasksInput{
+			Cluster: stringPtr(cluster),
+			Tasks:   arns[:n],
+			Include: stringPtrSlice([]string{ecs.TaskFieldTags}),
+		})
+		if err != nil {
+			return nil, nil, fmt.Errorf("describe tasks of %v: %w", cluster, &apiError{err})
+		}
+		arns = arns[n:]
+		tasks = append(tasks, resp.Tasks...)
+		failures = append(failures, resp.Failures...)
+	}
+	return tasks, failures, nil
+}
+
+func (f *Fargate) remoteProcess(ctx context.Context, cluster string, task *ecs.Task, ports map[string]string) (*flexi.RemoteProcess, error) {
+	c := &Container{Name: *task.TaskArn, Cluster: cluster}
+	if eni, err := eniFromTask(task); err == nil {
+		def := *task.TaskDefinitionArn
+		port, ok := ports[def]
+		if !ok {
+			port, _ = f.servicePort(ctx, def)
+			ports[def] = port
+		}
+		ip, err := publicIP(ctx, f.lazySession(), eni, flexi.RetryPolicy{})
+		if err == nil && port != "" {
+			c.Addr = net.JoinHostPort(ip, port)
+		}
+	}
+	var b bytes.Buffer
+	if err := json.NewEncoder(&b).Encode(c); err != nil {
+		return nil, err
+	}
+	return &flexi.RemoteProcess{
+		ID:        -1,
+		Addr:      c.Addr,
+		Name:      c.Name,
+		StartedAt: startedAt(task),
+		Spawned:   b.Bytes(),
+	}, nil
+}
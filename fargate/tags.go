@@ -0,0 +1,75 @@
+// SPDX-FileCopyrightText: 2020 jecoz
+//
+// SPDX-License-Identifier: BSD-3-Clause
+
+package fargate
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/jecoz/flexi"
+)
+
+// ECS tag limits.
+const (
+	maxTags        = 50
+	maxTagKeyLen   = 128
+	maxTagValueLen = 256
+)
+
+// taskTags turns labels into ECS tags, sorted by key. Returns a
+// *ValidationError if ECS would refuse them.
+func taskTags(labels map[string]string) ([]*ecs.Tag, error) {
+	e := new(ValidationError)
+	if len(labels) > maxTags {
+		e.add("tags", "%d tags, at most %d are allowed", len(labels), maxTags)
+	}
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	tags := make([]*ecs.Tag, 0, len(keys))
+	for _, k := range keys {
+		v := labels[k]
+		switch {
+		case len(k) > maxTagKeyLen:
+			e.add("tags", "key %q is longer than %d characters", k, maxTagKeyLen)
+		case strings.HasPrefix(strings.ToLower(k), "aws:"):
+			e.add("tags", "key %q: the aws: prefix is reserved", k)
+		case len(v) > maxTagValueLen:
+			e.add("tags", "value of %q is longer than %d characters", k, maxTagValueLen)
+		}
+		tags = append(tags, &ecs.Tag{Key: stringPtr(k), Value: stringPtr(v)})
+	}
+	if len(e.Problems) > 0 {
+		return nil, e
+	}
+	return tags, nil
+}
+
+// tag returns the value of the tag called key, if any.
+func tag(tags []*ecs.Tag, key string) string {
+	for _, v := range tags {
+		if v.Key != nil && *v.Key == key && v.Value != nil {
+			return *v.Value
+		}
+	}
+	return ""
+}
+
+// taskGroup returns the task group of the tasks spawned for the
+// remotes described by m: one for each flexi instance and
+// namespace.
+func taskGroup(m flexi.Metadata) string {
+	if m.Instance == "" {
+		return ""
+	}
+	group := "flexi:" + m.Instance
+	if m.Namespace != "" {
+		group += "/" + m.Namespace
+	}
+	return group
+}
@@ -0,0 +1,40 @@
+// SPDX-FileCopyrightText: 2020 jecoz
+//
+// SPDX-License-Identifier: BSD-3-Clause
+
+package fargate
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/jecoz/flexi"
+)
+
+func TestTaskTags(t *testing.T) {
+	m := flexi.Metadata{
+		Instance: "fx1",
+		Remote:   "3",
+		User:     "glenda",
+		Tags:     map[string]string{"team": "a"},
+	}
+	tags, err := taskTags(m.Labels())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var have []string
+	for _, v := range tags {
+		have = append(have, *v.Key+"="+*v.Value)
+	}
+	want := "flexi:instance=fx1 flexi:remote=3 flexi:user=glenda team=a"
+	if strings.Join(have, " ") != want {
+		t.Fatalf("have %q, want %q", have, want)
+	}
+
+	if _, err := taskTags(map[string]string{"aws:name": "x"}); err == nil {
+		t.Fatal("reserved prefix accepted")
+	}
+	if _, err := taskTags(map[string]string{"k": strings.Repeat("v", maxTagValueLen+1)}); err == nil {
+		t.Fatal("long value accepted")
+	}
+}
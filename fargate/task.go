@@ -6,8 +6,14 @@ package fargate
 
 import (
 	"crypto/md5"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"strconv"
+	"strings"
+
+	"github.com/jecoz/flexi"
 )
 
 type Image struct {
@@ -34,6 +40,84 @@ type Task struct {
 	Caps      *Caps  `json:"capabilities"`
 }
 
+// ValidationError lists the problems found in a Task.
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return "invalid task: " + strings.Join(e.Problems, "; ")
+}
+
+// Code returns flexi.CodeInvalidInput.
+func (e *ValidationError) Code() flexi.Code { return flexi.CodeInvalidInput }
+
+func (e *ValidationError) add(field, format string, args ...interface{}) {
+	e.Problems = append(e.Problems, field+": "+fmt.Sprintf(format, args...))
+}
+
+func validIDs(e *ValidationError, field, prefix string, ids []string) {
+	for i, v := range ids {
+		if !strings.HasPrefix(v, prefix) || len(v) == len(prefix) {
+			e.add(fmt.Sprintf("%s[%d]", field, i), "%q is not a valid id, it should start with %q", v, prefix)
+		}
+	}
+}
+
+// Validate reports the problems that would make ECS refuse to
+// run t, or make flexi unable to reach it. Returns a
+// *ValidationError.
+func (t *Task) Validate() error {
+	e := new(ValidationError)
+	if t.ImageType != "" && t.ImageType != "fargate" {
+		e.add("image_type", "unsupported image type %q", t.ImageType)
+	}
+	if i := t.Image; i == nil {
+		e.add("image", "required")
+	} else {
+		if i.Name == "" {
+			e.add("image.name", "required")
+		}
+		if i.Cluster == "" {
+			e.add("image.cluster", "required")
+		}
+		if port, err := strconv.Atoi(i.Service); err != nil || port < 1 || port > 65535 {
+			e.add("image.service", "%q is not a valid port", i.Service)
+		}
+		if len(i.Subnets) == 0 {
+			e.add("image.subnets", "at least one subnet is required")
+		}
+		validIDs(e, "image.subnets", "subnet-", i.Subnets)
+		validIDs(e, "image.security_groups", "sg-", i.SecurityGroups)
+	}
+	if c := t.Caps; c != nil && (c.CPU < 0 || c.Ram < 0 || c.GPU < 0) {
+		e.add("capabilities", "negative values are not allowed")
+	}
+	if len(e.Problems) > 0 {
+		return e
+	}
+	return nil
+}
+
+// DecodeTask reads a single Task from r, rejecting unknown
+// fields, and validates it.
+func DecodeTask(r io.Reader) (*Task, error) {
+	var t Task
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&t); err != nil {
+		return nil, flexi.WithCode(flexi.CodeInvalidInput, fmt.Errorf("decoding task: %w", err))
+	}
+	var rest json.RawMessage
+	if err := dec.Decode(&rest); !errors.Is(err, io.EOF) {
+		return nil, flexi.WithCode(flexi.CodeInvalidInput, fmt.Errorf("decoding task: unexpected data after the task"))
+	}
+	if err := t.Validate(); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
 type Container struct {
 	Addr    string `json:"addr"`
 	Name    string `json:"name"`
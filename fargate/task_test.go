@@ -0,0 +1,64 @@
+// SPDX-FileCopyrightText: 2020 jecoz
+//
+// SPDX-License-Identifier: BSD-3-Clause
+
+package fargate
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestDecodeTask(t *testing.T) {
+	tt := []struct {
+		in       string
+		problems []string
+	}{
+		{
+			in: `{"image": {"name": "echo64", "cluster": "dev", "service": "564", "subnets": ["subnet-1"], "security_groups": ["sg-1"]}}`,
+		},
+		{
+			in:       `{"id": ""}`,
+			problems: []string{"image: required"},
+		},
+		{
+			in: `{"image": {"service": "56a", "subnets": ["sub-1"]}}`,
+			problems: []string{
+				"image.name: required",
+				"image.cluster: required",
+				`image.service: "56a" is not a valid port`,
+				`image.subnets[0]: "sub-1" is not a valid id, it should start with "subnet-"`,
+			},
+		},
+		{
+			in:       `{"image": {"name": "echo64", "cluster": "dev", "service": "564", "subnets": ["subnet-1"], "security_group": ["sg-1"]}}`,
+			problems: []string{`unknown field "security_group"`},
+		},
+		{
+			in:       `{"image": {"name": "echo64", "cluster": "dev", "service": "564", "subnets": ["subnet-1"]}} {}`,
+			problems: []string{"unexpected data"},
+		},
+	}
+	for i, v := range tt {
+		_, err := DecodeTask(strings.NewReader(v.in))
+		if len(v.problems) == 0 {
+			if err != nil {
+				t.Fatalf("%d: %v", i, err)
+			}
+			continue
+		}
+		if err == nil {
+			t.Fatalf("%d: expected an error", i)
+		}
+		var verr *ValidationError
+		if errors.As(err, &verr) && len(verr.Problems) != len(v.problems) {
+			t.Fatalf("%d: have %q, want %q", i, verr.Problems, v.problems)
+		}
+		for _, p := range v.problems {
+			if !strings.Contains(err.Error(), p) {
+				t.Fatalf("%d: error [%v] does not contain [%v]", i, err, p)
+			}
+		}
+	}
+}
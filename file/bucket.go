@@ -5,7 +5,6 @@
 package file
 
 import (
-	"bytes"
 	"io"
 	"os"
 	"sync"
@@ -20,18 +19,7 @@ type Bucket struct {
 	buf *LimitBuffer
 }
 
-func (b *Bucket) Open() (io.ReadWriteCloser, error) {
-	b.Lock()
-	defer b.Unlock()
-
-	return struct {
-		io.Reader
-		io.WriteCloser
-	}{
-		Reader:      bytes.NewBuffer(b.buf.Bytes()),
-		WriteCloser: b,
-	}, nil
-}
+func (b *Bucket) Open() (io.ReadWriteCloser, error) { return newHandle(b), nil }
 func (b *Bucket) Stat() (os.FileInfo, error) {
 	b.Lock()
 	defer b.Unlock()
@@ -51,8 +39,49 @@ func (b *Bucket) Write(p []byte) (int, error) {
 	return b.buf.Write(p)
 }
 
+func (b *Bucket) ReadAt(p []byte, off int64) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+	return b.buf.ReadAt(p, off)
+}
+
+func (b *Bucket) WriteAt(p []byte, off int64) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+	b.modTime = time.Now()
+	return b.buf.WriteAt(p, off)
+}
+
 func (b *Bucket) Close() error { return b.buf.Close() }
 
+func (b *Bucket) Truncate(size int64) error {
+	b.Lock()
+	defer b.Unlock()
+	b.modTime = time.Now()
+	return b.buf.Truncate(size)
+}
+
+func (b *Bucket) SetMode(mode os.FileMode) error {
+	b.Lock()
+	defer b.Unlock()
+	b.mode = mode
+	return nil
+}
+
+func (b *Bucket) Rename(name string) error {
+	b.Lock()
+	defer b.Unlock()
+	b.name = name
+	return nil
+}
+
+func (b *Bucket) SetModTime(t time.Time) error {
+	b.Lock()
+	defer b.Unlock()
+	b.modTime = t
+	return nil
+}
+
 func NewBucket(name string, mode os.FileMode, max int64) *Bucket {
 	return &Bucket{name: name, mode: mode, modTime: time.Now(), buf: &LimitBuffer{Max: max}}
 }
@@ -0,0 +1,72 @@
+// SPDX-FileCopyrightText: 2020 jecoz
+//
+// SPDX-License-Identifier: BSD-3-Clause
+
+package file
+
+import (
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Ctl is a write-only file that accepts commands, one per line.
+// Commands are executed when the file is closed, and the first
+// error is returned to the client that wrote them.
+type Ctl struct {
+	name string
+	exec func(cmd string) error
+
+	sync.Mutex
+	modTime time.Time
+}
+
+type ctlHandle struct {
+	c   *Ctl
+	buf LimitBuffer
+}
+
+func (h *ctlHandle) Read(p []byte) (int, error)               { return 0, ReadNotAllowed }
+func (h *ctlHandle) ReadAt(p []byte, off int64) (int, error)  { return 0, ReadNotAllowed }
+func (h *ctlHandle) Write(p []byte) (int, error)              { return h.buf.Write(p) }
+func (h *ctlHandle) WriteAt(p []byte, off int64) (int, error) { return h.buf.WriteAt(p, off) }
+
+func (h *ctlHandle) Close() error {
+	if h.buf.Size() == 0 {
+		return nil
+	}
+	h.c.Lock()
+	h.c.modTime = time.Now()
+	h.c.Unlock()
+	for _, v := range strings.Split(string(h.buf.Bytes()), "\n") {
+		cmd := strings.TrimSpace(v)
+		if cmd == "" {
+			continue
+		}
+		if err := h.c.exec(cmd); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Ctl) Open() (io.ReadWriteCloser, error) { return &ctlHandle{c: c}, nil }
+
+func (c *Ctl) Stat() (os.FileInfo, error) {
+	c.Lock()
+	defer c.Unlock()
+	return Info{
+		name:    c.name,
+		mode:    0222,
+		modTime: c.modTime,
+	}, nil
+}
+
+func (c *Ctl) Close() error { return nil }
+
+// NewCtl returns a Ctl file which commands are executed by exec.
+func NewCtl(name string, exec func(cmd string) error) *Ctl {
+	return &Ctl{name: name, exec: exec, modTime: time.Now()}
+}
@@ -9,39 +9,60 @@ import (
 	"io"
 	"os"
 	"path/filepath"
-	"strings"
 	"sync"
 	"time"
 
 	"github.com/jecoz/flexi/fs"
 )
 
+// Dir is a directory which files are either kept in memory,
+// indexed by name, or listed each time by an ls function, as
+// for the contents of a disk directory. Dynamic directories
+// keep the files appended to them in memory too.
 type Dir struct {
 	name string
 	perm os.FileMode
 
 	sync.Mutex
 	ls      func() []fs.File
+	files   map[string]fs.File
+	order   []string
 	modTime time.Time
 }
 
+// static returns the files kept in memory, in the order they
+// were appended. Call with d locked.
+func (d *Dir) static() []fs.File {
+	files := make([]fs.File, len(d.order))
+	for i, v := range d.order {
+		files[i] = d.files[v]
+	}
+	return files
+}
+
 func (d *Dir) Ls() []fs.File {
 	d.Lock()
 	defer d.Unlock()
-	return d.ls()
+	if d.ls == nil {
+		return d.static()
+	}
+	return append(d.ls(), d.static()...)
 }
 
 func (d *Dir) Close() error {
 	d.Lock()
 	defer d.Unlock()
 	d.modTime = time.Now()
-	d.ls = func() []fs.File {
-		return []fs.File{}
-	}
+	d.ls = nil
+	d.files = make(map[string]fs.File)
+	d.order = nil
 	return nil
 }
 
-func (d *Dir) Open() (io.ReadWriteCloser, error) { return &dirReader{dir: d}, nil }
+// Open returns a reader listing the files d contains when it is
+// opened, so that chunked Readdir calls neither skip nor repeat
+// files added or removed meanwhile.
+func (d *Dir) Open() (io.ReadWriteCloser, error) { return &dirReader{files: d.Ls()}, nil }
 func (d *Dir) Stat() (os.FileInfo, error) {
 	d.Lock()
 	defer d.Unlock()
@@ -54,49 +75,135 @@ func (d *Dir) Stat() (os.FileInfo, error) {
 	}, nil
 }
 
-func (d *Dir) Find(name string) (fs.File, error) {
-	if name == d.name {
-		return d, nil
-	}
-	filename := strings.TrimPrefix(name, d.name)
+func (d *Dir) SetMode(mode os.FileMode) error {
+	d.Lock()
+	defer d.Unlock()
+	d.perm = mode.Perm()
+	return nil
+}
 
+func (d *Dir) SetModTime(t time.Time) error {
+	d.Lock()
+	defer d.Unlock()
+	d.modTime = t
+	return nil
+}
+
+// find returns the file called name. Files kept in memory are
+// found without listing the directory. Call with d locked.
+func (d *Dir) find(name string) (fs.File, bool) {
+	if f, ok := d.files[name]; ok {
+		return f, true
+	}
+	if d.ls == nil {
+		return nil, false
+	}
 	for _, v := range d.ls() {
 		info, err := v.Stat()
 		if err != nil {
 			continue
 		}
-		if info.Name() == filename {
-			return v, nil
+		if info.Name() == name {
+			return v, true
 		}
 	}
+	return nil, false
+}
+
+// Find returns the file contained in d called name.
+func (d *Dir) Find(name string) (fs.File, error) {
+	d.Lock()
+	defer d.Unlock()
+	if f, ok := d.find(name); ok {
+		return f, nil
+	}
 	return nil, os.ErrNotExist
 }
 
+// Append adds f to the files of d. A file with the same name
+// is replaced.
 func (d *Dir) Append(f fs.File) {
+	info, err := f.Stat()
+	if err != nil {
+		return
+	}
 	d.Lock()
 	defer d.Unlock()
 	d.modTime = time.Now()
-	oldls := d.ls
-	d.ls = func() []fs.File {
-		return append(oldls(), f)
+	d.add(info.Name(), f)
+}
+
+// add is Append without locking.
+func (d *Dir) add(name string, f fs.File) {
+	if _, ok := d.files[name]; !ok {
+		d.order = append(d.order, name)
 	}
+	d.files[name] = f
 }
 
+// unlink removes name from the files kept in memory.
+// Call with d locked.
+func (d *Dir) unlink(name string) {
+	delete(d.files, name)
+	for i, v := range d.order {
+		if v == name {
+			d.order = append(d.order[:i], d.order[i+1:]...)
+			return
+		}
+	}
+}
+
+// Remove removes f from the files kept in memory. Files
+// returned by the ls function cannot be removed.
 func (d *Dir) Remove(f fs.File) {
 	d.Lock()
 	defer d.Unlock()
 	d.modTime = time.Now()
-	oldls := d.ls
-	d.ls = func() []fs.File {
-		files := oldls()
-		filtered := make([]fs.File, 0, len(files))
-		for _, v := range files {
-			if v != f {
-				filtered = append(filtered, v)
+	if info, err := f.Stat(); err == nil && d.files[info.Name()] == f {
+		d.unlink(info.Name())
+		return
+	}
+	// f might have been renamed without
+	// informing us.
+	for name, v := range d.files {
+		if v == f {
+			d.unlink(name)
+			return
+		}
+	}
+}
+
+// RenameFile renames the file called oldname, which must
+// implement fs.Renamer, to newname. newname must not be taken.
+func (d *Dir) RenameFile(oldname, newname string) error {
+	d.Lock()
+	defer d.Unlock()
+	f, ok := d.find(oldname)
+	if !ok {
+		return os.ErrNotExist
+	}
+	if _, ok := d.find(newname); ok {
+		return os.ErrExist
+	}
+	r, ok := f.(fs.Renamer)
+	if !ok {
+		return fs.ErrNotSupported
+	}
+	if err := r.Rename(newname); err != nil {
+		return err
+	}
+	if _, ok := d.files[oldname]; ok {
+		// Keep the position of the file.
+		for i, v := range d.order {
+			if v == oldname {
+				d.order[i] = newname
 			}
 		}
-		return filtered
+		delete(d.files, oldname)
+		d.files[newname] = f
 	}
+	d.modTime = time.Now()
+	return nil
 }
 
 // LsDisk returns an ls function that inspects path on disk. Basically
@@ -118,12 +225,10 @@ func LsDisk(path string) func() []fs.File {
 		for i, v := range infos {
 			child := filepath.Join(path, v.Name())
 			if v.IsDir() {
-				files[i] = &Dir{
-					name:    v.Name(),
-					perm:    v.Mode(),
-					modTime: v.ModTime(),
-					ls:      LsDisk(child),
-				}
+				d := NewDirLs(v.Name(), LsDisk(child))
+				d.perm = v.Mode().Perm()
+				d.modTime = v.ModTime()
+				files[i] = d
 			} else {
 				files[i] = NewRegular(child, v)
 			}
@@ -132,23 +237,60 @@ func LsDisk(path string) func() []fs.File {
 	}
 }
 
+// LsDiskReadOnly works like LsDisk, but the files returned can
+// only be read.
+func LsDiskReadOnly(path string) func() []fs.File {
+	return func() []fs.File {
+		dir, err := os.Open(path)
+		if err != nil {
+			return []fs.File{}
+		}
+		defer dir.Close()
+
+		infos, _ := dir.Readdir(-1)
+		files := make([]fs.File, len(infos))
+		for i, v := range infos {
+			child := filepath.Join(path, v.Name())
+			if v.IsDir() {
+				d := NewDirLs(v.Name(), LsDiskReadOnly(child))
+				d.perm = v.Mode().Perm() &^ 0222
+				d.modTime = v.ModTime()
+				files[i] = d
+			} else {
+				files[i] = NewReadOnlyRegular(child)
+			}
+		}
+		return files
+	}
+}
+
+// NewDirLs returns a dynamic directory, which files are
+// listed by ls each time.
 func NewDirLs(name string, ls func() []fs.File) *Dir {
 	return &Dir{
 		perm:    os.ModePerm,
 		name:    name,
 		modTime: time.Now(),
 		ls:      ls,
+		files:   make(map[string]fs.File),
 	}
 }
 
+// NewDirFiles returns a directory containing files.
 func NewDirFiles(name string, files ...fs.File) *Dir {
-	return NewDirLs(name, func() []fs.File {
-		return files
-	})
+	d := NewDirLs(name, nil)
+	for _, v := range files {
+		info, err := v.Stat()
+		if err != nil {
+			continue
+		}
+		d.add(info.Name(), v)
+	}
+	return d
 }
 
 type dirReader struct {
-	dir    *Dir
+	files  []fs.File
 	offset int
 }
 
@@ -159,17 +301,10 @@ func (d *dirReader) Write(p []byte) (int, error) { return 0, errNotSupported }
 func (d *dirReader) Close() error                { return nil }
 
 func (d *dirReader) Readdir(n int) ([]os.FileInfo, error) {
-	if d.dir == nil {
-		return nil, os.ErrInvalid
-	}
-	d.dir.Lock()
-	all := d.dir.ls()
-	d.dir.Unlock()
-
-	if d.offset >= len(all) {
+	if d.offset >= len(d.files) {
 		return nil, io.EOF
 	}
-	files := all[d.offset:]
+	files := d.files[d.offset:]
 	count := len(files)
 	take := n
 	if take <= 0 || take > count {
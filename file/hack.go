@@ -43,6 +43,9 @@ type HackableRead struct {
 	sync.Mutex
 	ModTime time.Time
 	ReadAlt func([]byte) (int, error)
+	// ReadAltUser, if present, is preferred over ReadAlt
+	// and receives the user that opened the file.
+	ReadAltUser func(string, []byte) (int, error)
 }
 
 func (h *HackableRead) Close() error {
@@ -51,35 +54,85 @@ func (h *HackableRead) Close() error {
 	h.ReadAlt = func([]byte) (int, error) {
 		return 0, io.EOF
 	}
+	h.ReadAltUser = nil
 	h.ModTime = time.Now()
 	return nil
 }
-func (h *HackableRead) Open() (io.ReadWriteCloser, error) {
+func (h *HackableRead) Open() (io.ReadWriteCloser, error) { return h.OpenUser("") }
+
+// OpenUser returns a handle which contents are generated by the
+// read function on first use and buffered, so that clients can
+// read them at any offset, and read them again, without
+// triggering the generation more than once per open.
+func (h *HackableRead) OpenUser(user string) (io.ReadWriteCloser, error) {
+	return newHandle(readOnly{&hackableOutput{h: h, user: user}}), nil
+}
+
+// hackableOutput is the output generated by a HackableRead for
+// a single open.
+type hackableOutput struct {
+	h    *HackableRead
+	user string
+
+	sync.Mutex
+	generated bool
+	data      []byte
+	err       error
+}
+
+// hackableChunk is the size of the buffer passed to the read
+// functions of HackableRead.
+const hackableChunk = 8192
+
+func (o *hackableOutput) generate() {
+	h := o.h
 	h.Lock()
 	defer h.Unlock()
-	var lastErr error
-	return &HackableRWC{
-		ReadAlt: func(p []byte) (int, error) {
-			h.Lock()
-			defer h.Unlock()
-			switch {
-			case errors.Is(lastErr, io.EOF):
-				return 0, lastErr
-			case errors.Is(lastErr, io.ErrShortBuffer):
-				// Maybe this time the user provided a
-				// buffer that is big enough.
-			case lastErr != nil:
-				return 0, lastErr
-			default:
-			}
-
-			h.ModTime = time.Now()
-			n, err := h.ReadAlt(p)
-			lastErr = err
-			return n, err
-		},
-	}, nil
+	h.ModTime = time.Now()
+
+	p := make([]byte, hackableChunk)
+	for {
+		var n int
+		var err error
+		if h.ReadAltUser != nil {
+			n, err = h.ReadAltUser(o.user, p)
+		} else {
+			n, err = h.ReadAlt(p)
+		}
+		o.data = append(o.data, p[:n]...)
+		if errors.Is(err, io.EOF) || (err == nil && n == 0) {
+			return
+		}
+		if err != nil {
+			o.err = err
+			return
+		}
+	}
 }
+
+func (o *hackableOutput) ReadAt(p []byte, off int64) (int, error) {
+	o.Lock()
+	defer o.Unlock()
+	if !o.generated {
+		o.generate()
+		o.generated = true
+	}
+	if o.err != nil {
+		return 0, o.err
+	}
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if off >= int64(len(o.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, o.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
 func (h *HackableRead) Stat() (os.FileInfo, error) {
 	h.Lock()
 	defer h.Unlock()
@@ -95,3 +148,7 @@ func (h *HackableRead) Stat() (os.FileInfo, error) {
 func WithRead(name string, r func([]byte) (int, error)) *HackableRead {
 	return &HackableRead{Name: name, ModTime: time.Now(), ReadAlt: r}
 }
+
+func WithUserRead(name string, r func(string, []byte) (int, error)) *HackableRead {
+	return &HackableRead{Name: name, ModTime: time.Now(), ReadAltUser: r}
+}
@@ -0,0 +1,131 @@
+// SPDX-FileCopyrightText: 2020 jecoz
+//
+// SPDX-License-Identifier: BSD-3-Clause
+
+package file
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+// generator returns a read function producing data, counting the
+// times it is called and the times data is generated completely.
+type generator struct {
+	data        []byte
+	off         int
+	calls       int
+	generations int
+	chunks      []int
+}
+
+func (g *generator) read(p []byte) (int, error) {
+	g.calls++
+	g.chunks = append(g.chunks, len(p))
+	if g.off >= len(g.data) {
+		g.off = 0
+		g.generations++
+		return 0, io.EOF
+	}
+	n := copy(p, g.data[g.off:])
+	g.off += n
+	return n, nil
+}
+
+func newGenerator(size int) *generator {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte('a' + i%26)
+	}
+	return &generator{data: data}
+}
+
+func TestHackableRead_ReadAt(t *testing.T) {
+	g := newGenerator(2*hackableChunk + 100)
+	h := WithRead("ctl", g.read)
+	rwc, err := h.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := rwc.(io.ReaderAt)
+
+	tt := []struct {
+		off int64
+		len int
+		// n is the number of bytes expected.
+		n   int
+		eof bool
+	}{
+		{off: 0, len: 10, n: 10},
+		{off: hackableChunk - 5, len: 10, n: 10},
+		{off: 2 * hackableChunk, len: 100, n: 100},
+		{off: 2*hackableChunk + 90, len: 20, n: 10, eof: true},
+		{off: 2*hackableChunk + 100, len: 10, eof: true},
+		// Going back is allowed too.
+		{off: 3, len: 5, n: 5},
+	}
+	for i, v := range tt {
+		p := make([]byte, v.len)
+		n, err := r.ReadAt(p, v.off)
+		if n != v.n {
+			t.Fatalf("%d: have %d bytes, want %d", i, n, v.n)
+		}
+		if eof := errors.Is(err, io.EOF); eof != v.eof || (err != nil && !eof) {
+			t.Fatalf("%d: unexpected error: %v", i, err)
+		}
+		if want := g.data[v.off : v.off+int64(v.n)]; !bytes.Equal(p[:n], want) {
+			t.Fatalf("%d: have [%s], want [%s]", i, p[:n], want)
+		}
+	}
+	if _, err := r.ReadAt(make([]byte, 1), -1); err == nil {
+		t.Fatal("expected an error reading at a negative offset")
+	}
+}
+
+func TestHackableRead_OncePerOpen(t *testing.T) {
+	g := newGenerator(hackableChunk + 1)
+	h := WithRead("ctl", g.read)
+
+	for i := 1; i <= 2; i++ {
+		rwc, err := h.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Read the whole file twice with the same handle.
+		for j := 0; j < 2; j++ {
+			b, err := ioutil.ReadAll(io.NewSectionReader(rwc.(io.ReaderAt), 0, 1<<20))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(b, g.data) {
+				t.Fatalf("%d: have %d bytes, want %d", i, len(b), len(g.data))
+			}
+		}
+		if g.generations != i {
+			t.Fatalf("have %d generations after %d opens", g.generations, i)
+		}
+	}
+	// Two chunks of data and the final EOF, for each open.
+	if g.calls != 6 {
+		t.Fatalf("have %d calls, want 6", g.calls)
+	}
+	for _, v := range g.chunks {
+		if v != hackableChunk {
+			t.Fatalf("have a chunk of %d bytes, want %d", v, hackableChunk)
+		}
+	}
+}
+
+func TestHackableRead_Write(t *testing.T) {
+	h := WithRead("ctl", newGenerator(1).read)
+	rwc, err := h.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rwc.Write([]byte("x")); !errors.Is(err, ErrNotAllowed) {
+		t.Fatalf("have [%v], want [%v]", err, ErrNotAllowed)
+	}
+}
@@ -0,0 +1,58 @@
+// SPDX-FileCopyrightText: 2020 jecoz
+//
+// SPDX-License-Identifier: BSD-3-Clause
+
+package file
+
+import (
+	"io"
+	"sync"
+)
+
+type readerWriterAt interface {
+	io.ReaderAt
+	io.WriterAt
+}
+
+// handle is the io.ReadWriteCloser returned when opening files
+// that support offsets. The 9p server uses ReadAt and WriteAt
+// directly, honoring the offsets requested by clients, while
+// Read and Write work sequentially starting from the beginning
+// of the file, just like a freshly opened os.File.
+type handle struct {
+	rw readerWriterAt
+
+	sync.Mutex
+	off int64
+}
+
+func (h *handle) ReadAt(p []byte, off int64) (int, error)  { return h.rw.ReadAt(p, off) }
+func (h *handle) WriteAt(p []byte, off int64) (int, error) { return h.rw.WriteAt(p, off) }
+
+func (h *handle) Read(p []byte) (int, error) {
+	h.Lock()
+	defer h.Unlock()
+	n, err := h.rw.ReadAt(p, h.off)
+	h.off += int64(n)
+	return n, err
+}
+
+func (h *handle) Write(p []byte) (int, error) {
+	h.Lock()
+	defer h.Unlock()
+	n, err := h.rw.WriteAt(p, h.off)
+	h.off += int64(n)
+	return n, err
+}
+
+func (h *handle) Close() error { return nil }
+
+func newHandle(rw readerWriterAt) *handle { return &handle{rw: rw} }
+
+// readOnly turns an io.ReaderAt into a readerWriterAt which
+// writes are not allowed.
+type readOnly struct {
+	io.ReaderAt
+}
+
+func (readOnly) WriteAt([]byte, int64) (int, error) { return 0, WriteNotAllowed }
@@ -0,0 +1,65 @@
+// SPDX-FileCopyrightText: 2020 jecoz
+//
+// SPDX-License-Identifier: BSD-3-Clause
+
+package file
+
+import (
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+func TestHandle(t *testing.T) {
+	b := NewBucket("b", 0644, 0)
+	rwc, err := b.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := rwc.(io.WriterAt)
+
+	tt := []struct {
+		p    string
+		off  int64
+		want string
+	}{
+		{p: "hello", off: 0, want: "hello"},
+		{p: "J", off: 0, want: "Jello"},
+		{p: "XY", off: 7, want: "Jello\x00\x00XY"},
+		{p: "o", off: 5, want: "Jelloo\x00XY"},
+	}
+	for i, v := range tt {
+		if _, err := w.WriteAt([]byte(v.p), v.off); err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		// A new handle reads from the beginning.
+		r, err := b.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		have, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		if string(have) != v.want {
+			t.Fatalf("%d: have %q, want %q", i, have, v.want)
+		}
+	}
+
+	// Sequential writes continue where the previous one
+	// stopped.
+	s := NewBucket("s", 0644, 0)
+	rwc, err = s.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []string{"a", "b", "c"} {
+		if _, err := rwc.Write([]byte(v)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r, _ := s.Open()
+	if have, _ := ioutil.ReadAll(r); string(have) != "abc" {
+		t.Fatalf("have %q, want %q", have, "abc")
+	}
+}
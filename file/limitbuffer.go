@@ -7,6 +7,8 @@ package file
 import (
 	"bytes"
 	"errors"
+	"fmt"
+	"io"
 )
 
 type LimitBuffer struct {
@@ -17,19 +19,69 @@ type LimitBuffer struct {
 func (b *LimitBuffer) Close() error               { return nil }
 func (b *LimitBuffer) Read(p []byte) (int, error) { return b.buf.Read(p) }
 
-// Write writes at most f.Max bytes inside the f.buf.
+// ErrFull is returned when a write would make a LimitBuffer
+// grow past its limit.
+var ErrFull = errors.New("buffer is full")
+
+// Write writes p inside f.buf, unless the write would make the
+// buffer grow past f.Max bytes. In that case nothing is written
+// and ErrFull is returned, so that data is never silently cut.
 // If f.Max is not provided, no boundaries are explicitly set.
 func (b *LimitBuffer) Write(p []byte) (int, error) {
 	if b.Max > 0 && int64(len(p))+b.Size() > b.Max {
-		n := b.Max - b.Size()
-		written, err := b.buf.Write(p[:n])
-		if err != nil {
-			return written, err
-		}
-		return written, errors.New("buffer is full")
+		return 0, fmt.Errorf("%w (max %d bytes)", ErrFull, b.Max)
 	}
 	return b.buf.Write(p)
 }
 
+// Truncate changes the size of the buffer to n. If n is bigger
+// than the current size, the buffer is extended with zeros.
+func (b *LimitBuffer) Truncate(n int64) error {
+	switch {
+	case n < 0:
+		return errors.New("negative size")
+	case b.Max > 0 && n > b.Max:
+		return fmt.Errorf("%w (max %d bytes)", ErrFull, b.Max)
+	case n <= b.Size():
+		b.buf.Truncate(int(n))
+		return nil
+	default:
+		_, err := b.buf.Write(make([]byte, n-b.Size()))
+		return err
+	}
+}
+
+// ReadAt reads the unread portion of the buffer starting at off,
+// without consuming it.
+func (b *LimitBuffer) ReadAt(p []byte, off int64) (int, error) {
+	data := b.buf.Bytes()
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if off >= int64(len(data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// WriteAt writes p at off, extending the buffer with zeros if
+// off is past its end. Just like Write, nothing is written if the
+// buffer would grow past f.Max bytes.
+func (b *LimitBuffer) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if end := off + int64(len(p)); end > b.Size() {
+		if err := b.Truncate(end); err != nil {
+			return 0, err
+		}
+	}
+	return copy(b.buf.Bytes()[off:], p), nil
+}
+
 func (b *LimitBuffer) Bytes() []byte { return b.buf.Bytes() }
 func (b *LimitBuffer) Size() int64   { return int64(b.buf.Len()) }
@@ -10,67 +10,39 @@ import (
 	"path/filepath"
 	"strings"
 
-	"github.com/jecoz/flexi/file"
 	"github.com/jecoz/flexi/fs"
 )
 
 type MemFS struct {
-	Root *file.Dir
+	// Root is usually a file.Dir, or a type embedding it.
+	Root fs.File
 }
 
-func open(path []string, files []fs.File) fs.File {
-	if len(files) == 0 {
-		// We do not have anything more to check!
-		return nil
-	}
-	target := ""
-	if len(path) > 0 {
-		target = path[0]
-	}
+// finder is implemented by directories that can look up their
+// files by name, such as file.Dir.
+type finder interface {
+	Find(name string) (fs.File, error)
+}
 
-	for _, v := range files {
-		info, err := v.Stat()
-		if err != nil || info.Name() != target {
+func (mfs *MemFS) Open(path string) (fs.File, error) {
+	var f fs.File = mfs.Root
+	for _, v := range strings.Split(path, "/") {
+		if v == "" {
+			// Either the root or a repeated slash.
 			continue
 		}
-		if len(path) <= 1 {
-			return v
-		}
-
-		// Reaching this point means the file is relevant,
-		// but we're not yet at the end of the path (on the
-		// right way though).
-		// What we have in our files list does not matter:
-		// the file we're looking for is under this one, hence
-		// we should search in the files contained in this
-		// directory.
-		type hasLs interface {
-			Ls() []fs.File
-		}
-
-		dir, ok := v.(hasLs)
+		dir, ok := f.(finder)
 		if !ok {
-			// We cannot do anything. The file is supposed to
-			// be under this directory, but this is not a
-			// directory.
-			return nil
+			// The file is supposed to be under
+			// this one, which is not a directory.
+			return nil, os.ErrNotExist
+		}
+		var err error
+		if f, err = dir.Find(v); err != nil {
+			return nil, err
 		}
-		return open(path[1:], dir.Ls())
-	}
-	return nil
-}
-
-func (mfs *MemFS) Open(path string) (fs.File, error) {
-	fields := strings.Split(path, "/")
-	if path == "/" {
-		fields = []string{}
-	}
-
-	file := open(fields, []fs.File{mfs.Root})
-	if file == nil {
-		return nil, os.ErrNotExist
 	}
-	return file, nil
+	return f, nil
 }
 
 func (mfs *MemFS) Create(path string, newfile fs.File) error {
@@ -85,6 +57,13 @@ func (mfs *MemFS) Create(path string, newfile fs.File) error {
 	if !ok {
 		return fmt.Errorf("%v is not a directory", path)
 	}
+	info, err := newfile.Stat()
+	if err != nil {
+		return err
+	}
+	if _, err := mfs.Open(filepath.Join(path, info.Name())); err == nil {
+		return os.ErrExist
+	}
 	dir.Append(newfile)
 	return nil
 }
@@ -121,4 +100,25 @@ func (mfs *MemFS) Remove(path string) error {
 	return nil
 }
 
-func New(d *file.Dir) *MemFS { return &MemFS{Root: d} }
+// Rename changes the name of the file at path to name, which
+// must not be taken by any other file in the same directory.
+func (mfs *MemFS) Rename(path, name string) error {
+	if name == "" || strings.Contains(name, "/") {
+		return fmt.Errorf("invalid file name %q", name)
+	}
+	dirpath, oldname := filepath.Split(path)
+	f, err := mfs.Open(dirpath)
+	if err != nil {
+		return err
+	}
+	type hasRename interface {
+		RenameFile(oldname, newname string) error
+	}
+	dir, ok := f.(hasRename)
+	if !ok {
+		return fs.ErrNotSupported
+	}
+	return dir.RenameFile(oldname, name)
+}
+
+func New(root fs.File) *MemFS { return &MemFS{Root: root} }
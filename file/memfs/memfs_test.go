@@ -5,7 +5,11 @@
 package memfs
 
 import (
+	"fmt"
+	"io"
+	"os"
 	"path/filepath"
+	"strconv"
 	"testing"
 
 	"github.com/jecoz/flexi/file"
@@ -47,3 +51,137 @@ func TestOpen(t *testing.T) {
 	}
 
 }
+
+func TestRename(t *testing.T) {
+	root := file.NewDirFiles(
+		"",
+		file.NewBucket("a", 0644, 0),
+		file.NewBucket("b", 0644, 0),
+		file.NewMulti("c"),
+	)
+	fs := New(root)
+
+	if err := fs.Rename("/a", "b"); !os.IsExist(err) {
+		t.Fatalf("renaming to an existing name: have [%v], want [%v]", err, os.ErrExist)
+	}
+	if err := fs.Rename("/c", "d"); err == nil {
+		t.Fatalf("renaming a file that does not support it should fail")
+	}
+	if err := fs.Rename("/a", "d"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Open("/d"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Open("/a"); !os.IsNotExist(err) {
+		t.Fatalf("have [%v], want [%v]", err, os.ErrNotExist)
+	}
+}
+
+// remotesFS returns a namespace that looks like the one of a
+// flexi server with n remotes.
+func remotesFS(n int) *MemFS {
+	root := file.NewDirFiles("", file.NewMulti("clone"))
+	for i := 0; i < n; i++ {
+		root.Append(file.NewDirFiles(
+			strconv.Itoa(i),
+			file.NewMulti("spawn"),
+			file.NewMulti("retv"),
+			file.NewMulti("err"),
+		))
+	}
+	return New(root)
+}
+
+func BenchmarkOpen(b *testing.B) {
+	for _, n := range []int{10, 1000, 10000} {
+		b.Run(strconv.Itoa(n), func(b *testing.B) {
+			fs := remotesFS(n)
+			path := fmt.Sprintf("/%d/retv", n-1)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := fs.Open(path); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// readdirChunk is about the number of entries styx asks for
+// with each Readdir call.
+const readdirChunk = 18
+
+func BenchmarkReaddir(b *testing.B) {
+	for _, n := range []int{10, 1000, 10000} {
+		for _, chunk := range []int{-1, readdirChunk} {
+			b.Run(fmt.Sprintf("%d/%d", n, chunk), func(b *testing.B) {
+				fs := remotesFS(n)
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					rwc, err := fs.Root.Open()
+					if err != nil {
+						b.Fatal(err)
+					}
+					d := rwc.(interface {
+						Readdir(int) ([]os.FileInfo, error)
+					})
+					for {
+						_, err := d.Readdir(chunk)
+						if err == io.EOF {
+							break
+						}
+						if err != nil {
+							b.Fatal(err)
+						}
+						if chunk <= 0 {
+							break
+						}
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestReaddir_Changes(t *testing.T) {
+	fs := remotesFS(2 * readdirChunk)
+	rwc, err := fs.Root.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := rwc.(interface {
+		Readdir(int) ([]os.FileInfo, error)
+	})
+	seen := make(map[string]int)
+	for i := 0; ; i++ {
+		infos, err := d.Readdir(readdirChunk)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, v := range infos {
+			seen[v.Name()]++
+		}
+		if i == 0 {
+			// The directory changes while
+			// it is being listed.
+			if err := fs.Remove("/0"); err != nil {
+				t.Fatal(err)
+			}
+			fs.Root.(*file.Dir).Append(file.NewMulti("new"))
+		}
+	}
+	// The clone file and the remotes present when
+	// the directory was opened.
+	if len(seen) != 2*readdirChunk+1 {
+		t.Fatalf("have %d files listed, want %d", len(seen), 2*readdirChunk+1)
+	}
+	for k, v := range seen {
+		if v != 1 {
+			t.Fatalf("%v listed %d times", k, v)
+		}
+	}
+}
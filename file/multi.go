@@ -5,7 +5,6 @@
 package file
 
 import (
-	"bytes"
 	"io"
 	"os"
 	"sync"
@@ -35,12 +34,23 @@ func (m *Multi) Close() error {
 	return m.buf.Close()
 }
 
-func (m *Multi) Open() (io.ReadWriteCloser, error) {
+// Reset discards the contents of m. It is not named Truncate,
+// as m is read-only to clients.
+func (m *Multi) Reset() error {
 	m.Lock()
 	defer m.Unlock()
-	return &LimitBuffer{
-		buf: *bytes.NewBuffer(m.buf.Bytes()),
-	}, nil
+	m.modTime = time.Now()
+	return m.buf.Truncate(0)
+}
+
+// Open returns a read-only handle on the contents of m. Reads
+// see what was written to m after the handle was opened too.
+func (m *Multi) Open() (io.ReadWriteCloser, error) { return newHandle(readOnly{m}), nil }
+
+func (m *Multi) ReadAt(p []byte, off int64) (int, error) {
+	m.RLock()
+	defer m.RUnlock()
+	return m.buf.ReadAt(p, off)
 }
 
 func (m *Multi) Stat() (os.FileInfo, error) {
@@ -13,8 +13,9 @@ import (
 )
 
 type Plumber struct {
-	f    func(*Plumber) bool
-	name string
+	f     func(*Plumber) bool
+	check func(*Plumber) error
+	name  string
 
 	sync.Mutex
 	buf     *LimitBuffer
@@ -60,6 +61,21 @@ func (p *Plumber) Write(b []byte) (int, error) {
 	return p.buf.Write(b)
 }
 
+func (p *Plumber) ReadAt(b []byte, off int64) (int, error) {
+	p.Lock()
+	defer p.Unlock()
+	return p.buf.ReadAt(b, off)
+}
+
+func (p *Plumber) WriteAt(b []byte, off int64) (int, error) {
+	p.Lock()
+	defer p.Unlock()
+	if p.plumbed {
+		return 0, errors.New("plumbed already")
+	}
+	return p.buf.WriteAt(b, off)
+}
+
 func (p *Plumber) Close() error {
 	p.Lock()
 
@@ -81,6 +97,16 @@ func (p *Plumber) Close() error {
 	p.Unlock()
 
 	// Note that from this point on the p is unlocked.
+	if p.check != nil && p.Size() > 0 {
+		if err := p.check(p); err != nil {
+			// Discard the data, callers are supposed
+			// to try again later.
+			p.Lock()
+			p.buf = &LimitBuffer{}
+			p.Unlock()
+			return err
+		}
+	}
 	if p.Size() > 0 {
 		p.plumbed = p.f(p)
 	}
@@ -90,3 +116,13 @@ func (p *Plumber) Close() error {
 func NewPlumber(name string, f func(*Plumber) bool) *Plumber {
 	return &Plumber{name: name, f: f, buf: &LimitBuffer{}, modTime: time.Now()}
 }
+
+// NewPlumberCheck works like NewPlumber, but check is called
+// before plumbing. If check returns an error, the buffered data
+// is discarded, the error is returned by Close and f is not
+// called.
+func NewPlumberCheck(name string, check func(*Plumber) error, f func(*Plumber) bool) *Plumber {
+	p := NewPlumber(name, f)
+	p.check = check
+	return p
+}
@@ -7,6 +7,8 @@ package file
 import (
 	"io"
 	"os"
+	"path/filepath"
+	"time"
 )
 
 type Regular struct {
@@ -27,6 +29,55 @@ func (r *Regular) Stat() (os.FileInfo, error) {
 }
 func (r *Regular) Close() error { return nil }
 
+func (r *Regular) Truncate(size int64) error      { return os.Truncate(r.path, size) }
+func (r *Regular) SetMode(mode os.FileMode) error { return os.Chmod(r.path, mode) }
+func (r *Regular) SetModTime(t time.Time) error   { return os.Chtimes(r.path, t, t) }
+func (r *Regular) Rename(name string) error {
+	path := filepath.Join(filepath.Dir(r.path), name)
+	if err := os.Rename(r.path, path); err != nil {
+		return err
+	}
+	r.path = path
+	return nil
+}
+
 func NewRegular(path string, i os.FileInfo) *Regular {
 	return &Regular{path: path, info: i}
 }
+
+// ReadOnlyRegular is a disk file that clients can only read.
+// It does not support changing any attribute of the file.
+type ReadOnlyRegular struct {
+	path string
+}
+
+func (r *ReadOnlyRegular) Open() (io.ReadWriteCloser, error) {
+	f, err := os.Open(r.path)
+	if err != nil {
+		return nil, err
+	}
+	return readOnlyFile{f}, nil
+}
+
+func (r *ReadOnlyRegular) Stat() (os.FileInfo, error) {
+	i, err := os.Stat(r.path)
+	if err != nil {
+		return nil, err
+	}
+	return Info{
+		name:    i.Name(),
+		size:    i.Size(),
+		mode:    i.Mode() &^ 0222,
+		modTime: i.ModTime(),
+	}, nil
+}
+
+func (r *ReadOnlyRegular) Close() error { return nil }
+
+func NewReadOnlyRegular(path string) *ReadOnlyRegular {
+	return &ReadOnlyRegular{path: path}
+}
+
+type readOnlyFile struct{ *os.File }
+
+func (readOnlyFile) Write([]byte) (int, error) { return 0, WriteNotAllowed }
@@ -0,0 +1,56 @@
+// SPDX-FileCopyrightText: 2020 jecoz
+//
+// SPDX-License-Identifier: BSD-3-Clause
+
+package file
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Snapshot is a read-only file which contents are generated
+// each time the file is opened. Use it to expose reports that
+// change over time, such as usage or status information.
+type Snapshot struct {
+	name string
+	f    func() []byte
+
+	sync.Mutex
+	modTime time.Time
+}
+
+type snapshotReader struct {
+	*bytes.Reader
+}
+
+func (r *snapshotReader) Write(p []byte) (int, error) { return 0, WriteNotAllowed }
+func (r *snapshotReader) Close() error                { return nil }
+
+func (s *Snapshot) Open() (io.ReadWriteCloser, error) {
+	s.Lock()
+	defer s.Unlock()
+	s.modTime = time.Now()
+	return &snapshotReader{Reader: bytes.NewReader(s.f())}, nil
+}
+
+func (s *Snapshot) Stat() (os.FileInfo, error) {
+	s.Lock()
+	defer s.Unlock()
+	return Info{
+		name:    s.name,
+		size:    int64(len(s.f())),
+		mode:    0444,
+		modTime: s.modTime,
+		isDir:   false,
+	}, nil
+}
+
+func (s *Snapshot) Close() error { return nil }
+
+func NewSnapshot(name string, f func() []byte) *Snapshot {
+	return &Snapshot{name: name, f: f, modTime: time.Now()}
+}
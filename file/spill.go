@@ -0,0 +1,188 @@
+// SPDX-FileCopyrightText: 2020 jecoz
+//
+// SPDX-License-Identifier: BSD-3-Clause
+
+package file
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// Spill is a file that keeps its contents in memory till they
+// grow past a threshold. After that, contents are moved to a
+// temporary file on disk, which is removed when Spill is closed.
+type Spill struct {
+	name      string
+	dir       string
+	threshold int64
+	max       int64
+
+	sync.Mutex
+	mode    os.FileMode
+	modTime time.Time
+	mem     []byte
+	disk    *os.File
+	size    int64
+}
+
+// spill moves the contents of s to disk. Call with s locked.
+func (s *Spill) spill() error {
+	f, err := ioutil.TempFile(s.dir, "spill-")
+	if err != nil {
+		return fmt.Errorf("spill %v: %w", s.name, err)
+	}
+	if _, err := f.Write(s.mem); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return fmt.Errorf("spill %v: %w", s.name, err)
+	}
+	s.disk = f
+	s.mem = nil
+	return nil
+}
+
+func (s *Spill) ReadAt(p []byte, off int64) (int, error) {
+	s.Lock()
+	defer s.Unlock()
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if off >= s.size {
+		return 0, io.EOF
+	}
+	if s.disk != nil {
+		return s.disk.ReadAt(p, off)
+	}
+	n := copy(p, s.mem[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (s *Spill) WriteAt(p []byte, off int64) (int, error) {
+	s.Lock()
+	defer s.Unlock()
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	end := off + int64(len(p))
+	if s.max > 0 && end > s.max {
+		return 0, fmt.Errorf("%w (max %d bytes)", ErrFull, s.max)
+	}
+	if s.disk == nil && end > s.threshold {
+		if err := s.spill(); err != nil {
+			return 0, err
+		}
+	}
+	s.modTime = time.Now()
+	if s.disk != nil {
+		n, err := s.disk.WriteAt(p, off)
+		if end := off + int64(n); end > s.size {
+			s.size = end
+		}
+		return n, err
+	}
+	if end > int64(len(s.mem)) {
+		s.mem = append(s.mem, make([]byte, end-int64(len(s.mem)))...)
+	}
+	copy(s.mem[off:], p)
+	if end > s.size {
+		s.size = end
+	}
+	return len(p), nil
+}
+
+func (s *Spill) Open() (io.ReadWriteCloser, error) { return newHandle(s), nil }
+
+func (s *Spill) Stat() (os.FileInfo, error) {
+	s.Lock()
+	defer s.Unlock()
+	return Info{
+		name:    s.name,
+		size:    s.size,
+		mode:    s.mode,
+		modTime: s.modTime,
+	}, nil
+}
+
+// Close releases the disk space used by s, if any.
+func (s *Spill) Close() error {
+	s.Lock()
+	defer s.Unlock()
+	s.mem = nil
+	s.size = 0
+	if s.disk == nil {
+		return nil
+	}
+	f := s.disk
+	s.disk = nil
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+func (s *Spill) Truncate(size int64) error {
+	s.Lock()
+	defer s.Unlock()
+	if s.max > 0 && size > s.max {
+		return fmt.Errorf("%w (max %d bytes)", ErrFull, s.max)
+	}
+	if s.disk == nil && size > s.threshold {
+		if err := s.spill(); err != nil {
+			return err
+		}
+	}
+	s.modTime = time.Now()
+	if s.disk != nil {
+		if err := s.disk.Truncate(size); err != nil {
+			return err
+		}
+	} else if size <= int64(len(s.mem)) {
+		s.mem = s.mem[:size]
+	} else {
+		s.mem = append(s.mem, make([]byte, size-int64(len(s.mem)))...)
+	}
+	s.size = size
+	return nil
+}
+
+func (s *Spill) SetMode(mode os.FileMode) error {
+	s.Lock()
+	defer s.Unlock()
+	s.mode = mode
+	return nil
+}
+
+func (s *Spill) Rename(name string) error {
+	s.Lock()
+	defer s.Unlock()
+	s.name = name
+	return nil
+}
+
+func (s *Spill) SetModTime(t time.Time) error {
+	s.Lock()
+	defer s.Unlock()
+	s.modTime = t
+	return nil
+}
+
+// NewSpill returns a file which contents are moved inside dir
+// when they grow bigger than threshold bytes. Writes that would
+// make the file bigger than max fail, unless max is zero.
+func NewSpill(name string, mode os.FileMode, dir string, threshold, max int64) *Spill {
+	return &Spill{
+		name:      name,
+		mode:      mode,
+		dir:       dir,
+		threshold: threshold,
+		max:       max,
+		modTime:   time.Now(),
+	}
+}
@@ -5,10 +5,16 @@
 package fs
 
 import (
+	"errors"
 	"io"
 	"os"
+	"time"
 )
 
+// ErrNotSupported is returned when a file does not support
+// the requested operation.
+var ErrNotSupported = errors.New("operation not supported")
+
 // File describes the minimal list of functions
 // required to interact with a file in flexi's
 // context.
@@ -27,6 +33,53 @@ type File interface {
 	Close() error
 }
 
+// UserFile is implemented by files which behavior depends
+// on the 9p user that is opening them.
+type UserFile interface {
+	OpenUser(user string) (io.ReadWriteCloser, error)
+}
+
+// The following interfaces are optionally implemented by files
+// that support changing their attributes.
+
+// Truncater is implemented by files which size can be changed.
+type Truncater interface {
+	Truncate(size int64) error
+}
+
+// Moder is implemented by files which mode can be changed.
+type Moder interface {
+	SetMode(mode os.FileMode) error
+}
+
+// Renamer is implemented by files which name can be changed.
+// name is the new base name of the file.
+type Renamer interface {
+	Rename(name string) error
+}
+
+// Toucher is implemented by files which modification time
+// can be changed.
+type Toucher interface {
+	SetModTime(t time.Time) error
+}
+
+// Removable is implemented by the files of the server that
+// clients are allowed to remove, such as remotes, when Removable
+// returns true. Files created by clients can always be removed.
+type Removable interface {
+	Removable() bool
+}
+
+// Creator is implemented by directories that decide which file
+// is created when a client asks for a new file called name
+// inside them. The created file is added to the directory by
+// Create itself. Returning an error wrapping ErrNotSupported
+// lets the file-system create an ordinary file instead.
+type Creator interface {
+	Create(name string, mode os.FileMode) (File, error)
+}
+
 type Directory interface {
 	Readdir(n int) ([]os.FileInfo, error)
 }
@@ -36,6 +89,12 @@ type RoFS interface {
 	Open(path string) (File, error)
 }
 
+// RenameFS is implemented by file-systems that support
+// renaming files within their directory.
+type RenameFS interface {
+	Rename(path, name string) error
+}
+
 type FS interface {
 	RoFS
 	// Create adds newfile at path within FS.
@@ -0,0 +1,375 @@
+// SPDX-FileCopyrightText: 2020 jecoz
+//
+// SPDX-License-Identifier: BSD-3-Clause
+
+package flexi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jecoz/flexi/file"
+	"github.com/jecoz/flexi/fs"
+)
+
+const (
+	DefaultJobRetention = time.Hour
+	DefaultJobTimeout   = time.Hour
+	DefaultJobPoll      = time.Second
+)
+
+// Jobs configures the jobs directory, where users run tasks in
+// a single step. Reading jobs/clone creates a job directory.
+// Writing
+//
+//	{"task": <spawn payload>, "input": <worker input>}
+//
+// to its job file spawns a worker remote process, feeds it the
+// input, waits for it to finish, copies its retv and err files
+// inside the job directory and kills it. Writing
+//
+//	{"task": <spawn payload>, "workers": 8, "retries": 2}
+//	<input 0>
+//	<input 1>
+//	...
+//
+// to the map file instead runs every input on its own worker,
+// collecting the results in the out file, one JSON line per input
+// following their order. Job directories are removed once the
+// retention period is over.
+type Jobs struct {
+	// Retention is how long finished jobs are kept.
+	// Defaults to DefaultJobRetention.
+	Retention time.Duration
+	// Timeout limits the time workers are given to complete
+	// their task. Defaults to DefaultJobTimeout.
+	Timeout time.Duration
+	// Poll is the interval between checks of the worker
+	// state. Defaults to DefaultJobPoll.
+	Poll time.Duration
+	// Workers is the maximum number of workers a map job or
+	// a pipeline runs at once. Defaults to DefaultMapWorkers.
+	Workers int
+	// Retries is the number of times failed map job items
+	// are run again, unless the request says otherwise.
+	Retries int
+}
+
+func (j *Jobs) retention() time.Duration {
+	if j.Retention <= 0 {
+		return DefaultJobRetention
+	}
+	return j.Retention
+}
+
+func (j *Jobs) timeout() time.Duration {
+	if j.Timeout <= 0 {
+		return DefaultJobTimeout
+	}
+	return j.Timeout
+}
+
+func (j *Jobs) poll() time.Duration {
+	if j.Poll <= 0 {
+		return DefaultJobPoll
+	}
+	return j.Poll
+}
+
+type jobRequest struct {
+	// Task is the spawn payload of the worker. Strings are
+	// taken verbatim, so that they can name a template.
+	Task json.RawMessage `json:"task"`
+	// Input is written to the in file of the worker. Just
+	// like Task, strings are taken verbatim.
+	Input json.RawMessage `json:"input"`
+}
+
+// verbatim returns the contents of raw, if it is a JSON string,
+// or raw itself.
+func verbatim(raw json.RawMessage) []byte {
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return []byte(s)
+	}
+	return raw
+}
+
+func parseJobRequest(r io.Reader) (task, input []byte, err error) {
+	var req jobRequest
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		return nil, nil, fmt.Errorf("decode job: %w", err)
+	}
+	if len(req.Task) == 0 {
+		return nil, nil, fmt.Errorf("decode job: task is required")
+	}
+	return verbatim(req.Task), verbatim(req.Input), nil
+}
+
+// job is the directory of a job. Removing it cancels the job.
+type job struct {
+	*file.Dir
+	kind string
+	name string
+	user string
+	srv  *Srv
+
+	state, retv, err *file.Multi
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	once   sync.Once
+	done   func()
+
+	mu      sync.Mutex
+	started bool
+}
+
+// start marks j as started. Returns an error if it was already.
+func (j *job) start(*file.Plumber) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.started {
+		return errors.New("job started already")
+	}
+	j.started = true
+	return nil
+}
+
+// plumb returns a function that runs the request written to a
+// job file with f, removing the job once the retention period
+// is over.
+func (j *job) plumb(f func(*file.Plumber) (func(), error)) func(*file.Plumber) bool {
+	return func(p *file.Plumber) bool {
+		run, err := f(p)
+		go func() {
+			if err != nil {
+				h := NewProcessHelper(&Stdio{Err: j.err, State: j.state}, 1)
+				h.Err(err)
+				h.Done()
+			} else {
+				run()
+			}
+			e := Event{Type: EventJobDone, Job: j.kind + "/" + j.name, User: j.user}
+			e.Error = errorMessage(readAll(j.err))
+			j.srv.notify(e, nil)
+			time.AfterFunc(j.srv.Jobs.retention(), func() { j.Close() })
+		}()
+		return true
+	}
+}
+
+func (j *job) Close() error {
+	j.once.Do(func() {
+		j.cancel()
+		j.Dir.Close()
+		j.done()
+	})
+	return nil
+}
+
+// workerDone reports whether the last progress line written in
+// a worker state file marks the end of the execution.
+func workerDone(state []byte) bool {
+	lines := strings.Split(strings.TrimSpace(string(state)), "\n")
+	progress := strings.SplitN(lines[len(lines)-1], ",", 2)[0]
+	p, err := strconv.ParseFloat(progress, 64)
+	return err == nil && p >= 1
+}
+
+// maxStateErrors is the number of consecutive failed reads of
+// the state file after which a worker is considered gone.
+const maxStateErrors = 10
+
+func waitWorker(ctx context.Context, path string, poll time.Duration) error {
+	ticker := time.NewTicker(poll)
+	defer ticker.Stop()
+	failures := 0
+	for {
+		b, err := ioutil.ReadFile(filepath.Join(path, "state"))
+		switch {
+		case err == nil && workerDone(b):
+			return nil
+		case err != nil:
+			if failures++; failures >= maxStateErrors {
+				return fmt.Errorf("wait worker: %w", err)
+			}
+		default:
+			failures = 0
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return fmt.Errorf("wait worker: %w", ctx.Err())
+		}
+	}
+}
+
+func writeInput(path string, input []byte) error {
+	f, err := os.OpenFile(filepath.Join(path, "in"), os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(input); err != nil {
+		f.Close()
+		return err
+	}
+	// The worker starts when in is closed.
+	return f.Close()
+}
+
+func readAll(f fs.File) []byte {
+	rwc, err := f.Open()
+	if err != nil {
+		return nil
+	}
+	defer rwc.Close()
+	b, _ := ioutil.ReadAll(rwc)
+	return b
+}
+
+// runWorker runs input on a new worker, a remote of the root
+// namespace that is not listed anywhere, and returns the contents
+// of its retv and err files. The worker is killed before
+// returning. progress, if present, is called as the worker goes
+// through steps 1 to 5.
+func (j *job) runWorker(ctx context.Context, task, input []byte, progress func(int, string, ...interface{})) (retv, errb []byte, err error) {
+	if progress == nil {
+		progress = func(int, string, ...interface{}) {}
+	}
+	log := j.srv.log().With("job", j.name, "user", j.user)
+
+	progress(1, "spawning worker")
+	r, err := j.srv.root.newRemote(j.user)
+	if err != nil {
+		return nil, nil, fmt.Errorf("create worker: %w", err)
+	}
+	defer func() {
+		if err := r.Close(); err != nil {
+			log.Error("unable to kill worker", "remote", r.Name, "error", err)
+		}
+	}()
+	if j.srv.Queue == nil {
+		// Otherwise the queue checks the spawn rate.
+		if err := r.ns.checkSpawn(); err != nil {
+			return nil, nil, fmt.Errorf("spawn worker: %w", err)
+		}
+	}
+
+	spawnErr, spawnState := file.NewMulti("err"), file.NewMulti("state")
+	r.mirrorRemoteProcess(ctx, r.mountpoint(), &Stdio{
+		In:    bytes.NewReader(task),
+		Err:   spawnErr,
+		State: spawnState,
+	}, r.id)
+	rp := r.process()
+	if rp == nil {
+		return nil, nil, fmt.Errorf("spawn worker: %w", docError(readAll(spawnErr)))
+	}
+	path := r.mountpoint()
+	progress(2, "worker spawned @ %v", rp.Addr)
+	log.Info("job worker spawned", "remote", r.Name, "addr", rp.Addr)
+
+	ctx, cancel := context.WithTimeout(ctx, j.srv.Jobs.timeout())
+	defer cancel()
+	if err := writeInput(path, input); err != nil {
+		return nil, nil, fmt.Errorf("write worker input: %w", err)
+	}
+	progress(3, "input sent, waiting for the worker")
+	if err := waitWorker(ctx, path, j.srv.Jobs.poll()); err != nil {
+		return nil, nil, err
+	}
+
+	progress(4, "copying results")
+	if retv, err = ioutil.ReadFile(filepath.Join(path, "retv")); err != nil && !os.IsNotExist(err) {
+		return nil, nil, fmt.Errorf("read worker retv: %w", err)
+	}
+	if errb, err = ioutil.ReadFile(filepath.Join(path, "err")); err != nil && !os.IsNotExist(err) {
+		return nil, nil, fmt.Errorf("read worker err: %w", err)
+	}
+	progress(5, "killing worker")
+	return retv, errb, nil
+}
+
+func (j *job) run(task, input []byte) {
+	h := NewProcessHelper(&Stdio{Err: j.err, Retv: j.retv, State: j.state}, 6)
+	defer h.Done()
+
+	retv, errb, err := j.runWorker(j.ctx, task, input, h.Progress)
+	if err != nil {
+		j.srv.log().Error("job failed", "job", j.name, "user", j.user, "error", err)
+		h.Err(err)
+		return
+	}
+	j.retv.Write(retv)
+	j.err.Write(errb)
+	j.srv.log().Info("job done", "job", j.name, "user", j.user)
+}
+
+// jobRequests returns the files that start an ordinary or a
+// map job.
+func (s *Srv) jobRequests(j *job) []fs.File {
+	request := file.NewPlumberCheck("job", j.start, j.plumb(func(p *file.Plumber) (func(), error) {
+		task, input, err := parseJobRequest(p)
+		return func() { j.run(task, input) }, err
+	}))
+	mapRequest := file.NewPlumberCheck("map", j.start, j.plumb(func(p *file.Plumber) (func(), error) {
+		m, err := s.Jobs.parseMapRequest(p)
+		return func() { j.runMap(m) }, err
+	}))
+	return []fs.File{request, mapRequest}
+}
+
+// jobsDir returns a directory whose clone file creates jobs,
+// each holding the request files returned by requests.
+func (s *Srv) jobsDir(dirname string, requests func(*job) []fs.File) fs.File {
+	pool := &idPool{dir: "/" + dirname}
+	var dir *file.Dir
+	clone := file.WithUserRead("clone", func(user string, p []byte) (int, error) {
+		id, err := pool.Get()
+		if err != nil {
+			return 0, err
+		}
+		name := strconv.Itoa(id)
+		j := &job{
+			kind:  dirname,
+			name:  name,
+			user:  user,
+			srv:   s,
+			state: file.NewMulti("state"),
+			retv:  file.NewMulti("retv"),
+			err:   file.NewMulti("err"),
+		}
+		j.ctx, j.cancel = context.WithCancel(context.Background())
+		j.done = func() {
+			dir.Remove(j)
+			pool.Put(id)
+		}
+		files := append(requests(j), j.state, j.retv, j.err)
+		j.Dir = file.NewDirFiles(name, files...)
+
+		b := []byte(name + "\n")
+		if len(b) > len(p) {
+			j.cancel()
+			pool.Put(id)
+			return 0, io.ErrShortBuffer
+		}
+		dir.Append(j)
+		return copy(p, b), io.EOF
+	})
+	dir = file.NewDirFiles(dirname, clone)
+	return dir
+}
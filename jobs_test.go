@@ -0,0 +1,131 @@
+// SPDX-FileCopyrightText: 2020 jecoz
+//
+// SPDX-License-Identifier: BSD-3-Clause
+
+package flexi
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWorkerDone(t *testing.T) {
+	tt := []struct {
+		state string
+		done  bool
+	}{
+		{"", false},
+		{"0.16,spawning\n", false},
+		{"0.16,spawning\n0.5,running\n", false},
+		{"0.5,running\n1,done\n", true},
+		{"1\n", true},
+		{"garbage\n", false},
+	}
+	for i, v := range tt {
+		if done := workerDone([]byte(v.state)); done != v.done {
+			t.Fatalf("%d: unexpected done: wanted %v, found %v", i, v.done, done)
+		}
+	}
+}
+
+func TestParseJobRequest(t *testing.T) {
+	tt := []struct {
+		in    string
+		task  string
+		input string
+		err   bool
+	}{
+		{in: `{"task": "echo64", "input": "hello"}`, task: "echo64", input: "hello"},
+		{in: `{"task": {"image": {}}, "input": {"a": 1}}`, task: `{"image": {}}`, input: `{"a": 1}`},
+		{in: `{"task": "echo64"}`, task: "echo64"},
+		{in: `{"input": "hello"}`, err: true},
+		{in: `{"task": "echo64", "extra": 1}`, err: true},
+		{in: `not json`, err: true},
+	}
+	for i, v := range tt {
+		task, input, err := parseJobRequest(strings.NewReader(v.in))
+		if v.err {
+			if err == nil {
+				t.Fatalf("%d: expected an error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%d: unexpected error: %v", i, err)
+		}
+		if string(task) != v.task {
+			t.Fatalf("%d: unexpected task: wanted %q, found %q", i, v.task, task)
+		}
+		if string(input) != v.input {
+			t.Fatalf("%d: unexpected input: wanted %q, found %q", i, v.input, input)
+		}
+	}
+}
+
+func TestParseMapRequest(t *testing.T) {
+	jobs := &Jobs{Workers: 4, Retries: 1}
+	tt := []struct {
+		in      string
+		inputs  []string
+		workers int
+		retries int
+		err     bool
+	}{
+		{
+			in:      "{\"task\": \"echo64\"}\n\"a\"\n{\"b\": 1}\n",
+			inputs:  []string{"a", `{"b": 1}`},
+			workers: 4,
+			retries: 1,
+		},
+		{
+			in:      "{\"task\": \"echo64\", \"workers\": 2, \"retries\": 0}\n\"a\"\n",
+			inputs:  []string{"a"},
+			workers: 2,
+			retries: 0,
+		},
+		{
+			in:      "{\"task\": \"echo64\", \"workers\": 64}\n\"a\"\n",
+			inputs:  []string{"a"},
+			workers: 4,
+			retries: 1,
+		},
+		{in: "{\"task\": \"echo64\"}\n", err: true},
+		{in: "{\"inputs\": []}\n\"a\"\n", err: true},
+		{in: "{\"task\": \"echo64\", \"retries\": -1}\n\"a\"\n", err: true},
+		{in: "{\"task\": \"echo64\"}\n\"a\"\n{\n", err: true},
+	}
+	for i, v := range tt {
+		m, err := jobs.parseMapRequest(strings.NewReader(v.in))
+		if v.err {
+			if err == nil {
+				t.Fatalf("%d: expected an error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%d: unexpected error: %v", i, err)
+		}
+		if m.workers != v.workers || m.retries != v.retries {
+			t.Fatalf("%d: unexpected workers/retries: wanted %d/%d, found %d/%d", i, v.workers, v.retries, m.workers, m.retries)
+		}
+		if len(m.inputs) != len(v.inputs) {
+			t.Fatalf("%d: unexpected inputs: wanted %q, found %q", i, v.inputs, m.inputs)
+		}
+		for j, input := range m.inputs {
+			if string(input) != v.inputs[j] {
+				t.Fatalf("%d: unexpected input %d: wanted %q, found %q", i, j, v.inputs[j], input)
+			}
+		}
+	}
+}
+
+func TestWaitWorker_Gone(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := waitWorker(ctx, "testdata/no-such-worker", time.Millisecond); err == nil || errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("have [%v], want a read error", err)
+	}
+}
@@ -0,0 +1,125 @@
+// SPDX-FileCopyrightText: 2020 jecoz
+//
+// SPDX-License-Identifier: BSD-3-Clause
+
+package flexi
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// alive reports whether the remote process mounted at path
+// answers within timeout. returned is called once the check is
+// over, which might happen long after alive returns.
+func alive(path string, timeout time.Duration, returned func()) bool {
+	done := make(chan error, 1)
+	go func() {
+		// Stat on an unreachable mount might block
+		// for a long time, in which case this goroutine
+		// is left behind.
+		_, err := os.Stat(filepath.Join(path, "state"))
+		returned()
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		return err == nil
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// remotes returns the remotes of every namespace that have a
+// remote process.
+func (s *Srv) remotes() []*Remote {
+	s.nsmu.Lock()
+	namespaces := make([]*namespace, 0, len(s.namespaces))
+	for _, ns := range s.namespaces {
+		namespaces = append(namespaces, ns)
+	}
+	s.nsmu.Unlock()
+
+	var remotes []*Remote
+	for _, ns := range namespaces {
+		for _, f := range ns.dir.Ls() {
+			if r, ok := f.(*Remote); ok && r.process() != nil {
+				remotes = append(remotes, r)
+			}
+		}
+	}
+	return remotes
+}
+
+// livenessWorkers is the maximum number of remotes probed at once.
+const livenessWorkers = 8
+
+// livenessTimeout is how long a remote has to answer a probe, unless
+// the liveness interval is shorter.
+const livenessTimeout = 5 * time.Second
+
+// checkLiveness checks the remotes every interval until stop is
+// closed. Remotes that do not answer are reported once, with a
+// remote.dead event. Remotes whose previous check is still
+// blocked are skipped, so that hung mounts do not pile up
+// goroutines.
+func (s *Srv) checkLiveness(interval time.Duration, stop <-chan struct{}) {
+	timeout := livenessTimeout
+	if interval < timeout {
+		timeout = interval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+		remotes := make(chan *Remote)
+		var wg sync.WaitGroup
+		for w := 0; w < livenessWorkers; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for r := range remotes {
+					s.checkRemote(r, timeout)
+				}
+			}()
+		}
+		for _, r := range s.remotes() {
+			remotes <- r
+		}
+		close(remotes)
+		wg.Wait()
+	}
+}
+
+// checkRemote checks whether r answers within timeout, reporting it
+// as dead otherwise.
+func (s *Srv) checkRemote(r *Remote, timeout time.Duration) {
+	r.mu.Lock()
+	skip := r.dead || r.probing
+	if !skip {
+		r.probing = true
+	}
+	r.mu.Unlock()
+	if skip {
+		return
+	}
+	returned := func() {
+		r.mu.Lock()
+		r.probing = false
+		r.mu.Unlock()
+	}
+	if alive(r.mountpoint(), timeout, returned) {
+		return
+	}
+	r.mu.Lock()
+	r.dead = true
+	r.mu.Unlock()
+	r.log.Error("remote process is not answering")
+	s.notify(r.event(EventRemoteDead, nil), r.targets())
+}
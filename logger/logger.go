@@ -0,0 +1,174 @@
+// SPDX-FileCopyrightText: 2020 jecoz
+//
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package logger provides the leveled, structured logger used
+// across flexi.
+package logger
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Level int
+
+const (
+	Debug Level = iota
+	Info
+	Error
+)
+
+func (l Level) String() string {
+	switch l {
+	case Debug:
+		return "debug"
+	case Info:
+		return "info"
+	case Error:
+		return "error"
+	default:
+		return fmt.Sprintf("level(%d)", int(l))
+	}
+}
+
+func ParseLevel(s string) (Level, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return Debug, nil
+	case "info":
+		return Info, nil
+	case "error":
+		return Error, nil
+	default:
+		return Info, fmt.Errorf("unknown log level %q", s)
+	}
+}
+
+// Logger writes log lines made of a message and a list of
+// key value pairs.
+type Logger interface {
+	Debug(msg string, kv ...interface{})
+	Info(msg string, kv ...interface{})
+	Error(msg string, kv ...interface{})
+	// With returns a Logger that adds kv to each line.
+	With(kv ...interface{}) Logger
+}
+
+type logger struct {
+	out   *output
+	level Level
+	kv    []interface{}
+}
+
+// output is shared by loggers derived with With.
+type output struct {
+	sync.Mutex
+	w    io.Writer
+	json bool
+}
+
+// New returns a Logger writing lines with at least level to w.
+// Lines are JSON objects if json is true, otherwise they are
+// encoded as logfmt-like text.
+func New(w io.Writer, level Level, json bool) Logger {
+	return &logger{out: &output{w: w, json: json}, level: level}
+}
+
+// Default is the Logger used when none is provided.
+var Default = New(os.Stderr, Info, false)
+
+// Nop discards everything.
+var Nop Logger = nop{}
+
+func (l *logger) Debug(msg string, kv ...interface{}) { l.log(Debug, msg, kv) }
+func (l *logger) Info(msg string, kv ...interface{})  { l.log(Info, msg, kv) }
+func (l *logger) Error(msg string, kv ...interface{}) { l.log(Error, msg, kv) }
+
+func (l *logger) With(kv ...interface{}) Logger {
+	all := make([]interface{}, 0, len(l.kv)+len(kv))
+	all = append(append(all, l.kv...), kv...)
+	return &logger{out: l.out, level: l.level, kv: all}
+}
+
+func value(v interface{}) interface{} {
+	switch t := v.(type) {
+	case error:
+		return t.Error()
+	case fmt.Stringer:
+		return t.String()
+	default:
+		return v
+	}
+}
+
+func (l *logger) log(level Level, msg string, kv []interface{}) {
+	if level < l.level {
+		return
+	}
+	all := append(append(make([]interface{}, 0, len(l.kv)+len(kv)), l.kv...), kv...)
+	if len(all)%2 != 0 {
+		all = append(all, "(missing)")
+	}
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+
+	var line []byte
+	if l.out.json {
+		fields := make(map[string]interface{}, len(all)/2+3)
+		for i := 0; i < len(all); i += 2 {
+			fields[fmt.Sprint(all[i])] = value(all[i+1])
+		}
+		fields["time"] = now
+		fields["level"] = level.String()
+		fields["msg"] = msg
+		b, err := json.Marshal(fields)
+		if err != nil {
+			b = []byte(fmt.Sprintf(`{"time":%q,"level":"error","msg":"unable to encode log line: %v"}`, now, err))
+		}
+		line = append(b, '\n')
+	} else {
+		var sb strings.Builder
+		fmt.Fprintf(&sb, "%s %s %q", now, level, msg)
+		for i := 0; i < len(all); i += 2 {
+			v := fmt.Sprint(value(all[i+1]))
+			if v == "" || strings.ContainsAny(v, " \t\n\"=") {
+				v = fmt.Sprintf("%q", v)
+			}
+			fmt.Fprintf(&sb, " %v=%s", all[i], v)
+		}
+		sb.WriteByte('\n')
+		line = []byte(sb.String())
+	}
+
+	l.out.Lock()
+	defer l.out.Unlock()
+	l.out.w.Write(line)
+}
+
+type nop struct{}
+
+func (nop) Debug(string, ...interface{}) {}
+func (nop) Info(string, ...interface{})  {}
+func (nop) Error(string, ...interface{}) {}
+func (nop) With(...interface{}) Logger   { return nop{} }
+
+type ctxKey struct{}
+
+// NewContext returns a context carrying l.
+func NewContext(ctx context.Context, l Logger) context.Context {
+	return context.WithValue(ctx, ctxKey{}, l)
+}
+
+// FromContext returns the Logger carried by ctx, or Default.
+func FromContext(ctx context.Context) Logger {
+	if l, ok := ctx.Value(ctxKey{}).(Logger); ok {
+		return l
+	}
+	return Default
+}
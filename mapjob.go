@@ -0,0 +1,208 @@
+// SPDX-FileCopyrightText: 2020 jecoz
+//
+// SPDX-License-Identifier: BSD-3-Clause
+
+package flexi
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/jecoz/flexi/file"
+)
+
+// DefaultMapWorkers is the maximum number of workers a map
+// job runs at once, unless configured otherwise.
+const DefaultMapWorkers = 4
+
+// mapRequest is the first JSON value written to the map file
+// of a job. It is followed by the inputs, one per line.
+type mapRequest struct {
+	Task json.RawMessage `json:"task"`
+	// Workers is the number of workers to run at once,
+	// which cannot exceed the Jobs one.
+	Workers int `json:"workers"`
+	// Retries, if present, overrides the Jobs one.
+	Retries *int `json:"retries"`
+}
+
+type mapJob struct {
+	task    []byte
+	inputs  [][]byte
+	workers int
+	retries int
+}
+
+func (j *Jobs) workers() int {
+	if j.Workers <= 0 {
+		return DefaultMapWorkers
+	}
+	return j.Workers
+}
+
+// parseMapRequest reads a map request followed by its inputs.
+// Just like for ordinary jobs, string inputs are taken verbatim.
+func (j *Jobs) parseMapRequest(r io.Reader) (*mapJob, error) {
+	var req mapRequest
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		return nil, fmt.Errorf("decode map job: %w", err)
+	}
+	if len(req.Task) == 0 {
+		return nil, fmt.Errorf("decode map job: task is required")
+	}
+	m := &mapJob{
+		task:    verbatim(req.Task),
+		workers: j.workers(),
+		retries: j.Retries,
+	}
+	if req.Workers < 0 {
+		return nil, fmt.Errorf("decode map job: workers cannot be negative")
+	}
+	if req.Workers > 0 && req.Workers < m.workers {
+		m.workers = req.Workers
+	}
+	if req.Retries != nil {
+		if *req.Retries < 0 {
+			return nil, fmt.Errorf("decode map job: retries cannot be negative")
+		}
+		m.retries = *req.Retries
+	}
+	for i := 0; ; i++ {
+		var input json.RawMessage
+		err := dec.Decode(&input)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("decode map job input %d: %w", i, err)
+		}
+		m.inputs = append(m.inputs, verbatim(input))
+	}
+	if len(m.inputs) == 0 {
+		return nil, fmt.Errorf("decode map job: no inputs")
+	}
+	return m, nil
+}
+
+// mapResult is the outcome of a map job item, as it is written
+// in the out file.
+type mapResult struct {
+	Index    int             `json:"index"`
+	Attempts int             `json:"attempts"`
+	Retv     json.RawMessage `json:"retv,omitempty"`
+	Err      json.RawMessage `json:"err,omitempty"`
+}
+
+// jsonValue returns b if it is valid JSON, b encoded as a JSON
+// string otherwise. Empty values are returned as nil.
+func jsonValue(b []byte) json.RawMessage {
+	b = bytes.TrimSpace(b)
+	if len(b) == 0 {
+		return nil
+	}
+	if json.Valid(b) {
+		return b
+	}
+	s, _ := json.Marshal(string(b))
+	return s
+}
+
+// mapItem runs item i of m on a new worker each attempt.
+func (j *job) mapItem(m *mapJob, i int) *mapResult {
+	res := &mapResult{Index: i}
+	for {
+		res.Attempts++
+		retv, errb, err := j.runWorker(j.ctx, m.task, m.inputs[i], nil)
+		res.Retv, res.Err = jsonValue(retv), jsonValue(errb)
+		if err != nil {
+			res.Err = errorValue(err)
+		}
+		if res.Err == nil || res.Attempts > m.retries || j.ctx.Err() != nil {
+			return res
+		}
+		j.srv.log().Info("map item failed, retrying", "job", j.name, "item", i, "attempt", res.Attempts, "error", string(res.Err))
+	}
+}
+
+// runMap distributes the inputs of m among at most m.workers
+// workers at once. Results are written to the out file following
+// the order of the inputs, while the state file reports how many
+// items are done.
+func (j *job) runMap(m *mapJob) {
+	out := file.NewMulti("out")
+	j.Append(out)
+	defer out.Close()
+
+	total := len(m.inputs)
+	// The last step is reached only when the outputs
+	// are written.
+	h := NewProcessHelper(&Stdio{Err: j.err, Retv: j.retv, State: j.state}, total+1)
+	defer h.Done()
+
+	items := make(chan int)
+	results := make(chan *mapResult)
+	go func() {
+		defer close(items)
+		for i := range m.inputs {
+			select {
+			case items <- i:
+			case <-j.ctx.Done():
+				return
+			}
+		}
+	}()
+	var wg sync.WaitGroup
+	for w := 0; w < m.workers && w < total; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range items {
+				results <- j.mapItem(m, i)
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	enc := json.NewEncoder(out)
+	pending := make(map[int]*mapResult)
+	next, done, failed := 0, 0, 0
+	for res := range results {
+		done++
+		if res.Err != nil {
+			failed++
+		}
+		pending[res.Index] = res
+		for ; pending[next] != nil; next++ {
+			if err := enc.Encode(pending[next]); err != nil {
+				j.srv.log().Error("unable to write map result", "job", j.name, "item", next, "error", err)
+			}
+			delete(pending, next)
+		}
+		h.Progress(done, "%d/%d items done, %d failed", done, total, failed)
+	}
+
+	if err := j.ctx.Err(); err != nil {
+		h.Errf("map job interrupted after %d/%d items: %w", done, total, err)
+		return
+	}
+	h.Retv(&struct {
+		Items  int `json:"items"`
+		Failed int `json:"failed"`
+	}{
+		Items:  total,
+		Failed: failed,
+	})
+	if failed > 0 {
+		h.Errf("%d of %d items failed", failed, total)
+	}
+	j.srv.log().Info("map job done", "job", j.name, "user", j.user, "items", total, "failed", failed)
+}
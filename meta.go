@@ -0,0 +1,89 @@
+// SPDX-FileCopyrightText: 2020 jecoz
+//
+// SPDX-License-Identifier: BSD-3-Clause
+
+package flexi
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// LabelPrefix prefixes the labels set by flexi. Tags provided
+// by users cannot use it.
+const LabelPrefix = "flexi:"
+
+// Metadata describes the remote a process is spawned for.
+// Spawners find it in the spawn context and should attach it to
+// the resources they create, for example as tags or labels, so
+// that they can be traced back to flexi.
+type Metadata struct {
+	// Instance identifies the flexi server, see Srv.Instance.
+	Instance  string
+	Namespace string
+	// Remote is the name of the remote inside its namespace.
+	Remote string
+	// User is the 9p user owning the remote.
+	User string
+	// Template is the name of the template the spawn payload
+	// refers to, if any.
+	Template string
+	// Pool is the name of the warm pool the process is
+	// spawned for, if any. Such processes are not assigned
+	// to a remote yet.
+	Pool string
+	// Tags are provided by the user with the tags field of the
+	// spawn payload.
+	Tags map[string]string
+}
+
+// Labels returns m as a flat set of labels. The flexi fields
+// are prefixed with LabelPrefix, and empty ones are omitted.
+func (m Metadata) Labels() map[string]string {
+	labels := make(map[string]string, len(m.Tags)+6)
+	for k, v := range m.Tags {
+		labels[k] = v
+	}
+	for k, v := range map[string]string{
+		"instance":  m.Instance,
+		"namespace": m.Namespace,
+		"remote":    m.Remote,
+		"user":      m.User,
+		"template":  m.Template,
+		"pool":      m.Pool,
+	} {
+		if v != "" {
+			labels[LabelPrefix+k] = v
+		}
+	}
+	return labels
+}
+
+// validTags checks the tags provided with a spawn payload.
+func validTags(tags map[string]string) error {
+	for k := range tags {
+		if k == "" {
+			return fmt.Errorf("tag keys cannot be empty")
+		}
+		if strings.HasPrefix(k, LabelPrefix) {
+			return fmt.Errorf("tag %q: the %q prefix is reserved", k, LabelPrefix)
+		}
+	}
+	return nil
+}
+
+type metaKey struct{}
+
+// WithMetadata returns a context carrying the metadata of the
+// remote a process is spawned for.
+func WithMetadata(ctx context.Context, m Metadata) context.Context {
+	return context.WithValue(ctx, metaKey{}, m)
+}
+
+// MetadataFromContext returns the metadata carried by ctx, or
+// its zero value.
+func MetadataFromContext(ctx context.Context) Metadata {
+	m, _ := ctx.Value(metaKey{}).(Metadata)
+	return m
+}
@@ -0,0 +1,122 @@
+// SPDX-FileCopyrightText: 2020 jecoz
+//
+// SPDX-License-Identifier: BSD-3-Clause
+
+package flexi
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/jecoz/flexi/metrics"
+)
+
+// spawnBuckets are histogram buckets suitable for operations
+// that take seconds to minutes, such as spawns and job runs.
+var spawnBuckets = []float64{.1, .5, 1, 5, 10, 20, 30, 45, 60, 90, 120, 180, 300}
+
+var (
+	remotesActive = metrics.Default.NewGauge(
+		"flexi_remotes_active",
+		"Number of active remotes.",
+	)
+	idPoolSize = metrics.Default.NewGauge(
+		"flexi_id_pool_size",
+		"Number of identifiers in use, by directory.",
+		"dir",
+	)
+	spawnDuration = metrics.Default.NewHistogram(
+		"flexi_spawn_duration_seconds",
+		"Time spent spawning remote processes, by Spawner backend.",
+		spawnBuckets,
+		"backend",
+	)
+	spawnFailures = metrics.Default.NewCounter(
+		"flexi_spawn_failures_total",
+		"Number of failed spawns, by Spawner backend.",
+		"backend",
+	)
+	killDuration = metrics.Default.NewHistogram(
+		"flexi_kill_duration_seconds",
+		"Time spent killing remote processes, by Spawner backend.",
+		spawnBuckets,
+		"backend",
+	)
+	killFailures = metrics.Default.NewCounter(
+		"flexi_kill_failures_total",
+		"Number of failed kills, by Spawner backend.",
+		"backend",
+	)
+	bytesWritten = metrics.Default.NewCounter(
+		"flexi_bytes_written_total",
+		"Number of bytes written to process files.",
+		"file",
+	)
+	processRuns = metrics.Default.NewCounter(
+		"flexi_process_runs_total",
+		"Number of processor executions.",
+	)
+	processDuration = metrics.Default.NewHistogram(
+		"flexi_process_run_duration_seconds",
+		"Time spent executing processors.",
+		spawnBuckets,
+	)
+	processPanics = metrics.Default.NewCounter(
+		"flexi_process_panics_total",
+		"Number of processor executions that panicked.",
+	)
+	notificationsSent = metrics.Default.NewCounter(
+		"flexi_notifications_total",
+		"Number of notification deliveries, by event type and result.",
+		"type", "result",
+	)
+	orphansFound = metrics.Default.NewCounter(
+		"flexi_orphans_total",
+		"Number of orphaned remote processes found, by Spawner backend and action taken.",
+		"backend", "action",
+	)
+)
+
+func backendName(s Spawner) string {
+	return strings.TrimPrefix(fmt.Sprintf("%T", s), "*")
+}
+
+// spawnProcess and killProcess should be used instead of calling
+// the Spawner directly, as they keep track of the metrics.
+
+func spawnProcess(ctx context.Context, s Spawner, r io.Reader, id int) (*RemoteProcess, error) {
+	backend := backendName(s)
+	start := time.Now()
+	rp, err := s.Spawn(ctx, r, id)
+	spawnDuration.Observe(time.Since(start).Seconds(), backend)
+	if err != nil {
+		spawnFailures.Inc(backend)
+	}
+	return rp, err
+}
+
+func killProcess(ctx context.Context, s Spawner, r io.Reader) error {
+	backend := backendName(s)
+	start := time.Now()
+	err := s.Kill(ctx, r)
+	killDuration.Observe(time.Since(start).Seconds(), backend)
+	if err != nil {
+		killFailures.Inc(backend)
+	}
+	return err
+}
+
+// countWriter counts the bytes written to the file called name.
+type countWriter struct {
+	io.WriteCloser
+	name string
+}
+
+func (w *countWriter) Write(p []byte) (int, error) {
+	n, err := w.WriteCloser.Write(p)
+	bytesWritten.Add(float64(n), w.name)
+	return n, err
+}
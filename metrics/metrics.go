@@ -0,0 +1,288 @@
+// SPDX-FileCopyrightText: 2020 jecoz
+//
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package metrics implements a minimal set of metric types that
+// can be exposed using the Prometheus text exposition format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefBuckets are the default histogram buckets, suitable for
+// measuring request latencies in seconds.
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type metric interface {
+	write(w io.Writer)
+}
+
+// Registry holds a set of metrics. Use Default unless there
+// is a reason not to.
+type Registry struct {
+	sync.Mutex
+	metrics []metric
+	names   map[string]bool
+}
+
+func NewRegistry() *Registry { return &Registry{names: make(map[string]bool)} }
+
+// Default is the registry used by the flexi packages.
+var Default = NewRegistry()
+
+func (r *Registry) register(name string, m metric) {
+	r.Lock()
+	defer r.Unlock()
+	if r.names[name] {
+		panic(fmt.Sprintf("metrics: %v registered twice", name))
+	}
+	r.names[name] = true
+	r.metrics = append(r.metrics, m)
+}
+
+// WriteText writes every metric in r to w, using the Prometheus
+// text exposition format.
+func (r *Registry) WriteText(w io.Writer) error {
+	r.Lock()
+	metrics := make([]metric, len(r.metrics))
+	copy(metrics, r.metrics)
+	r.Unlock()
+
+	bw := bufio.NewWriter(w)
+	for _, v := range metrics {
+		v.write(bw)
+	}
+	return bw.Flush()
+}
+
+// Handler returns an http.Handler that serves the metrics of r.
+func Handler(r *Registry) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		r.WriteText(w)
+	})
+}
+
+// desc contains the fields shared by every metric type.
+type desc struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+}
+
+func (d *desc) header(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", d.name, escapeHelp(d.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", d.name, d.kind)
+}
+
+// key encodes label values so that they can be used as map
+// keys. Panics if the number of values does not match the
+// number of labels.
+func (d *desc) key(values []string) string {
+	if len(values) != len(d.labels) {
+		panic(fmt.Sprintf("metrics: %v expects %d label values, got %d", d.name, len(d.labels), len(values)))
+	}
+	return strings.Join(values, "\xff")
+}
+
+func (d *desc) pairs(key string, extra ...string) string {
+	var values []string
+	if len(d.labels) > 0 {
+		values = strings.Split(key, "\xff")
+	}
+	pairs := make([]string, 0, len(values)+1)
+	for i, v := range values {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", d.labels[i], v))
+	}
+	if len(extra) == 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", extra[0], extra[1]))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func escapeHelp(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(s)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Counter is a value that only goes up.
+type Counter struct {
+	desc
+	sync.Mutex
+	values map[string]float64
+}
+
+func (r *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{
+		desc:   desc{name: name, help: help, kind: "counter", labels: labels},
+		values: make(map[string]float64),
+	}
+	r.register(name, c)
+	return c
+}
+
+// Add adds v, which must not be negative, to the counter
+// identified by the label values.
+func (c *Counter) Add(v float64, labels ...string) {
+	if v < 0 {
+		panic("metrics: counters cannot decrease")
+	}
+	key := c.key(labels)
+	c.Lock()
+	defer c.Unlock()
+	c.values[key] += v
+}
+
+func (c *Counter) Inc(labels ...string) { c.Add(1, labels...) }
+
+func (c *Counter) write(w io.Writer) {
+	c.Lock()
+	defer c.Unlock()
+	c.header(w)
+	for _, k := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, c.pairs(k), formatFloat(c.values[k]))
+	}
+}
+
+// Gauge is a value that can go up and down.
+type Gauge struct {
+	desc
+	sync.Mutex
+	values map[string]float64
+}
+
+func (r *Registry) NewGauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{
+		desc:   desc{name: name, help: help, kind: "gauge", labels: labels},
+		values: make(map[string]float64),
+	}
+	r.register(name, g)
+	return g
+}
+
+func (g *Gauge) Set(v float64, labels ...string) {
+	key := g.key(labels)
+	g.Lock()
+	defer g.Unlock()
+	g.values[key] = v
+}
+
+func (g *Gauge) Add(v float64, labels ...string) {
+	key := g.key(labels)
+	g.Lock()
+	defer g.Unlock()
+	g.values[key] += v
+}
+
+func (g *Gauge) Inc(labels ...string) { g.Add(1, labels...) }
+func (g *Gauge) Dec(labels ...string) { g.Add(-1, labels...) }
+
+func (g *Gauge) write(w io.Writer) {
+	g.Lock()
+	defer g.Unlock()
+	g.header(w)
+	for _, k := range sortedKeys(g.values) {
+		fmt.Fprintf(w, "%s%s %s\n", g.name, g.pairs(k), formatFloat(g.values[k]))
+	}
+}
+
+// Histogram samples observations and counts them in buckets.
+type Histogram struct {
+	desc
+	buckets []float64
+
+	sync.Mutex
+	counts map[string][]uint64
+	sums   map[string]float64
+	totals map[string]uint64
+}
+
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	if buckets == nil {
+		buckets = DefBuckets
+	}
+	sorted := make([]float64, len(buckets))
+	copy(sorted, buckets)
+	sort.Float64s(sorted)
+	h := &Histogram{
+		desc:    desc{name: name, help: help, kind: "histogram", labels: labels},
+		buckets: sorted,
+		counts:  make(map[string][]uint64),
+		sums:    make(map[string]float64),
+		totals:  make(map[string]uint64),
+	}
+	r.register(name, h)
+	return h
+}
+
+func (h *Histogram) Observe(v float64, labels ...string) {
+	key := h.key(labels)
+	h.Lock()
+	defer h.Unlock()
+	counts, ok := h.counts[key]
+	if !ok {
+		counts = make([]uint64, len(h.buckets))
+		h.counts[key] = counts
+	}
+	for i, b := range h.buckets {
+		if v <= b {
+			counts[i]++
+		}
+	}
+	h.sums[key] += v
+	h.totals[key]++
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.Lock()
+	defer h.Unlock()
+	h.header(w)
+	for _, k := range sortedKeys(h.sums) {
+		for i, b := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.pairs(k, "le", formatFloat(b)), h.counts[k][i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.pairs(k, "le", "+Inf"), h.totals[k])
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, h.pairs(k), formatFloat(h.sums[k]))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, h.pairs(k), h.totals[k])
+	}
+}
+
+// ListenAndServe serves the metrics of r on addr, under the
+// /metrics path.
+func ListenAndServe(addr string, r *Registry) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Handler(r))
+	return http.ListenAndServe(addr, mux)
+}
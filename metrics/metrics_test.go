@@ -0,0 +1,48 @@
+// SPDX-FileCopyrightText: 2020 jecoz
+//
+// SPDX-License-Identifier: BSD-3-Clause
+
+package metrics
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestWriteText(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("requests_total", "Number of requests.", "type")
+	g := r.NewGauge("active", "Active things.")
+	h := r.NewHistogram("latency_seconds", "Latency.", []float64{1, 0.5})
+
+	c.Inc("Topen")
+	c.Add(2, "Twalk")
+	g.Set(3)
+	g.Dec()
+	h.Observe(0.2)
+	h.Observe(0.7)
+	h.Observe(3)
+
+	b := new(bytes.Buffer)
+	if err := r.WriteText(b); err != nil {
+		t.Fatal(err)
+	}
+	want := `# HELP requests_total Number of requests.
+# TYPE requests_total counter
+requests_total{type="Topen"} 1
+requests_total{type="Twalk"} 2
+# HELP active Active things.
+# TYPE active gauge
+active 2
+# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{le="0.5"} 1
+latency_seconds_bucket{le="1"} 2
+latency_seconds_bucket{le="+Inf"} 3
+latency_seconds_sum 3.9
+latency_seconds_count 3
+`
+	if have := b.String(); have != want {
+		t.Fatalf("have:\n%v\nwant:\n%v", have, want)
+	}
+}
@@ -7,6 +7,7 @@
 package flexi
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"os/exec"
@@ -23,6 +24,15 @@ func mount(addr, mtpt string) error {
 	return run("9", "mount", addr, mtpt)
 }
 
+// mountContext works like mount, but the 9 command is killed
+// when ctx is done.
+func mountContext(ctx context.Context, addr, mtpt string) error {
+	if err := os.MkdirAll(mtpt, os.ModePerm); err != nil {
+		return fmt.Errorf("mount: %w", err)
+	}
+	return exec.CommandContext(ctx, "9", "mount", addr, mtpt).Run()
+}
+
 func umount(mtpt string) error {
 	return run("umount", mtpt)
 }
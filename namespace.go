@@ -0,0 +1,365 @@
+// SPDX-FileCopyrightText: 2020 jecoz
+//
+// SPDX-License-Identifier: BSD-3-Clause
+
+package flexi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/jecoz/flexi/file"
+	"github.com/jecoz/flexi/fs"
+	"github.com/jecoz/flexi/logger"
+)
+
+// NamespaceSpec describes a namespace, a directory of the flexi
+// root that groups remotes sharing the same Spawner, default
+// spawn payload and limits. Each namespace has its own clone
+// file and remote identifiers.
+type NamespaceSpec struct {
+	// Name is the path of the namespace relative to the
+	// flexi root, such as teamA or teamA/batch.
+	Name string `json:"name"`
+	// Backend is the name of the Spawner used by the
+	// namespace, as registered in Srv.Spawners. Empty means
+	// the server Spawner.
+	Backend string `json:"backend,omitempty"`
+	// Template is the default spawn payload. Spawn payloads
+	// that are JSON objects and do not refer to a named template
+	// are merged into it as JSON merge patches, while an empty
+	// payload spawns the template as it is.
+	Template json.RawMessage `json:"template,omitempty"`
+	// Limits are enforced on the remotes of the namespace and
+	// of its children. Zero values are inherited from the
+	// parent namespace, and the others cannot exceed them.
+	Limits Limits `json:"limits"`
+}
+
+var nsNameRx = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_-]*$`)
+
+func validNamespace(name string) error {
+	for _, v := range strings.Split(name, "/") {
+		if !nsNameRx.MatchString(v) {
+			return fmt.Errorf("invalid namespace name %q", name)
+		}
+	}
+	return nil
+}
+
+type nsKey struct{}
+
+// WithNamespace returns a context carrying the name of the
+// namespace a remote process is spawned for. Spawners should
+// store it in RemoteProcess.Namespace, so that flexi can restore
+// the remote in the right place.
+func WithNamespace(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, nsKey{}, name)
+}
+
+// NamespaceFromContext returns the namespace carried by ctx. The
+// root namespace is the empty string.
+func NamespaceFromContext(ctx context.Context) string {
+	name, _ := ctx.Value(nsKey{}).(string)
+	return name
+}
+
+type namespace struct {
+	NamespaceSpec
+	srv   *Srv
+	s     Spawner
+	mtpt  string
+	dir   *nsDir
+	pool  *idPool
+	quota *quota
+	// parent is nil for the root namespace. Remotes and spawns
+	// are charged to the quota of every ancestor too, so that
+	// the limits of the root hold for the whole server.
+	parent *namespace
+}
+
+// nsDir is the directory of a namespace. Creating a directory
+// inside it creates a child namespace.
+type nsDir struct {
+	*file.Dir
+	ns *namespace
+}
+
+func (d *nsDir) Create(name string, mode os.FileMode) (fs.File, error) {
+	if !mode.IsDir() {
+		return nil, fs.ErrNotSupported
+	}
+	ns, err := d.ns.srv.addNamespace(NamespaceSpec{
+		Name:     path.Join(d.ns.Name, name),
+		Backend:  d.ns.Backend,
+		Template: d.ns.Template,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ns.dir, nil
+}
+
+// Close removes the namespace, which must not contain any
+// remote or namespace.
+func (d *nsDir) Close() error { return d.ns.srv.removeNamespace(d.ns) }
+
+func (ns *namespace) log() logger.Logger {
+	log := ns.srv.log()
+	if ns.Name != "" {
+		log = log.With("namespace", ns.Name)
+	}
+	return log
+}
+
+// acquire reserves a remote for user in ns and its ancestors.
+func (ns *namespace) acquire(user string) error {
+	for n := ns; n != nil; n = n.parent {
+		if err := n.quota.Acquire(user); err != nil {
+			for m := ns; m != n; m = m.parent {
+				m.quota.Release(user)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func (ns *namespace) release(user string) {
+	for n := ns; n != nil; n = n.parent {
+		n.quota.Release(user)
+	}
+}
+
+func (ns *namespace) addRemote(id int, user string, f func(string, int) (*Remote, error)) (*Remote, error) {
+	if err := ns.acquire(user); err != nil {
+		return nil, fmt.Errorf("add remote: %w", err)
+	}
+	if id < 0 {
+		var err error
+		if id, err = ns.pool.Get(); err != nil {
+			ns.release(user)
+			return nil, fmt.Errorf("add remote: %w", err)
+		}
+	} else {
+		// Notify the pool that we have this id
+		// already and no other Get() call should
+		// return id till we Put it back to the pool.
+		if err := ns.pool.Have(id); err != nil {
+			ns.release(user)
+			return nil, fmt.Errorf("add remote: invalid id requested: %w", err)
+		}
+	}
+	r, err := f(strconv.Itoa(id), id)
+	if err != nil {
+		ns.pool.Put(id)
+		ns.release(user)
+		return nil, err
+	}
+	r.srv = ns.srv
+	r.ns = ns
+	r.policy = ns.srv.spawnPolicy(SpawnPolicy{})
+	r.User = user
+	r.log = ns.log().With("remote", r.Name, "user", user)
+	remotesActive.Inc()
+	r.Done = func() {
+		remotesActive.Dec()
+		ns.pool.Put(id)
+		ns.release(user)
+	}
+	return r, nil
+}
+
+func (ns *namespace) newRemote(user string) (*Remote, error) {
+	return ns.addRemote(-1, user, func(name string, id int) (*Remote, error) {
+		return NewRemote(ns.mtpt, name, ns.s, id)
+	})
+}
+
+func (ns *namespace) restoreRemote(rp *RemoteProcess) (*Remote, error) {
+	// We do not know who the owner of the remote was,
+	// hence it is accounted to the anonymous user.
+	// Processes with a negative ID, such as adopted orphans,
+	// get a new one.
+	return ns.addRemote(rp.ID, "", func(name string, id int) (*Remote, error) {
+		rp.ID = id
+		return RestoreRemote(ns.mtpt, name, ns.s, rp)
+	})
+}
+
+// checkSpawn is called before a remote process is spawned.
+func (ns *namespace) checkSpawn() error {
+	for n := ns; n != nil; n = n.parent {
+		if err := n.quota.Spawn(); err != nil {
+			for m := ns; m != n; m = m.parent {
+				m.quota.unspawn()
+			}
+			return fmt.Errorf("spawn: %w", err)
+		}
+	}
+	return nil
+}
+
+// uncheckSpawn undoes a successful checkSpawn, when the remote
+// process is not spawned after all.
+func (ns *namespace) uncheckSpawn() {
+	for n := ns; n != nil; n = n.parent {
+		n.quota.unspawn()
+	}
+}
+
+// files returns the files every namespace directory contains.
+func (ns *namespace) files() []fs.File {
+	clone := file.WithUserRead("clone", func(user string, p []byte) (int, error) {
+		// Users read the clone file to obtain
+		// a new remote process.
+		remote, err := ns.newRemote(user)
+		if err != nil {
+			return 0, publicError(err)
+		}
+
+		s := []byte(remote.Name + "\n")
+		if len(s) > len(p) {
+			remote.Done()
+			return 0, io.ErrShortBuffer
+		}
+
+		ns.dir.Append(remote)
+		return copy(p, s), io.EOF
+	})
+	usage := file.NewSnapshot("usage", ns.quota.Usage)
+	return []fs.File{clone, usage}
+}
+
+func (s *Srv) newNamespace(spec NamespaceSpec) (*namespace, error) {
+	sp := s.S
+	if spec.Backend != "" {
+		var ok bool
+		if sp, ok = s.Spawners[spec.Backend]; !ok {
+			return nil, fmt.Errorf("namespace %v: unknown backend %q", spec.Name, spec.Backend)
+		}
+	}
+	ns := &namespace{
+		NamespaceSpec: spec,
+		srv:           s,
+		s:             sp,
+		mtpt:          filepath.Join(s.Mtpt, filepath.FromSlash(spec.Name)),
+		pool:          &idPool{dir: path.Join("/", spec.Name)},
+		quota:         &quota{Limits: spec.Limits},
+	}
+	_, name := path.Split(spec.Name)
+	ns.dir = &nsDir{Dir: file.NewDirFiles(name, ns.files()...), ns: ns}
+	return ns, nil
+}
+
+// addNamespace creates the namespace described by spec. Its
+// parent must exist already.
+func (s *Srv) addNamespace(spec NamespaceSpec) (*namespace, error) {
+	if err := validNamespace(spec.Name); err != nil {
+		return nil, err
+	}
+	if len(spec.Template) > 0 && !json.Valid(spec.Template) {
+		return nil, fmt.Errorf("namespace %v: template is not valid json", spec.Name)
+	}
+	ns, err := s.newNamespace(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	s.nsmu.Lock()
+	defer s.nsmu.Unlock()
+	parentName, name := path.Split(spec.Name)
+	parent, ok := s.namespaces[path.Clean("/" + parentName)[1:]]
+	if !ok {
+		return nil, fmt.Errorf("namespace %v: parent does not exist", spec.Name)
+	}
+	if _, err := parent.dir.Find(name); err == nil {
+		return nil, fmt.Errorf("namespace %v: %w", spec.Name, os.ErrExist)
+	}
+	ns.parent = parent
+	ns.Limits = spec.Limits.within(parent.Limits)
+	ns.quota.Limits = ns.Limits
+	parent.dir.Append(ns.dir)
+	s.namespaces[spec.Name] = ns
+	ns.log().Info("namespace created", "backend", spec.Backend)
+	return ns, nil
+}
+
+// ensureNamespace returns the namespace called name, creating it
+// and its missing parents with backend if needed.
+func (s *Srv) ensureNamespace(name, backend string) (*namespace, error) {
+	s.nsmu.Lock()
+	ns, ok := s.namespaces[name]
+	s.nsmu.Unlock()
+	if ok {
+		return ns, nil
+	}
+	if parent := path.Dir(name); parent != "." {
+		if _, err := s.ensureNamespace(parent, backend); err != nil {
+			return nil, err
+		}
+	}
+	return s.addNamespace(NamespaceSpec{Name: name, Backend: backend})
+}
+
+var errNamespaceNotEmpty = errors.New("namespace is not empty")
+
+func (s *Srv) removeNamespace(ns *namespace) error {
+	if ns.Name == "" {
+		return fmt.Errorf("the root namespace cannot be removed")
+	}
+	s.nsmu.Lock()
+	defer s.nsmu.Unlock()
+	for k := range s.namespaces {
+		if strings.HasPrefix(k, ns.Name+"/") {
+			return fmt.Errorf("remove namespace %v: %w", ns.Name, errNamespaceNotEmpty)
+		}
+	}
+	// Remotes are added without holding nsmu: the pool
+	// makes sure none is added while removing.
+	removed := ns.pool.drain(func() {
+		delete(s.namespaces, ns.Name)
+		os.Remove(ns.mtpt)
+	})
+	if !removed {
+		return fmt.Errorf("remove namespace %v: %w", ns.Name, errNamespaceNotEmpty)
+	}
+	ns.log().Info("namespace removed")
+	return ns.dir.Dir.Close()
+}
+
+// execCtl executes the commands written to the root ctl file:
+//
+//	mkns <name> [backend]	creates a namespace
+//	rmns <name>		removes an empty namespace
+func (s *Srv) execCtl(cmd string) error {
+	args := strings.Fields(cmd)
+	switch {
+	case len(args) >= 2 && len(args) <= 3 && args[0] == "mkns":
+		spec := NamespaceSpec{Name: args[1]}
+		if len(args) == 3 {
+			spec.Backend = args[2]
+		}
+		_, err := s.addNamespace(spec)
+		return err
+	case len(args) == 2 && args[0] == "rmns":
+		s.nsmu.Lock()
+		_, ok := s.namespaces[args[1]]
+		s.nsmu.Unlock()
+		if !ok || args[1] == "" {
+			return fmt.Errorf("namespace %v: %w", args[1], os.ErrNotExist)
+		}
+		return s.FS.Remove("/" + args[1])
+	default:
+		return fmt.Errorf("invalid ctl command %q", cmd)
+	}
+}
@@ -0,0 +1,126 @@
+// SPDX-FileCopyrightText: 2020 jecoz
+//
+// SPDX-License-Identifier: BSD-3-Clause
+
+package flexi
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/jecoz/flexi/file/memfs"
+)
+
+func newTestSrv(t *testing.T) *Srv {
+	mtpt, err := ioutil.TempDir("", "flexi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(mtpt) })
+	srv := &Srv{Mtpt: mtpt}
+	if srv.root, err = srv.newNamespace(NamespaceSpec{}); err != nil {
+		t.Fatal(err)
+	}
+	srv.namespaces = map[string]*namespace{"": srv.root}
+	srv.FS = memfs.New(srv.root.dir)
+	return srv
+}
+
+func TestNamespace_Add(t *testing.T) {
+	srv := newTestSrv(t)
+	tt := []struct {
+		name string
+		ok   bool
+	}{
+		{"teamA", true},
+		{"teamA/batch", true},
+		{"teamA", false},
+		{"teamB/batch", false},
+		{"1", false},
+		{"warm.a", false},
+		{"", false},
+		{"teamA//x", false},
+	}
+	for i, v := range tt {
+		_, err := srv.addNamespace(NamespaceSpec{Name: v.name})
+		if (err == nil) != v.ok {
+			t.Fatalf("%d: unexpected error: %v", i, err)
+		}
+	}
+	for _, v := range []string{"/teamA/clone", "/teamA/batch/usage"} {
+		if _, err := srv.FS.Open(v); err != nil {
+			t.Fatalf("%v: %v", v, err)
+		}
+	}
+	if err := srv.execCtl("rmns teamA"); !errors.Is(err, errNamespaceNotEmpty) {
+		t.Fatalf("have [%v], want [%v]", err, errNamespaceNotEmpty)
+	}
+	if err := srv.execCtl("rmns teamA/batch"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := srv.FS.Open("/teamA/batch"); !os.IsNotExist(err) {
+		t.Fatalf("have [%v], want [%v]", err, os.ErrNotExist)
+	}
+	if err := srv.execCtl("mkns teamA/batch unknown"); err == nil {
+		t.Fatal("namespaces with unknown backends should not be created")
+	}
+}
+
+func TestNamespace_Limits(t *testing.T) {
+	srv := newTestSrv(t)
+	srv.root.quota.Limits = Limits{MaxRemotes: 2, SpawnsPerMinute: 1}
+	srv.root.Limits = srv.root.quota.Limits
+
+	ns, err := srv.addNamespace(NamespaceSpec{Name: "teamA", Limits: Limits{MaxRemotes: 5, MaxRemotesPerUser: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (Limits{MaxRemotes: 2, MaxRemotesPerUser: 1, SpawnsPerMinute: 1}); ns.Limits != want {
+		t.Fatalf("have %+v, want %+v", ns.Limits, want)
+	}
+	if err := ns.acquire("glenda"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ns.acquire("glenda"); !errors.Is(err, ErrQuota) {
+		t.Fatalf("have [%v], want [%v]", err, ErrQuota)
+	}
+	if err := srv.root.acquire("rob"); err != nil {
+		t.Fatal(err)
+	}
+	// The root counts the remotes of teamA too.
+	if err := ns.acquire("ken"); !errors.Is(err, ErrQuota) {
+		t.Fatalf("have [%v], want [%v]", err, ErrQuota)
+	}
+	if err := ns.checkSpawn(); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.root.checkSpawn(); !errors.Is(err, ErrQuota) {
+		t.Fatalf("have [%v], want [%v]", err, ErrQuota)
+	}
+}
+
+func TestNamespace_RemoveInUse(t *testing.T) {
+	srv := newTestSrv(t)
+	ns, err := srv.addNamespace(NamespaceSpec{Name: "teamA"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := ns.pool.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.removeNamespace(ns); !errors.Is(err, errNamespaceNotEmpty) {
+		t.Fatalf("have [%v], want [%v]", err, errNamespaceNotEmpty)
+	}
+	ns.pool.Put(id)
+	if err := srv.removeNamespace(ns); err != nil {
+		t.Fatal(err)
+	}
+	// Clone files opened before the removal cannot
+	// add remotes to it.
+	if _, err := ns.newRemote("glenda"); !errors.Is(err, errPoolClosed) {
+		t.Fatalf("have [%v], want [%v]", err, errPoolClosed)
+	}
+}
@@ -0,0 +1,287 @@
+// SPDX-FileCopyrightText: 2020 jecoz
+//
+// SPDX-License-Identifier: BSD-3-Clause
+
+package flexi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jecoz/flexi/logger"
+)
+
+// Event types.
+const (
+	EventSpawnSucceeded = "spawn.succeeded"
+	EventSpawnFailed    = "spawn.failed"
+	EventJobDone        = "job.done"
+	EventRemoteDead     = "remote.dead"
+	EventRemoteExpired  = "remote.expired"
+	EventRemoteOrphan   = "remote.orphan"
+)
+
+// Event is what notification targets receive, encoded as JSON.
+type Event struct {
+	Type      string    `json:"type"`
+	Time      time.Time `json:"time"`
+	Namespace string    `json:"namespace,omitempty"`
+	Remote    string    `json:"remote,omitempty"`
+	Job       string    `json:"job,omitempty"`
+	User      string    `json:"user,omitempty"`
+	Addr      string    `json:"addr,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// NotifyTarget is where events are delivered. Exactly one among
+// URL, Command and File should be provided.
+type NotifyTarget struct {
+	// Name allows spawn payloads to refer to the target.
+	Name string `json:"name"`
+	// URL receives the events as POST requests.
+	URL string `json:"url,omitempty"`
+	// Command is executed with the event on its stdin.
+	Command []string `json:"command,omitempty"`
+	// File gets the events appended, one per line.
+	File string `json:"file,omitempty"`
+	// Events lists the types of the events the target
+	// is interested in. Empty means all of them.
+	Events []string `json:"events,omitempty"`
+	// All makes the target receive the events of every remote
+	// and job, not only of those whose payload refer to it.
+	All bool `json:"all,omitempty"`
+}
+
+func (t *NotifyTarget) wants(typ string) bool {
+	if len(t.Events) == 0 {
+		return true
+	}
+	for _, v := range t.Events {
+		if v == typ {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *NotifyTarget) validate() error {
+	n := 0
+	for _, v := range []bool{t.URL != "", len(t.Command) > 0, t.File != ""} {
+		if v {
+			n++
+		}
+	}
+	if n != 1 {
+		return fmt.Errorf("notify target %q: exactly one among url, command and file is required", t.Name)
+	}
+	return nil
+}
+
+// Notifier delivers events to its Targets and to the ones named
+// in spawn payloads, retrying failed deliveries.
+type Notifier struct {
+	Targets []NotifyTarget
+	// AllowURLs lists the webhook URLs spawn payloads are
+	// allowed to use in place of target names. A URL is allowed
+	// if it has the scheme and host of an entry and its path
+	// starts with the entry path. Empty allows names only.
+	AllowURLs []string
+	// Retry is applied to failed deliveries.
+	Retry Backoff
+	// Timeout limits each delivery attempt. Defaults to
+	// DefaultNotifyTimeout.
+	Timeout time.Duration
+	// Log is used to report deliveries that failed for good.
+	// Defaults to logger.Default.
+	Log logger.Logger
+
+	mu sync.Mutex // Serializes file appends.
+}
+
+const DefaultNotifyTimeout = 10 * time.Second
+
+func (n *Notifier) log() logger.Logger {
+	if n.Log == nil {
+		return logger.Default
+	}
+	return n.Log
+}
+
+func (n *Notifier) timeout() time.Duration {
+	if n.Timeout <= 0 {
+		return DefaultNotifyTimeout
+	}
+	return n.Timeout
+}
+
+// allowed reports whether u matches AllowURLs.
+func (n *Notifier) allowed(u *url.URL) bool {
+	for _, v := range n.AllowURLs {
+		a, err := url.Parse(v)
+		if err != nil {
+			continue
+		}
+		if u.Scheme == a.Scheme && strings.EqualFold(u.Host, a.Host) && strings.HasPrefix(u.Path, a.Path) {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate checks the configured targets.
+func (n *Notifier) Validate() error {
+	names := make(map[string]bool, len(n.Targets))
+	for i := range n.Targets {
+		t := &n.Targets[i]
+		if err := t.validate(); err != nil {
+			return err
+		}
+		if t.Name != "" && names[t.Name] {
+			return fmt.Errorf("notify target %q: duplicate name", t.Name)
+		}
+		names[t.Name] = true
+	}
+	for _, v := range n.AllowURLs {
+		u, err := url.Parse(v)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("allowed notify url %q: an http(s) url is required", v)
+		}
+	}
+	return nil
+}
+
+// Resolve returns the targets refs point to. Each reference is
+// either the name of a configured target or a URL matching
+// AllowURLs, which is used as a webhook. Commands and files can
+// only be configured on the server.
+func (n *Notifier) Resolve(refs []string) ([]NotifyTarget, error) {
+	targets := make([]NotifyTarget, 0, len(refs))
+Refs:
+	for _, ref := range refs {
+		for _, t := range n.Targets {
+			if t.Name != "" && t.Name == ref {
+				if !t.All {
+					targets = append(targets, t)
+				}
+				continue Refs
+			}
+		}
+		u, err := url.Parse(ref)
+		if err != nil || u.User != nil || path.Clean("/"+u.Path) != u.Path || !n.allowed(u) {
+			return nil, fmt.Errorf("unknown notify target %q", ref)
+		}
+		targets = append(targets, NotifyTarget{URL: ref})
+	}
+	return targets, nil
+}
+
+// Notify delivers e to the targets interested in every event and
+// to extra, in the background.
+func (n *Notifier) Notify(e Event, extra []NotifyTarget) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	b, err := json.Marshal(&e)
+	if err != nil {
+		n.log().Error("unable to encode event", "type", e.Type, "error", err)
+		return
+	}
+	deliver := func(t NotifyTarget) {
+		if !t.wants(e.Type) {
+			return
+		}
+		go n.deliver(t, e.Type, b)
+	}
+	for _, t := range n.Targets {
+		if t.All {
+			deliver(t)
+		}
+	}
+	for _, t := range extra {
+		deliver(t)
+	}
+}
+
+func (n *Notifier) deliver(t NotifyTarget, typ string, event []byte) {
+	for attempt := 1; ; attempt++ {
+		err := n.send(t, typ, event)
+		if err == nil {
+			notificationsSent.Inc(typ, "ok")
+			return
+		}
+		if attempt >= n.Retry.Attempts {
+			notificationsSent.Inc(typ, "error")
+			n.log().Error("notification lost", "type", typ, "target", t.Name, "attempts", attempt, "error", err)
+			return
+		}
+		time.Sleep(n.Retry.Delay(attempt))
+	}
+}
+
+// webhookClient does not follow redirects, which could lead
+// webhooks to addresses that are not allowed.
+var webhookClient = &http.Client{
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+func (n *Notifier) send(t NotifyTarget, typ string, event []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), n.timeout())
+	defer cancel()
+	switch {
+	case t.URL != "":
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.URL, bytes.NewReader(event))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := webhookClient.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			return fmt.Errorf("webhook %v: unexpected status %v", t.URL, resp.Status)
+		}
+		return nil
+	case len(t.Command) > 0:
+		cmd := exec.CommandContext(ctx, t.Command[0], t.Command[1:]...)
+		cmd.Stdin = bytes.NewReader(event)
+		cmd.Env = append(os.Environ(), "FLEXI_EVENT="+typ)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("command %v: %w: %s", t.Command[0], err, bytes.TrimSpace(out))
+		}
+		return nil
+	default:
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		f, err := os.OpenFile(t.File, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return err
+		}
+		if _, err := f.Write(append(event, '\n')); err != nil {
+			f.Close()
+			return err
+		}
+		return f.Close()
+	}
+}
+
+// notify delivers e through the server Notifier, if any.
+func (s *Srv) notify(e Event, extra []NotifyTarget) {
+	if s == nil || s.Notifier == nil {
+		return
+	}
+	s.Notifier.Notify(e, extra)
+}
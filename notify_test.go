@@ -0,0 +1,96 @@
+// SPDX-FileCopyrightText: 2020 jecoz
+//
+// SPDX-License-Identifier: BSD-3-Clause
+
+package flexi
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNotifier_Resolve(t *testing.T) {
+	n := &Notifier{
+		Targets: []NotifyTarget{
+			{Name: "ops", URL: "http://localhost/hook", All: true},
+			{Name: "page", Command: []string{"true"}},
+		},
+		AllowURLs: []string{"https://example.com/hooks/"},
+	}
+	tt := []struct {
+		refs []string
+		urls []string
+		err  bool
+	}{
+		{refs: []string{"page"}, urls: []string{""}},
+		// Targets receiving every event are not repeated.
+		{refs: []string{"ops"}, urls: []string{}},
+		{refs: []string{"https://example.com/hooks/a"}, urls: []string{"https://example.com/hooks/a"}},
+		{refs: []string{"https://example.com/hook"}, err: true},
+		{refs: []string{"https://example.com/hooks/../admin"}, err: true},
+		{refs: []string{"https://example.com.evil.net/hooks/a"}, err: true},
+		{refs: []string{"http://169.254.169.254/latest/meta-data"}, err: true},
+		{refs: []string{"unknown"}, err: true},
+		{refs: []string{"file:///etc/passwd"}, err: true},
+	}
+	for i, v := range tt {
+		targets, err := n.Resolve(v.refs)
+		if v.err {
+			if err == nil {
+				t.Fatalf("%d: expected an error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%d: unexpected error: %v", i, err)
+		}
+		if len(targets) != len(v.urls) {
+			t.Fatalf("%d: unexpected targets: %+v", i, targets)
+		}
+		for j, target := range targets {
+			if target.URL != v.urls[j] {
+				t.Fatalf("%d: unexpected target url: wanted %q, found %q", i, v.urls[j], target.URL)
+			}
+		}
+	}
+}
+
+func TestNotifier_File(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flexi-notify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "events")
+
+	n := &Notifier{Targets: []NotifyTarget{
+		{File: path, All: true, Events: []string{EventRemoteDead}},
+	}}
+	if err := n.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	n.Notify(Event{Type: EventSpawnSucceeded, Remote: "0"}, nil)
+	n.Notify(Event{Type: EventRemoteDead, Remote: "1"}, nil)
+
+	var b []byte
+	for i := 0; i < 100 && len(b) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+		b, _ = ioutil.ReadFile(path)
+	}
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("unexpected events: %q", b)
+	}
+	var e Event
+	if err := json.Unmarshal([]byte(lines[0]), &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Type != EventRemoteDead || e.Remote != "1" {
+		t.Fatalf("unexpected event: %+v", e)
+	}
+}
@@ -0,0 +1,297 @@
+// SPDX-FileCopyrightText: 2020 jecoz
+//
+// SPDX-License-Identifier: BSD-3-Clause
+
+package flexi
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/jecoz/flexi/file"
+	"github.com/jecoz/flexi/fs"
+)
+
+// PipelineStep is a step of a pipeline. Steps run on their own
+// worker once the steps listed in After are done, and read their
+// retv files as input. Steps that do not depend on any other
+// read the pipeline input instead.
+type PipelineStep struct {
+	Name string `json:"name"`
+	// Task is the spawn payload of the step worker. Strings
+	// are taken verbatim, so that they can name a template.
+	Task  json.RawMessage `json:"task"`
+	After []string        `json:"after"`
+	// Retry is applied when the worker fails or writes to
+	// its err file.
+	Retry RetryPolicy `json:"retry"`
+}
+
+// Pipeline describes a directed acyclic graph of steps. It is
+// written to the pipeline file of a directory created by reading
+// pipelines/clone. At most Jobs.Workers steps run at once, as for
+// map jobs. The retv of each step is held in memory until the
+// pipeline is over, so steps are meant to return small results:
+// larger ones should be stored elsewhere and referenced.
+type Pipeline struct {
+	Input json.RawMessage `json:"input"`
+	Steps []PipelineStep  `json:"steps"`
+}
+
+var stepNameRx = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+// Order returns the indexes of the steps of p sorted so that each
+// step follows its dependencies. Steps that could run at the same
+// time keep the order in which they are listed. Returns an error
+// if p is not a valid directed acyclic graph.
+func (p *Pipeline) Order() ([]int, error) {
+	if len(p.Steps) == 0 {
+		return nil, fmt.Errorf("pipeline has no steps")
+	}
+	index := make(map[string]int, len(p.Steps))
+	for i, v := range p.Steps {
+		if !stepNameRx.MatchString(v.Name) {
+			return nil, fmt.Errorf("step %d: invalid name %q", i, v.Name)
+		}
+		if _, ok := index[v.Name]; ok {
+			return nil, fmt.Errorf("step %v: duplicate name", v.Name)
+		}
+		if len(v.Task) == 0 {
+			return nil, fmt.Errorf("step %v: task is required", v.Name)
+		}
+		index[v.Name] = i
+	}
+	pending := make([]int, len(p.Steps))
+	next := make([][]int, len(p.Steps))
+	for i, v := range p.Steps {
+		for _, dep := range v.After {
+			j, ok := index[dep]
+			if !ok {
+				return nil, fmt.Errorf("step %v: unknown dependency %q", v.Name, dep)
+			}
+			pending[i]++
+			next[j] = append(next[j], i)
+		}
+	}
+
+	order := make([]int, 0, len(p.Steps))
+	done := make([]bool, len(p.Steps))
+	for len(order) < len(p.Steps) {
+		ready := -1
+		for i := range p.Steps {
+			if !done[i] && pending[i] == 0 {
+				ready = i
+				break
+			}
+		}
+		if ready == -1 {
+			var cycle []string
+			for i, v := range p.Steps {
+				if !done[i] {
+					cycle = append(cycle, v.Name)
+				}
+			}
+			return nil, fmt.Errorf("dependency cycle between steps %v", strings.Join(cycle, ", "))
+		}
+		done[ready] = true
+		order = append(order, ready)
+		for _, i := range next[ready] {
+			pending[i]--
+		}
+	}
+	return order, nil
+}
+
+// sinks returns the names of the steps no other step depends on.
+func (p *Pipeline) sinks() []string {
+	needed := make(map[string]bool)
+	for _, v := range p.Steps {
+		for _, dep := range v.After {
+			needed[dep] = true
+		}
+	}
+	var sinks []string
+	for _, v := range p.Steps {
+		if !needed[v.Name] {
+			sinks = append(sinks, v.Name)
+		}
+	}
+	return sinks
+}
+
+func parsePipeline(r io.Reader) (*Pipeline, []int, error) {
+	var p Pipeline
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&p); err != nil {
+		return nil, nil, fmt.Errorf("decode pipeline: %w", err)
+	}
+	order, err := p.Order()
+	if err != nil {
+		return nil, nil, fmt.Errorf("decode pipeline: %w", err)
+	}
+	return &p, order, nil
+}
+
+// stepRun is the execution of a pipeline step, exposed as a
+// directory containing its state, retv and err files.
+type stepRun struct {
+	*file.Dir
+	step             *PipelineStep
+	state, retv, err *file.Multi
+
+	// done is closed when the step is over. out is its retv,
+	// which is valid only if the step did not fail.
+	done   chan struct{}
+	out    []byte
+	failed bool
+}
+
+// input returns the input of r: the pipeline input if r has no
+// dependencies, the retv of its only dependency or, when there
+// are more, a JSON object containing their retv by step name.
+func (r *stepRun) input(p *Pipeline, runs map[string]*stepRun) []byte {
+	switch len(r.step.After) {
+	case 0:
+		return verbatim(p.Input)
+	case 1:
+		return runs[r.step.After[0]].out
+	}
+	in := make(map[string]json.RawMessage, len(r.step.After))
+	for _, dep := range r.step.After {
+		in[dep] = jsonValue(runs[dep].out)
+	}
+	b, _ := json.Marshal(in)
+	return b
+}
+
+// runStep runs r once its dependencies are done, holding one of
+// the slots of workers while its worker runs.
+func (j *job) runStep(p *Pipeline, r *stepRun, runs map[string]*stepRun, workers chan struct{}) {
+	defer close(r.done)
+	h := NewProcessHelper(&Stdio{Err: r.err, Retv: r.retv, State: r.state}, 6)
+	defer h.Done()
+	r.failed = true
+
+	for _, dep := range r.step.After {
+		select {
+		case <-runs[dep].done:
+		case <-j.ctx.Done():
+			h.Errf("step %v: %w", r.step.Name, j.ctx.Err())
+			return
+		}
+		if runs[dep].failed {
+			h.Errf("step %v skipped: step %v failed", r.step.Name, dep)
+			return
+		}
+	}
+
+	select {
+	case workers <- struct{}{}:
+		defer func() { <-workers }()
+	case <-j.ctx.Done():
+		h.Errf("step %v: %w", r.step.Name, j.ctx.Err())
+		return
+	}
+
+	input := r.input(p, runs)
+	task := verbatim(r.step.Task)
+	for attempt := 1; ; attempt++ {
+		retv, errb, err := j.runWorker(j.ctx, task, input, h.Progress)
+		if err == nil && len(jsonValue(errb)) == 0 {
+			r.out, r.failed = retv, false
+			r.retv.Write(retv)
+			return
+		}
+		if err != nil {
+			errb = errorValue(err)
+		}
+		if attempt >= r.step.Retry.Attempts || j.ctx.Err() != nil {
+			r.err.Write(errb)
+			return
+		}
+		delay := r.step.Retry.backoff().Delay(attempt)
+		h.Progress(1, "attempt %d failed: %s, retrying in %v", attempt, jsonValue(errb), delay)
+		select {
+		case <-time.After(delay):
+		case <-j.ctx.Done():
+			r.err.Write(errb)
+			return
+		}
+	}
+}
+
+// runPipeline runs the steps of p, which are listed in order,
+// as soon as their dependencies are done. The retv of the job is
+// the retv of the last step or, when more steps are not followed
+// by any other, a JSON object containing their retv by name.
+func (j *job) runPipeline(p *Pipeline, order []int) {
+	steps := file.NewDirFiles("steps")
+	j.Append(steps)
+
+	total := len(order)
+	h := NewProcessHelper(&Stdio{Err: j.err, Retv: j.retv, State: j.state}, total+1)
+	defer h.Done()
+
+	runs := make(map[string]*stepRun, total)
+	all := make([]*stepRun, 0, total)
+	for _, i := range order {
+		r := &stepRun{
+			step:  &p.Steps[i],
+			state: file.NewMulti("state"),
+			retv:  file.NewMulti("retv"),
+			err:   file.NewMulti("err"),
+			done:  make(chan struct{}),
+		}
+		r.Dir = file.NewDirFiles(r.step.Name, r.state, r.retv, r.err)
+		steps.Append(r)
+		runs[r.step.Name] = r
+		all = append(all, r)
+	}
+	finished := make(chan *stepRun, total)
+	workers := make(chan struct{}, j.srv.Jobs.workers())
+	for _, r := range all {
+		go func(r *stepRun) {
+			j.runStep(p, r, runs, workers)
+			finished <- r
+		}(r)
+	}
+
+	var failed []string
+	for i := 0; i < total; i++ {
+		r := <-finished
+		if r.failed {
+			failed = append(failed, r.step.Name)
+		}
+		h.Progress(i+1, "step %v done, %d/%d", r.step.Name, i+1, total)
+	}
+	if len(failed) > 0 {
+		h.Errf("steps failed: %v", strings.Join(failed, ", "))
+		return
+	}
+
+	sinks := p.sinks()
+	if len(sinks) == 1 {
+		j.retv.Write(runs[sinks[0]].out)
+	} else {
+		out := make(map[string]json.RawMessage, len(sinks))
+		for _, v := range sinks {
+			out[v] = jsonValue(runs[v].out)
+		}
+		h.Retv(out)
+	}
+	j.srv.log().Info("pipeline done", "job", j.name, "user", j.user, "steps", total)
+}
+
+// pipelineRequests returns the file that starts a pipeline.
+func (s *Srv) pipelineRequests(j *job) []fs.File {
+	request := file.NewPlumberCheck("pipeline", j.start, j.plumb(func(p *file.Plumber) (func(), error) {
+		pipeline, order, err := parsePipeline(p)
+		return func() { j.runPipeline(pipeline, order) }, err
+	}))
+	return []fs.File{request}
+}
@@ -0,0 +1,105 @@
+// SPDX-FileCopyrightText: 2020 jecoz
+//
+// SPDX-License-Identifier: BSD-3-Clause
+
+package flexi
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/jecoz/flexi/file"
+)
+
+func TestPipeline_Order(t *testing.T) {
+	task := json.RawMessage(`"echo64"`)
+	step := func(name string, after ...string) PipelineStep {
+		return PipelineStep{Name: name, Task: task, After: after}
+	}
+	tt := []struct {
+		steps []PipelineStep
+		order []int
+		err   bool
+	}{
+		{steps: []PipelineStep{step("a")}, order: []int{0}},
+		{steps: []PipelineStep{step("b", "a"), step("a")}, order: []int{1, 0}},
+		{steps: []PipelineStep{step("c", "a", "b"), step("a"), step("b", "a")}, order: []int{1, 2, 0}},
+		{steps: []PipelineStep{step("a"), step("b"), step("c", "b")}, order: []int{0, 1, 2}},
+		{steps: nil, err: true},
+		{steps: []PipelineStep{step("a"), step("a")}, err: true},
+		{steps: []PipelineStep{step("a", "z")}, err: true},
+		{steps: []PipelineStep{step("a", "a")}, err: true},
+		{steps: []PipelineStep{step("a", "b"), step("b", "a")}, err: true},
+		{steps: []PipelineStep{step("a/b")}, err: true},
+		{steps: []PipelineStep{{Name: "a"}}, err: true},
+	}
+	for i, v := range tt {
+		p := &Pipeline{Steps: v.steps}
+		order, err := p.Order()
+		if v.err {
+			if err == nil {
+				t.Fatalf("%d: expected an error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%d: unexpected error: %v", i, err)
+		}
+		if !reflect.DeepEqual(order, v.order) {
+			t.Fatalf("%d: unexpected order: wanted %v, found %v", i, v.order, order)
+		}
+	}
+}
+
+func TestStepRun_Input(t *testing.T) {
+	p := &Pipeline{Input: json.RawMessage(`"hello"`)}
+	runs := map[string]*stepRun{
+		"a": {out: []byte(`{"n": 1}`)},
+		"b": {out: []byte("plain\n")},
+	}
+	tt := []struct {
+		after []string
+		input string
+	}{
+		{nil, "hello"},
+		{[]string{"b"}, "plain\n"},
+		{[]string{"a", "b"}, `{"a":{"n":1},"b":"plain"}`},
+	}
+	for i, v := range tt {
+		r := &stepRun{step: &PipelineStep{After: v.after}}
+		if input := string(r.input(p, runs)); input != v.input {
+			t.Fatalf("%d: unexpected input: wanted %q, found %q", i, v.input, input)
+		}
+	}
+}
+
+func TestRunStep_Workers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	j := &job{ctx: ctx}
+	r := &stepRun{
+		step:  &PipelineStep{Name: "a"},
+		state: file.NewMulti("state"),
+		retv:  file.NewMulti("retv"),
+		err:   file.NewMulti("err"),
+		done:  make(chan struct{}),
+	}
+	workers := make(chan struct{}, 1)
+	workers <- struct{}{}
+
+	// No worker slot is free: the step waits until
+	// the job is interrupted.
+	go j.runStep(&Pipeline{}, r, nil, workers)
+	select {
+	case <-r.done:
+		t.Fatal("step ran past the workers limit")
+	default:
+	}
+	cancel()
+	<-r.done
+	if !r.failed || !strings.Contains(errorMessage(readAll(r.err)), "context canceled") {
+		t.Fatalf("unexpected step error: %s", readAll(r.err))
+	}
+}
@@ -0,0 +1,160 @@
+// SPDX-FileCopyrightText: 2020 jecoz
+//
+// SPDX-License-Identifier: BSD-3-Clause
+
+package flexi
+
+import (
+	"context"
+	"time"
+)
+
+// RetryPolicy is the JSON friendly version of Backoff.
+type RetryPolicy struct {
+	// Attempts is the maximum number of attempts. Zero
+	// or negative values mean a single attempt.
+	Attempts int      `json:"attempts,omitempty"`
+	Initial  Duration `json:"initial,omitempty"`
+	Max      Duration `json:"max,omitempty"`
+}
+
+func (r RetryPolicy) backoff() Backoff {
+	return Backoff{Attempts: r.Attempts, Initial: r.Initial, Max: r.Max}
+}
+
+// Do calls f until it succeeds, the attempts are over, ctx is
+// done or f fails with an error retryable does not accept. A nil
+// retryable accepts any error. Returns the last error of f.
+func (r RetryPolicy) Do(ctx context.Context, retryable func(error) bool, f func(attempt int) error) error {
+	b := r.backoff()
+	for attempt := 1; ; attempt++ {
+		err := f(attempt)
+		if err == nil || attempt >= b.Attempts || (retryable != nil && !retryable(err)) {
+			return err
+		}
+		timer := time.NewTimer(b.Delay(attempt))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		}
+	}
+}
+
+// SpawnPolicy configures the timeouts and retries applied when
+// remote processes are spawned, mounted and killed. It can be
+// provided both to the server and in spawn payloads, with the
+// spawn_policy field. Zero values are replaced by the server
+// ones, or by DefaultSpawnPolicy, which also cap the values of
+// spawn payloads.
+type SpawnPolicy struct {
+	SpawnTimeout Duration `json:"spawn_timeout,omitempty"`
+	MountTimeout Duration `json:"mount_timeout,omitempty"`
+	KillTimeout  Duration `json:"kill_timeout,omitempty"`
+	// BackendRetry is applied by Spawners to transient backend
+	// failures, such as throttled API calls.
+	BackendRetry RetryPolicy `json:"backend_retry,omitempty"`
+	// MountRetry is applied to failed mounts, which happen when
+	// the 9p server of the remote process is not ready yet.
+	MountRetry RetryPolicy `json:"mount_retry,omitempty"`
+	// Probe is applied before mounting spawned processes.
+	Probe Probe `json:"probe,omitempty"`
+}
+
+// DefaultSpawnPolicy is used when no other policy is provided.
+var DefaultSpawnPolicy = SpawnPolicy{
+	SpawnTimeout: Duration(SpawnTimeout),
+	MountTimeout: Duration(SpawnTimeout),
+	KillTimeout:  Duration(30 * time.Second),
+	BackendRetry: RetryPolicy{Attempts: 3, Initial: Duration(time.Second), Max: Duration(10 * time.Second)},
+	MountRetry:   RetryPolicy{Attempts: 5, Initial: Duration(time.Second), Max: Duration(10 * time.Second)},
+	Probe:        Probe{Timeout: Duration(time.Minute), Interval: Duration(500 * time.Millisecond), MaxInterval: Duration(5 * time.Second)},
+}
+
+func mergeRetry(r, o RetryPolicy) RetryPolicy {
+	if o.Attempts != 0 {
+		r.Attempts = o.Attempts
+	}
+	if o.Initial != 0 {
+		r.Initial = o.Initial
+	}
+	if o.Max != 0 {
+		r.Max = o.Max
+	}
+	return r
+}
+
+// atMost returns d, capped to max.
+func atMost(d, max Duration) Duration {
+	if d > max {
+		return max
+	}
+	return d
+}
+
+func (r RetryPolicy) within(max RetryPolicy) RetryPolicy {
+	if r.Attempts > max.Attempts {
+		r.Attempts = max.Attempts
+	}
+	r.Initial = atMost(r.Initial, max.Initial)
+	r.Max = atMost(r.Max, max.Max)
+	return r
+}
+
+// within returns p with its values capped to the ones of max, so
+// that spawn payloads cannot ask for more than the server allows.
+func (p SpawnPolicy) within(max SpawnPolicy) SpawnPolicy {
+	p.SpawnTimeout = atMost(p.SpawnTimeout, max.SpawnTimeout)
+	p.MountTimeout = atMost(p.MountTimeout, max.MountTimeout)
+	p.KillTimeout = atMost(p.KillTimeout, max.KillTimeout)
+	p.BackendRetry = p.BackendRetry.within(max.BackendRetry)
+	p.MountRetry = p.MountRetry.within(max.MountRetry)
+	p.Probe = p.Probe.within(max.Probe)
+	return p
+}
+
+// Merge returns p with the non-zero values of o.
+func (p SpawnPolicy) Merge(o SpawnPolicy) SpawnPolicy {
+	if o.SpawnTimeout != 0 {
+		p.SpawnTimeout = o.SpawnTimeout
+	}
+	if o.MountTimeout != 0 {
+		p.MountTimeout = o.MountTimeout
+	}
+	if o.KillTimeout != 0 {
+		p.KillTimeout = o.KillTimeout
+	}
+	p.BackendRetry = mergeRetry(p.BackendRetry, o.BackendRetry)
+	p.MountRetry = mergeRetry(p.MountRetry, o.MountRetry)
+	p.Probe = p.Probe.merge(o.Probe)
+	return p
+}
+
+type policyKey struct{}
+
+// WithSpawnPolicy returns a context carrying the policy of a
+// spawn, which Spawners should follow.
+func WithSpawnPolicy(ctx context.Context, p SpawnPolicy) context.Context {
+	return context.WithValue(ctx, policyKey{}, p)
+}
+
+// SpawnPolicyFromContext returns the policy carried by ctx, or
+// DefaultSpawnPolicy.
+func SpawnPolicyFromContext(ctx context.Context) SpawnPolicy {
+	if p, ok := ctx.Value(policyKey{}).(SpawnPolicy); ok {
+		return p
+	}
+	return DefaultSpawnPolicy
+}
+
+// spawnPolicy returns the policy of the remotes of s, merged
+// with the one requested in a spawn payload, which cannot exceed
+// the values of the server.
+func (s *Srv) spawnPolicy(requested SpawnPolicy) SpawnPolicy {
+	p := DefaultSpawnPolicy
+	if s != nil {
+		p = p.Merge(s.SpawnPolicy)
+	}
+	return p.Merge(requested.within(p))
+}
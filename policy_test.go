@@ -0,0 +1,95 @@
+// SPDX-FileCopyrightText: 2020 jecoz
+//
+// SPDX-License-Identifier: BSD-3-Clause
+
+package flexi
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSpawnPolicy_Merge(t *testing.T) {
+	srv := &Srv{SpawnPolicy: SpawnPolicy{
+		KillTimeout: Duration(time.Second),
+		MountRetry:  RetryPolicy{Attempts: 10},
+	}}
+	p := srv.spawnPolicy(SpawnPolicy{
+		SpawnTimeout: Duration(time.Minute),
+		MountRetry:   RetryPolicy{Initial: Duration(time.Millisecond)},
+	})
+	want := DefaultSpawnPolicy
+	want.SpawnTimeout = Duration(time.Minute)
+	want.KillTimeout = Duration(time.Second)
+	want.MountRetry.Attempts = 10
+	want.MountRetry.Initial = Duration(time.Millisecond)
+	if !reflect.DeepEqual(p, want) {
+		t.Fatalf("unexpected policy: wanted %+v, found %+v", want, p)
+	}
+}
+
+func TestSpawnPolicy_Capped(t *testing.T) {
+	srv := &Srv{SpawnPolicy: SpawnPolicy{KillTimeout: Duration(time.Second)}}
+	p := srv.spawnPolicy(SpawnPolicy{
+		KillTimeout: Duration(time.Hour),
+		MountRetry:  RetryPolicy{Attempts: 1000},
+		Probe:       Probe{Timeout: Duration(time.Hour), Files: []string{"in"}},
+	})
+	want := DefaultSpawnPolicy
+	want.KillTimeout = Duration(time.Second)
+	want.Probe.Files = []string{"in"}
+	if !reflect.DeepEqual(p, want) {
+		t.Fatalf("unexpected policy: wanted %+v, found %+v", want, p)
+	}
+}
+
+func TestRetryPolicy_Do(t *testing.T) {
+	r := RetryPolicy{Attempts: 3, Initial: Duration(time.Millisecond)}
+	errTemp := errors.New("temporary")
+	tt := []struct {
+		fail     int
+		err      error
+		attempts int
+	}{
+		{fail: 0, attempts: 1},
+		{fail: 2, err: errTemp, attempts: 3},
+		{fail: 5, err: errTemp, attempts: 3},
+		{fail: 5, err: errors.New("fatal"), attempts: 1},
+	}
+	for i, v := range tt {
+		attempts := 0
+		err := r.Do(context.Background(), func(err error) bool { return err == errTemp }, func(int) error {
+			attempts++
+			if attempts <= v.fail {
+				return v.err
+			}
+			return nil
+		})
+		if attempts != v.attempts {
+			t.Fatalf("%d: unexpected attempts: wanted %d, found %d", i, v.attempts, attempts)
+		}
+		if wantErr := v.fail >= v.attempts; (err != nil) != wantErr {
+			t.Fatalf("%d: unexpected error: %v", i, err)
+		}
+	}
+}
+
+func TestParseSpawnRequest_Policy(t *testing.T) {
+	req, err := parseSpawnRequest(strings.NewReader(`{"image": {}, "spawn_policy": {"mount_timeout": "10s", "mount_retry": {"attempts": 2}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.Policy.MountTimeout != Duration(10*time.Second) || req.Policy.MountRetry.Attempts != 2 {
+		t.Fatalf("unexpected policy: %+v", req.Policy)
+	}
+	if string(req.Payload) != `{"image":{}}` {
+		t.Fatalf("policy was not removed from the payload: %s", req.Payload)
+	}
+	if _, err := parseSpawnRequest(strings.NewReader(`{"spawn_policy": {"timeout": "1s"}}`)); err == nil {
+		t.Fatal("expected an error for unknown policy fields")
+	}
+}
@@ -0,0 +1,172 @@
+// SPDX-FileCopyrightText: 2020 jecoz
+//
+// SPDX-License-Identifier: BSD-3-Clause
+
+package flexi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"aqwari.net/net/styx/styxproto"
+	"github.com/jecoz/flexi/logger"
+)
+
+// Probe configures the readiness probe, which waits for the 9p
+// server of spawned processes to answer before mounting them.
+type Probe struct {
+	// Timeout is how long the 9p server is waited for.
+	Timeout Duration `json:"timeout,omitempty"`
+	// Interval is the initial delay between two attempts,
+	// which doubles up to MaxInterval.
+	Interval    Duration `json:"interval,omitempty"`
+	MaxInterval Duration `json:"max_interval,omitempty"`
+	// Files, if present, must exist in the namespace of the
+	// remote process once mounted, e.g. in and retv.
+	Files []string `json:"files,omitempty"`
+}
+
+func (p Probe) merge(o Probe) Probe {
+	if o.Timeout != 0 {
+		p.Timeout = o.Timeout
+	}
+	if o.Interval != 0 {
+		p.Interval = o.Interval
+	}
+	if o.MaxInterval != 0 {
+		p.MaxInterval = o.MaxInterval
+	}
+	if o.Files != nil {
+		p.Files = o.Files
+	}
+	return p
+}
+
+func (p Probe) within(max Probe) Probe {
+	p.Timeout = atMost(p.Timeout, max.Timeout)
+	p.Interval = atMost(p.Interval, max.Interval)
+	p.MaxInterval = atMost(p.MaxInterval, max.MaxInterval)
+	return p
+}
+
+// probeAttemptTimeout limits each probe attempt.
+const probeAttemptTimeout = 5 * time.Second
+
+// probeMsize is the msize proposed by the readiness probe.
+const probeMsize = 8192
+
+// probe9p dials addr and completes a 9p version handshake.
+func probe9p(ctx context.Context, addr string) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	enc := styxproto.NewEncoder(conn)
+	enc.Tversion(probeMsize, "9P2000")
+	if err := enc.Flush(); err != nil {
+		return fmt.Errorf("write Tversion: %w", err)
+	}
+
+	dec := styxproto.NewDecoder(conn)
+	if !dec.Next() {
+		err := dec.Err()
+		if err == nil {
+			err = io.ErrUnexpectedEOF
+		}
+		return fmt.Errorf("read Rversion: %w", err)
+	}
+	switch m := dec.Msg().(type) {
+	case styxproto.Rversion:
+		if string(m.Version()) == "unknown" {
+			return errors.New("9p version not supported by the server")
+		}
+		return nil
+	case styxproto.Rerror:
+		return fmt.Errorf("version handshake refused: %s", m.Ename())
+	default:
+		return fmt.Errorf("unexpected %T in place of Rversion", m)
+	}
+}
+
+// waitReady probes addr until its 9p server answers, the probe
+// timeout is over or ctx is done. report is called after each
+// failed attempt.
+func waitReady(ctx context.Context, addr string, p Probe, report func(attempt int, err error)) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(p.Timeout))
+	defer cancel()
+	b := Backoff{Initial: p.Interval, Max: p.MaxInterval}
+	for attempt := 1; ; attempt++ {
+		actx, acancel := context.WithTimeout(ctx, probeAttemptTimeout)
+		err := probe9p(actx, addr)
+		acancel()
+		if err == nil {
+			return nil
+		}
+		report(attempt, err)
+		timer := time.NewTimer(b.Delay(attempt))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return WithCode(CodeTimeout, fmt.Errorf("9p server not ready after %d attempts: %w", attempt, err))
+		}
+	}
+}
+
+// checkFiles returns an error if any of files is missing from
+// the namespace mounted at path.
+func checkFiles(path string, files []string) error {
+	for _, v := range files {
+		if _, err := os.Stat(filepath.Join(path, v)); err != nil {
+			return fmt.Errorf("remote process namespace: %w", err)
+		}
+	}
+	return nil
+}
+
+// mountReady waits for the 9p server at addr to answer, mounts
+// it at path, retrying as p says, and checks that the files
+// required by p.Probe are there. progress is told about the
+// failed attempts.
+func mountReady(ctx context.Context, addr, path string, p SpawnPolicy, progress func(format string, args ...interface{})) error {
+	progress("waiting for the 9p server @ %v", addr)
+	report := func(attempt int, err error) {
+		progress("9p server @ %v not ready (attempt %d): %v", addr, attempt, err)
+	}
+	if err := waitReady(ctx, addr, p.Probe, report); err != nil {
+		return fmt.Errorf("probe remote process: %w", err)
+	}
+	log := logger.FromContext(ctx)
+	err := p.MountRetry.Do(ctx, nil, func(attempt int) error {
+		if attempt > 1 {
+			progress("mount attempt %d @ %v", attempt, addr)
+		}
+		err := mount9p(ctx, addr, path)
+		if err != nil {
+			log.Debug("mount failed", "attempt", attempt, "error", err)
+		}
+		return err
+	})
+	if err != nil {
+		return WithCode(CodeMountFailed, fmt.Errorf("mount remote process: %w", err))
+	}
+	if err := checkFiles(path, p.Probe.Files); err != nil {
+		if err := Umount(path); err != nil {
+			log.Error("unable to umount unready process", "path", path, "error", err)
+		}
+		return WithCode(CodeMountFailed, fmt.Errorf("probe remote process: %w", err))
+	}
+	return nil
+}
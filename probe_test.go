@@ -0,0 +1,112 @@
+// SPDX-FileCopyrightText: 2020 jecoz
+//
+// SPDX-License-Identifier: BSD-3-Clause
+
+package flexi
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"aqwari.net/net/styx/styxproto"
+	"github.com/jecoz/flexi/file"
+	"github.com/jecoz/flexi/file/memfs"
+	"github.com/jecoz/flexi/logger"
+	"github.com/jecoz/flexi/styx"
+)
+
+func TestProbe9p(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	fs := memfs.New(file.NewDirFiles("", file.NewMulti("in")))
+	go styx.Serve(ln, fs, styx.Options{Log: logger.Nop})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := probe9p(ctx, ln.Addr().String()); err != nil {
+		t.Fatalf("unexpected probe error: %v", err)
+	}
+}
+
+func TestProbe9p_Refused(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		dec := styxproto.NewDecoder(conn)
+		if !dec.Next() {
+			return
+		}
+		enc := styxproto.NewEncoder(conn)
+		enc.Rerror(styxproto.NoTag, "go away")
+		enc.Flush()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := probe9p(ctx, ln.Addr().String()); err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestWaitReady_Timeout(t *testing.T) {
+	// Reserve an address nobody is listening on.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	attempts := 0
+	p := Probe{Timeout: Duration(200 * time.Millisecond), Interval: Duration(10 * time.Millisecond)}
+	err = waitReady(context.Background(), addr, p, func(int, error) { attempts++ })
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if CodeOf(err) != CodeTimeout {
+		t.Fatalf("unexpected code: %v", CodeOf(err))
+	}
+	if attempts < 2 {
+		t.Fatalf("expected more than one attempt, found %d", attempts)
+	}
+}
+
+func TestMountReady_NotReady(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	p := DefaultSpawnPolicy
+	p.Probe = Probe{Timeout: Duration(100 * time.Millisecond), Interval: Duration(10 * time.Millisecond)}
+	path := filepath.Join(t.TempDir(), "mnt")
+	var reports int
+	err = mountReady(context.Background(), addr, path, p, func(string, ...interface{}) { reports++ })
+	if CodeOf(err) != CodeTimeout {
+		t.Fatalf("have [%v], want a timeout", err)
+	}
+	if reports < 2 {
+		t.Fatalf("have %d progress reports, want at least 2", reports)
+	}
+	// Nothing is mounted if the 9p server does not answer.
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("mount point created: %v", err)
+	}
+}
@@ -6,18 +6,24 @@ package flexi
 
 import (
 	"bytes"
+	"context"
 	"encoding/csv"
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
+	"io/ioutil"
 	"net"
+	"runtime/debug"
 	"strconv"
+	"sync"
+	"time"
 
 	"github.com/jecoz/flexi/file"
 	"github.com/jecoz/flexi/file/memfs"
 	"github.com/jecoz/flexi/fs"
+	"github.com/jecoz/flexi/logger"
 	"github.com/jecoz/flexi/styx"
+	"github.com/jecoz/flexi/trace"
 )
 
 type Stdio struct {
@@ -31,6 +37,26 @@ type Stdio struct {
 	Retv io.WriteCloser
 	// Write here status updates.
 	State io.WriteCloser
+
+	// errs is the error document written to Err, shared by
+	// the helpers of the Stdio.
+	errs *errLog
+}
+
+// errLog is the error document of a Stdio, together with the
+// errors that could not be written to its err file yet.
+type errLog struct {
+	mu      sync.Mutex
+	doc     ErrorDoc
+	pending []error
+}
+
+// errLog returns the error log of i.
+func (i *Stdio) errLog() *errLog {
+	if i.errs == nil {
+		i.errs = new(errLog)
+	}
+	return i.errs
 }
 
 // Processor describes an entity that is capable of executing
@@ -51,30 +77,90 @@ type Process struct {
 	FS     fs.FS
 	Ln     net.Listener
 	Runner Processor
+	// Log is used to log process events. Defaults to
+	// logger.Default.
+	Log logger.Logger
+	// Files configures the files and directories created
+	// by clients.
+	Files styx.Files
+}
+
+func (p *Process) log() logger.Logger {
+	if p.Log == nil {
+		return logger.Default
+	}
+	return p.Log
 }
 
 func (p *Process) Serve() error {
-	return styx.Serve(p.Ln, p.FS)
+	return styx.Serve(p.Ln, p.FS, styx.Options{Log: p.log(), Files: p.Files})
+}
+
+// traceparent returns the span context stored in the trace
+// file, which flexi creates when the process is spawned.
+func (p *Process) traceparent() (trace.SpanContext, error) {
+	f, err := p.FS.Open("/trace")
+	if err != nil {
+		return trace.SpanContext{}, err
+	}
+	rwc, err := f.Open()
+	if err != nil {
+		return trace.SpanContext{}, err
+	}
+	defer rwc.Close()
+	b, err := ioutil.ReadAll(rwc)
+	if err != nil {
+		return trace.SpanContext{}, err
+	}
+	return trace.ParseTraceparent(string(b))
 }
 
 func ServeProcess(ln net.Listener, r Processor) error {
+	p := &Process{Ln: ln, Runner: r}
+	return p.Run()
+}
+
+// Run prepares the process namespace and serves it on p.Ln.
+// p.Runner is executed when the in file is written.
+func (p *Process) Run() error {
+	r := p.Runner
+	log := p.log()
 	err := file.NewMulti("err")
 	retv := file.NewMulti("retv")
 	state := file.NewMulti("state")
-	in := file.NewPlumber("in", func(p *file.Plumber) bool {
+	in := file.NewPlumber("in", func(in *file.Plumber) bool {
 		buf := new(bytes.Buffer)
-		if _, err := io.Copy(buf, p); err != nil {
+		if _, err := io.Copy(buf, in); err != nil {
+			log.Error("unable to buffer input", "error", err)
 			return false
 		}
+		bytesWritten.Add(float64(buf.Len()), "in")
 
 		go func() {
 			stdio := &Stdio{
 				In:    buf,
 				Err:   err,
-				Retv:  retv,
+				Retv:  &countWriter{WriteCloser: retv, name: "retv"},
 				State: state,
 			}
-			r.Run(stdio)
+			ctx := context.Background()
+			if sc, err := p.traceparent(); err == nil {
+				ctx = trace.ContextWithRemote(ctx, sc)
+			}
+			_, span := trace.Start(ctx, "flexi.process.run", "input_bytes", buf.Len())
+			log := log.With("trace", span.TraceID)
+
+			start := time.Now()
+			log.Info("processor started", "input_bytes", buf.Len())
+			if err := runProcessor(r, stdio); err != nil {
+				log.Error("processor panicked", "error", err.Error(), "stack", string(err.Stack))
+				span.SetError(err)
+				processPanics.Inc()
+			}
+			processRuns.Inc()
+			processDuration.Observe(time.Since(start).Seconds())
+			log.Info("processor done", "duration", time.Since(start))
+			span.Finish()
 			err.Close()
 			retv.Close()
 		}()
@@ -87,28 +173,59 @@ func ServeProcess(ln net.Listener, r Processor) error {
 		retv,
 		state,
 	)
-	p := Process{
-		FS:     memfs.New(root),
-		Ln:     ln,
-		Runner: r,
-	}
-	log.Printf("*** listening on %v", ln.Addr())
+	p.FS = memfs.New(root)
+	log.Info("listening", "addr", p.Ln.Addr())
 	return p.Serve()
 }
 
+// PanicError is recorded in the err file of a process when its
+// Processor panics.
+type PanicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+func (e *PanicError) Error() string { return fmt.Sprintf("processor panicked: %v", e.Value) }
+
+// runProcessor runs r, recovering it from panics. In that case
+// the panic is appended to the errors recorded by r in the err
+// file and the state file is marked as done, so that clients do
+// not wait forever.
+func runProcessor(r Processor, i *Stdio) (perr *PanicError) {
+	defer func() {
+		v := recover()
+		if v == nil {
+			return
+		}
+		perr = &PanicError{Value: v, Stack: debug.Stack()}
+		h := NewProcessHelper(i, 1)
+		h.OnError = func(error) {}
+		h.Err(perr)
+		h.Done()
+	}()
+	r.Run(i)
+	return nil
+}
+
 // Use NewProcessHelper to create a working instance
 // of ProcessHelper.
 type ProcessHelper struct {
-	tot float64
-	i   *Stdio
-	pw  *csv.Writer
+	// OnError is called when writing to Stdio fails. Failures
+	// are logged if it is nil.
+	OnError func(error)
+
+	tot  float64
+	i    *Stdio
+	pw   *csv.Writer
+	errs *errLog
 }
 
 func (h *ProcessHelper) relayErr(err error) {
-	// TODO: panic-ing here is just a tmp solution.
-	// I would rather prefer to contact a human.
-	// Log? Email? Slack?
-	panic(err)
+	if h.OnError != nil {
+		h.OnError(err)
+		return
+	}
+	logger.Default.Error("process helper write failed", "error", err)
 }
 
 func (h *ProcessHelper) Progress(step int, format string, args ...interface{}) {
@@ -125,16 +242,46 @@ func (h *ProcessHelper) Progress(step int, format string, args ...interface{}) {
 	}
 }
 
+// Err records err in the error document of the process, which
+// is rewritten from scratch if the err file can be reset or
+// truncated. The document is shared by all the helpers of the
+// same Stdio. If it cannot be written, OnError is called with
+// each error missing from the err file.
 func (h *ProcessHelper) Err(err error) {
-	// TODO: if we write multiple times to h.Err we'll produce
-	// and invalid json payload. We should be able to truncate
-	// the file instead.
-	if werr := json.NewEncoder(h.i.Err).Encode(&struct {
-		Error string `json:"error"`
-	}{
-		Error: err.Error(),
-	}); werr != nil {
-		h.relayErr(fmt.Errorf("%v: %w", werr, err))
+	l := h.errs
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.doc.Add(err)
+	l.pending = append(l.pending, err)
+	var reset func() error
+	switch f := h.i.Err.(type) {
+	case interface{ Reset() error }:
+		reset = f.Reset
+	case interface{ Truncate(int64) error }:
+		reset = func() error { return f.Truncate(0) }
+	}
+	if reset != nil {
+		if terr := reset(); terr != nil {
+			h.relayPending(terr)
+			return
+		}
+	} else if len(l.doc.Errors) > 1 {
+		// Only the last document will be complete,
+		// while the previous ones are left in place.
+		h.relayErr(fmt.Errorf("err file cannot be truncated: %w", err))
+	}
+	if werr := json.NewEncoder(h.i.Err).Encode(&l.doc); werr != nil {
+		h.relayPending(werr)
+		return
+	}
+	l.pending = nil
+}
+
+// relayPending relays the errors that are not in the err file
+// yet, wrapped by cause.
+func (h *ProcessHelper) relayPending(cause error) {
+	for _, err := range h.errs.pending {
+		h.relayErr(fmt.Errorf("%v: %w", cause, err))
 	}
 }
 
@@ -159,8 +306,9 @@ func (h *ProcessHelper) Done() { h.Progress(int(h.tot), "done!") }
 
 func NewProcessHelper(i *Stdio, tot int) *ProcessHelper {
 	return &ProcessHelper{
-		tot: float64(tot),
-		i:   i,
-		pw:  csv.NewWriter(i.State),
+		tot:  float64(tot),
+		i:    i,
+		pw:   csv.NewWriter(i.State),
+		errs: i.errLog(),
 	}
 }
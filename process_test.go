@@ -0,0 +1,124 @@
+// SPDX-FileCopyrightText: 2020 jecoz
+//
+// SPDX-License-Identifier: BSD-3-Clause
+
+package flexi
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/jecoz/flexi/file"
+)
+
+type nopCloser struct{ *bytes.Buffer }
+
+func (nopCloser) Close() error { return nil }
+
+type brokenWriter struct{}
+
+func (brokenWriter) Write(p []byte) (int, error) { return 0, errors.New("broken") }
+func (brokenWriter) Close() error                { return nil }
+
+func TestRunProcessor_Panic(t *testing.T) {
+	errb, state := new(bytes.Buffer), new(bytes.Buffer)
+	i := &Stdio{Err: nopCloser{errb}, State: nopCloser{state}, Retv: nopCloser{new(bytes.Buffer)}}
+	perr := runProcessor(ProcessorFunc(func(*Stdio) { panic("boom") }), i)
+	if perr == nil {
+		t.Fatal("expected a panic error")
+	}
+	if len(perr.Stack) == 0 {
+		t.Fatal("expected a stack trace")
+	}
+	var e ErrorDoc
+	if err := json.Unmarshal(errb.Bytes(), &e); err != nil {
+		t.Fatalf("err is not valid json: %v", err)
+	}
+	if !strings.Contains(e.Error, "boom") || len(e.Errors) != 1 || e.Errors[0].Stack == "" {
+		t.Fatalf("unexpected error: %q", e.Error)
+	}
+	if !workerDone(state.Bytes()) {
+		t.Fatalf("state is not done: %q", state)
+	}
+
+	if perr := runProcessor(ProcessorFunc(func(*Stdio) {}), i); perr != nil {
+		t.Fatalf("unexpected panic error: %v", perr)
+	}
+}
+
+func TestRunProcessor_PanicAfterErr(t *testing.T) {
+	errf := file.NewMulti("err")
+	i := &Stdio{Err: errf, State: nopCloser{new(bytes.Buffer)}, Retv: nopCloser{new(bytes.Buffer)}}
+	runProcessor(ProcessorFunc(func(i *Stdio) {
+		NewProcessHelper(i, 2).Errf("first")
+		panic("boom")
+	}), i)
+
+	var doc ErrorDoc
+	if err := json.Unmarshal(readAll(errf), &doc); err != nil {
+		t.Fatal(err)
+	}
+	if len(doc.Errors) != 2 || doc.Errors[0].Message != "first" || !strings.Contains(doc.Errors[1].Message, "boom") {
+		t.Fatalf("unexpected errors: %+v", doc.Errors)
+	}
+}
+
+func TestProcessHelper_OnError(t *testing.T) {
+	var errs []error
+	h := NewProcessHelper(&Stdio{Err: brokenWriter{}, State: brokenWriter{}}, 2)
+	h.OnError = func(err error) { errs = append(errs, err) }
+	h.Progress(1, "working")
+	h.Errf("failed")
+	if len(errs) == 0 {
+		t.Fatal("write failures were not reported")
+	}
+}
+
+func TestProcessHelper_OnErrorPending(t *testing.T) {
+	i := &Stdio{Err: brokenWriter{}, State: nopCloser{new(bytes.Buffer)}}
+	var errs []error
+	h := NewProcessHelper(i, 2)
+	h.OnError = func(err error) { errs = append(errs, err) }
+	h.Errf("first")
+	errs = nil
+
+	// Errors recorded by other helpers of the Stdio, as the one
+	// used by runProcessor on panics, are relayed too.
+	p := NewProcessHelper(i, 1)
+	p.OnError = h.OnError
+	p.Errf("second")
+	if n := len(errs); n < 2 || !strings.HasSuffix(errs[n-2].Error(), "broken: first") || !strings.HasSuffix(errs[n-1].Error(), "broken: second") {
+		t.Fatalf("unexpected relayed errors: %v", errs)
+	}
+}
+
+type codeError struct{}
+
+func (codeError) Error() string { return "quota exceeded" }
+func (codeError) Code() Code    { return CodeQuota }
+
+func TestProcessHelper_Err(t *testing.T) {
+	errf := file.NewMulti("err")
+	h := NewProcessHelper(&Stdio{Err: errf, State: nopCloser{new(bytes.Buffer)}}, 1)
+	h.Errf("first")
+	h.Err(fmt.Errorf("second: %w", codeError{}))
+
+	var doc ErrorDoc
+	dec := json.NewDecoder(bytes.NewReader(readAll(errf)))
+	if err := dec.Decode(&doc); err != nil {
+		t.Fatal(err)
+	}
+	if dec.More() {
+		t.Fatal("err contains more than one document")
+	}
+	if doc.Error != "second: quota exceeded" {
+		t.Fatalf("unexpected last error: %q", doc.Error)
+	}
+	if len(doc.Errors) != 2 || doc.Errors[0].Message != "first" || doc.Errors[1].Code != CodeQuota || doc.Errors[0].Code != CodeInternal {
+		t.Fatalf("unexpected errors: %+v", doc.Errors)
+	}
+}
@@ -0,0 +1,215 @@
+// SPDX-FileCopyrightText: 2020 jecoz
+//
+// SPDX-License-Identifier: BSD-3-Clause
+
+package flexi
+
+import (
+	"container/heap"
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Backoff describes an exponential backoff policy.
+type Backoff struct {
+	// Attempts is the maximum number of attempts. Zero
+	// or negative values mean a single attempt.
+	Attempts int `json:"attempts"`
+	// Initial is the delay applied after the first failure.
+	Initial Duration `json:"initial"`
+	// Max caps the delay between two attempts.
+	Max Duration `json:"max"`
+}
+
+// Delay returns how much time should pass before attempt
+// n+1, where n starts from 1.
+func (b Backoff) Delay(n int) time.Duration {
+	d, max := time.Duration(b.Initial), time.Duration(b.Max)
+	if d <= 0 {
+		d = time.Second
+	}
+	for i := 1; i < n; i++ {
+		d *= 2
+		if max > 0 && d >= max {
+			return max
+		}
+	}
+	if max > 0 && d > max {
+		return max
+	}
+	return d
+}
+
+// IsRetryable reports whether the operation that returned err
+// is worth retrying later on, according to its Code.
+func IsRetryable(err error) bool {
+	return CodeOf(err).Retryable()
+}
+
+// QueueReport is used by SpawnQueue to notify a queued
+// spawn about its position in the queue (starting from 1,
+// 0 means it is running) or about a failed attempt that
+// is going to be retried after delay.
+type QueueReport func(pos, attempt int, err error, delay time.Duration)
+
+// SpawnQueue limits the number of concurrent spawns. Pending
+// spawns are ordered by priority (higher first) and then in
+// FIFO order. Attempts failing with retryable errors are
+// queued again with exponential backoff.
+type SpawnQueue struct {
+	// MaxInflight is the maximum number of spawns that
+	// can be executed concurrently. Defaults to 1.
+	MaxInflight int
+	// Retry is applied to attempts failing with an error
+	// accepted by IsRetryable.
+	Retry Backoff
+
+	sync.Mutex
+	items    queueItems
+	seq      uint64
+	inflight int
+}
+
+type queueItem struct {
+	priority int
+	seq      uint64
+	index    int
+	pos      int
+	report   QueueReport
+	ready    chan struct{}
+}
+
+type queueItems []*queueItem
+
+func (q queueItems) Len() int { return len(q) }
+func (q queueItems) Less(i, j int) bool {
+	if q[i].priority != q[j].priority {
+		return q[i].priority > q[j].priority
+	}
+	return q[i].seq < q[j].seq
+}
+func (q queueItems) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+func (q *queueItems) Push(x interface{}) {
+	item := x.(*queueItem)
+	item.index = len(*q)
+	*q = append(*q, item)
+}
+func (q *queueItems) Pop() interface{} {
+	old := *q
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil
+	item.index = -1
+	*q = old[:n-1]
+	return item
+}
+
+// Len returns the number of spawns waiting in the queue.
+func (q *SpawnQueue) Len() int {
+	q.Lock()
+	defer q.Unlock()
+	return len(q.items)
+}
+
+// dispatch starts as many pending items as possible and
+// notifies the others about their position. Call with q locked.
+func (q *SpawnQueue) dispatch() {
+	max := q.MaxInflight
+	if max <= 0 {
+		max = 1
+	}
+	for q.inflight < max && len(q.items) > 0 {
+		item := heap.Pop(&q.items).(*queueItem)
+		q.inflight++
+		item.pos = 0
+		close(item.ready)
+	}
+
+	// Do not use sort.Sort here, as Swap would break
+	// the indexes of the heap.
+	sorted := make(queueItems, len(q.items))
+	copy(sorted, q.items)
+	sort.Slice(sorted, sorted.Less)
+	for i, v := range sorted {
+		if v.pos != i+1 {
+			v.pos = i + 1
+			if v.report != nil {
+				v.report(v.pos, 0, nil, 0)
+			}
+		}
+	}
+}
+
+func (q *SpawnQueue) push(item *queueItem) {
+	q.Lock()
+	defer q.Unlock()
+	item.ready = make(chan struct{})
+	heap.Push(&q.items, item)
+	q.dispatch()
+}
+
+func (q *SpawnQueue) remove(item *queueItem) {
+	q.Lock()
+	defer q.Unlock()
+	select {
+	case <-item.ready:
+		// The item was dispatched in the meanwhile,
+		// hence it is holding a slot.
+		q.inflight--
+	default:
+		heap.Remove(&q.items, item.index)
+	}
+	q.dispatch()
+}
+
+func (q *SpawnQueue) done() {
+	q.Lock()
+	defer q.Unlock()
+	q.inflight--
+	q.dispatch()
+}
+
+// Do queues f and waits for its turn to execute it. f is
+// retried according to q.Retry as long as it fails with
+// a retryable error. Do returns the last error returned by
+// f, or ctx's error if ctx is done before f succeeds.
+func (q *SpawnQueue) Do(ctx context.Context, priority int, report QueueReport, f func(context.Context) error) error {
+	q.Lock()
+	q.seq++
+	item := &queueItem{priority: priority, seq: q.seq, report: report, index: -1}
+	q.Unlock()
+
+	for attempt := 1; ; attempt++ {
+		q.push(item)
+		select {
+		case <-item.ready:
+		case <-ctx.Done():
+			q.remove(item)
+			return ctx.Err()
+		}
+
+		err := f(ctx)
+		q.done()
+		if err == nil || !IsRetryable(err) || attempt >= q.Retry.Attempts {
+			return err
+		}
+
+		delay := q.Retry.Delay(attempt)
+		if report != nil {
+			report(0, attempt, err, delay)
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
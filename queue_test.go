@@ -0,0 +1,95 @@
+// SPDX-FileCopyrightText: 2020 jecoz
+//
+// SPDX-License-Identifier: BSD-3-Clause
+
+package flexi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSpawnQueue_Order(t *testing.T) {
+	q := &SpawnQueue{MaxInflight: 1}
+	ctx := context.Background()
+
+	block := make(chan struct{})
+	started := make(chan struct{})
+	go q.Do(ctx, 0, nil, func(context.Context) error {
+		close(started)
+		<-block
+		return nil
+	})
+	<-started
+
+	var mu sync.Mutex
+	var have []int
+	var wg sync.WaitGroup
+	for i, prio := range []int{0, 1, 0, 2} {
+		wg.Add(1)
+		i, prio := i, prio
+		go q.Do(ctx, prio, nil, func(context.Context) error {
+			defer wg.Done()
+			mu.Lock()
+			have = append(have, i)
+			mu.Unlock()
+			return nil
+		})
+		// Wait for the item to be queued, to have a
+		// deterministic FIFO order.
+		for q.Len() != i+1 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	close(block)
+	wg.Wait()
+
+	want := []int{3, 1, 0, 2}
+	for i := range want {
+		if have[i] != want[i] {
+			t.Fatalf("have %v, want %v", have, want)
+		}
+	}
+}
+
+type temporary struct{}
+
+func (temporary) Error() string   { return "temporary" }
+func (temporary) Temporary() bool { return true }
+
+func TestSpawnQueue_Retry(t *testing.T) {
+	q := &SpawnQueue{Retry: Backoff{Attempts: 3, Initial: Duration(time.Millisecond)}}
+	attempts := 0
+	err := q.Do(context.Background(), 0, nil, func(context.Context) error {
+		attempts++
+		return temporary{}
+	})
+	if !errors.Is(err, temporary{}) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if attempts != 3 {
+		t.Fatalf("have %d attempts, want 3", attempts)
+	}
+}
+
+func TestBackoff_JSON(t *testing.T) {
+	b := Backoff{Attempts: 3, Initial: Duration(time.Second), Max: Duration(time.Minute)}
+	data, err := json.Marshal(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"attempts":3,"initial":"1s","max":"1m0s"}`; string(data) != want {
+		t.Fatalf("want %s, have %s", want, data)
+	}
+	var have Backoff
+	if err := json.Unmarshal(data, &have); err != nil {
+		t.Fatal(err)
+	}
+	if have != b {
+		t.Fatalf("want %+v, have %+v", b, have)
+	}
+}
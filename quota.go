@@ -0,0 +1,164 @@
+// SPDX-FileCopyrightText: 2020 jecoz
+//
+// SPDX-License-Identifier: BSD-3-Clause
+
+package flexi
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Limits describes how many remotes flexi is allowed to manage.
+// Zero values mean no limit.
+type Limits struct {
+	// MaxRemotes is the maximum number of remotes that can
+	// be active at the same time.
+	MaxRemotes int `json:"max_remotes"`
+	// MaxRemotesPerUser is the maximum number of remotes a
+	// single 9p user can have active at the same time.
+	MaxRemotesPerUser int `json:"max_remotes_per_user"`
+	// SpawnsPerMinute limits how many spawn operations are
+	// accepted within a one minute window.
+	SpawnsPerMinute int `json:"spawns_per_minute"`
+}
+
+// within returns l, taking the limits l does not set from parent
+// and capping the others to the parent ones.
+func (l Limits) within(parent Limits) Limits {
+	limit := func(n, max int) int {
+		if n <= 0 || (max > 0 && n > max) {
+			return max
+		}
+		return n
+	}
+	return Limits{
+		MaxRemotes:        limit(l.MaxRemotes, parent.MaxRemotes),
+		MaxRemotesPerUser: limit(l.MaxRemotesPerUser, parent.MaxRemotesPerUser),
+		SpawnsPerMinute:   limit(l.SpawnsPerMinute, parent.SpawnsPerMinute),
+	}
+}
+
+var ErrQuota = errors.New("quota exceeded")
+
+// quota enforces Limits. The zero value is ready to use and
+// does not limit anything.
+type quota struct {
+	Limits
+
+	sync.Mutex
+	total  int
+	users  map[string]int
+	spawns []time.Time
+	now    func() time.Time
+}
+
+func (q *quota) timeNow() time.Time {
+	if q.now == nil {
+		return time.Now()
+	}
+	return q.now()
+}
+
+// Acquire reserves a remote for user, returning an error
+// wrapping ErrQuota if either the global or the user limit
+// is reached.
+func (q *quota) Acquire(user string) error {
+	q.Lock()
+	defer q.Unlock()
+	if q.users == nil {
+		q.users = make(map[string]int)
+	}
+	if q.MaxRemotes > 0 && q.total >= q.MaxRemotes {
+		return fmt.Errorf("%w: %d active remotes (max %d)", ErrQuota, q.total, q.MaxRemotes)
+	}
+	if n := q.users[user]; q.MaxRemotesPerUser > 0 && n >= q.MaxRemotesPerUser {
+		return fmt.Errorf("%w: user %q has %d active remotes (max %d)", ErrQuota, user, n, q.MaxRemotesPerUser)
+	}
+	q.total++
+	q.users[user]++
+	return nil
+}
+
+// Release gives back a remote previously obtained with Acquire.
+func (q *quota) Release(user string) {
+	q.Lock()
+	defer q.Unlock()
+	if n, ok := q.users[user]; ok {
+		if n <= 1 {
+			delete(q.users, user)
+		} else {
+			q.users[user] = n - 1
+		}
+	}
+	if q.total > 0 {
+		q.total--
+	}
+}
+
+// trimSpawns drops the spawns that are older than a minute.
+// Call with q locked.
+func (q *quota) trimSpawns(now time.Time) {
+	i := 0
+	for ; i < len(q.spawns); i++ {
+		if now.Sub(q.spawns[i]) < time.Minute {
+			break
+		}
+	}
+	q.spawns = q.spawns[i:]
+}
+
+// Spawn records a spawn operation, returning an error wrapping
+// ErrQuota if the spawn rate is exceeded.
+func (q *quota) Spawn() error {
+	q.Lock()
+	defer q.Unlock()
+	now := q.timeNow()
+	q.trimSpawns(now)
+	if q.SpawnsPerMinute > 0 && len(q.spawns) >= q.SpawnsPerMinute {
+		return fmt.Errorf("%w: %d spawns in the last minute (max %d)", ErrQuota, len(q.spawns), q.SpawnsPerMinute)
+	}
+	q.spawns = append(q.spawns, now)
+	return nil
+}
+
+// unspawn forgets the last spawn recorded with Spawn.
+func (q *quota) unspawn() {
+	q.Lock()
+	defer q.Unlock()
+	if n := len(q.spawns); n > 0 {
+		q.spawns = q.spawns[:n-1]
+	}
+}
+
+func limitString(n int) string {
+	if n <= 0 {
+		return "unlimited"
+	}
+	return fmt.Sprintf("%d", n)
+}
+
+// Usage returns a human readable report of the current usage.
+func (q *quota) Usage() []byte {
+	q.Lock()
+	defer q.Unlock()
+	q.trimSpawns(q.timeNow())
+
+	b := new(bytes.Buffer)
+	fmt.Fprintf(b, "remotes %d %s\n", q.total, limitString(q.MaxRemotes))
+	fmt.Fprintf(b, "spawns/min %d %s\n", len(q.spawns), limitString(q.SpawnsPerMinute))
+
+	users := make([]string, 0, len(q.users))
+	for k := range q.users {
+		users = append(users, k)
+	}
+	sort.Strings(users)
+	for _, v := range users {
+		fmt.Fprintf(b, "user %q %d %s\n", v, q.users[v], limitString(q.MaxRemotesPerUser))
+	}
+	return b.Bytes()
+}
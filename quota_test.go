@@ -0,0 +1,54 @@
+// SPDX-FileCopyrightText: 2020 jecoz
+//
+// SPDX-License-Identifier: BSD-3-Clause
+
+package flexi
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestQuota_Acquire(t *testing.T) {
+	q := &quota{Limits: Limits{MaxRemotes: 3, MaxRemotesPerUser: 2}}
+	tt := []struct {
+		user string
+		err  error
+	}{
+		{user: "glenda"},
+		{user: "glenda"},
+		{user: "glenda", err: ErrQuota},
+		{user: "bootes"},
+		{user: "bootes", err: ErrQuota},
+	}
+	for i, v := range tt {
+		if err := q.Acquire(v.user); !errors.Is(err, v.err) {
+			t.Fatalf("%d: have [%v], want [%v]", i, err, v.err)
+		}
+	}
+	q.Release("glenda")
+	if err := q.Acquire("bootes"); err != nil {
+		t.Fatalf("acquire after release: %v", err)
+	}
+}
+
+func TestQuota_Spawn(t *testing.T) {
+	now := time.Now()
+	q := &quota{
+		Limits: Limits{SpawnsPerMinute: 2},
+		now:    func() time.Time { return now },
+	}
+	for i := 0; i < 2; i++ {
+		if err := q.Spawn(); err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+	}
+	if err := q.Spawn(); !errors.Is(err, ErrQuota) {
+		t.Fatalf("have [%v], want [%v]", err, ErrQuota)
+	}
+	now = now.Add(time.Minute)
+	if err := q.Spawn(); err != nil {
+		t.Fatalf("spawn after one minute: %v", err)
+	}
+}
@@ -0,0 +1,245 @@
+// SPDX-FileCopyrightText: 2020 jecoz
+//
+// SPDX-License-Identifier: BSD-3-Clause
+
+package flexi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"time"
+)
+
+// Orphan policies.
+const (
+	OrphanReport = "report"
+	OrphanKill   = "kill"
+	OrphanAdopt  = "adopt"
+)
+
+// DefaultOrphanAge is the default value of Reconcile.MinAge.
+const DefaultOrphanAge = 10 * time.Minute
+
+// Reconcile configures the reconciliation passes, which compare
+// the processes running on the backends of the Spawners that are
+// Reconcilers with the ones flexi knows about. Unknown processes
+// are orphans: they are reported with remote.orphan events and
+// listed in the orphans file, then killed or adopted according to
+// Policy.
+type Reconcile struct {
+	// Policy is one of OrphanReport, OrphanKill and
+	// OrphanAdopt. Defaults to OrphanReport.
+	Policy string
+	// Interval is the time between passes. Zero means that
+	// the only pass happens at startup.
+	Interval time.Duration
+	// MinAge is how old unknown processes have to be to be
+	// considered orphans, so that the ones being spawned are
+	// left alone. Defaults to DefaultOrphanAge.
+	MinAge time.Duration
+}
+
+func (c *Reconcile) Validate() error {
+	switch c.Policy {
+	case "", OrphanReport, OrphanKill, OrphanAdopt:
+		return nil
+	default:
+		return fmt.Errorf("unknown orphan policy %q", c.Policy)
+	}
+}
+
+func (c *Reconcile) policy() string {
+	if c.Policy == "" {
+		return OrphanReport
+	}
+	return c.Policy
+}
+
+func (c *Reconcile) minAge() time.Duration {
+	if c.MinAge <= 0 {
+		return DefaultOrphanAge
+	}
+	return c.MinAge
+}
+
+// Orphan is a process found by a reconciliation pass.
+type Orphan struct {
+	Backend   string    `json:"backend,omitempty"`
+	Name      string    `json:"name"`
+	Addr      string    `json:"addr,omitempty"`
+	StartedAt time.Time `json:"started_at,omitempty"`
+	// Action is what happened to the process: reported,
+	// killed or adopted.
+	Action string `json:"action"`
+	// Remote is the path of the remote that adopted the
+	// process, if any.
+	Remote string `json:"remote,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+type reconcileReport struct {
+	Time    time.Time `json:"time"`
+	Orphans []Orphan  `json:"orphans"`
+	Errors  []string  `json:"errors,omitempty"`
+}
+
+// track records that rp is known, as it belongs to a remote.
+func (s *Srv) track(rp *RemoteProcess) {
+	if s == nil {
+		return
+	}
+	s.procmu.Lock()
+	defer s.procmu.Unlock()
+	if s.procs == nil {
+		s.procs = make(map[string]bool)
+	}
+	s.procs[rp.Name] = true
+}
+
+func (s *Srv) untrack(rp *RemoteProcess) {
+	if s == nil {
+		return
+	}
+	s.procmu.Lock()
+	defer s.procmu.Unlock()
+	delete(s.procs, rp.Name)
+}
+
+// known returns the names of the processes owned by the remotes
+// and by the warm pool.
+func (s *Srv) known() map[string]bool {
+	s.procmu.Lock()
+	known := make(map[string]bool, len(s.procs))
+	for k := range s.procs {
+		known[k] = true
+	}
+	s.procmu.Unlock()
+	if s.Warm != nil {
+		for _, v := range s.Warm.processes() {
+			known[v] = true
+		}
+	}
+	return known
+}
+
+// reconcile runs a reconciliation pass, storing its report.
+func (s *Srv) reconcile(ctx context.Context) {
+	// Reconcilers return only the processes of this instance.
+	ctx = WithMetadata(ctx, Metadata{Instance: s.Instance})
+	known := s.known()
+	report := reconcileReport{Time: time.Now(), Orphans: []Orphan{}}
+	for backend, sp := range s.spawners() {
+		rec, ok := sp.(Reconciler)
+		if !ok {
+			continue
+		}
+		running, err := rec.Running(ctx)
+		if err != nil {
+			s.log().Error("unable to list running processes", "backend", backend, "error", err)
+			report.Errors = append(report.Errors, err.Error())
+			continue
+		}
+		for _, rp := range running {
+			if known[rp.Name] {
+				continue
+			}
+			if !rp.StartedAt.IsZero() && time.Since(rp.StartedAt) < s.Reconcile.minAge() {
+				continue
+			}
+			o := s.orphan(ctx, backend, sp, rp)
+			orphansFound.Inc(backendName(sp), o.Action)
+			s.log().Info("orphan found", "backend", backend, "name", o.Name, "action", o.Action, "error", o.Error)
+			s.notify(Event{
+				Type:      EventRemoteOrphan,
+				Namespace: rp.Namespace,
+				Remote:    o.Remote,
+				Addr:      o.Addr,
+				Error:     o.Error,
+			}, nil)
+			report.Orphans = append(report.Orphans, o)
+		}
+	}
+
+	b, err := json.MarshalIndent(report, "", "\t")
+	if err != nil {
+		s.log().Error("unable to encode reconciliation report", "error", err)
+		return
+	}
+	s.procmu.Lock()
+	s.reconciled = append(b, '\n')
+	s.procmu.Unlock()
+}
+
+// orphan applies the orphan policy to rp. Processes whose age is
+// not known are only reported.
+func (s *Srv) orphan(ctx context.Context, backend string, sp Spawner, rp *RemoteProcess) Orphan {
+	o := Orphan{
+		Backend:   backend,
+		Name:      rp.Name,
+		Addr:      rp.Addr,
+		StartedAt: rp.StartedAt,
+		Action:    "reported",
+	}
+	policy := s.Reconcile.policy()
+	if rp.StartedAt.IsZero() {
+		policy = OrphanReport
+	}
+	var err error
+	switch policy {
+	case OrphanKill:
+		ctx, cancel := context.WithTimeout(ctx, time.Duration(s.spawnPolicy(SpawnPolicy{}).KillTimeout))
+		defer cancel()
+		if err = killProcess(ctx, sp, rp.SpawnedReader()); err == nil {
+			o.Action = "killed"
+		}
+	case OrphanAdopt:
+		var r *Remote
+		if r, err = s.adopt(backend, rp); err == nil {
+			o.Action = "adopted"
+			o.Remote = path.Join("/", r.ns.Name, r.Name)
+		}
+	}
+	if err != nil {
+		o.Error = err.Error()
+	}
+	return o
+}
+
+// adopt restores rp as a new remote of its namespace.
+func (s *Srv) adopt(backend string, rp *RemoteProcess) (*Remote, error) {
+	if rp.Addr == "" {
+		return nil, errors.New("adopt: process address is unknown")
+	}
+	rp.ID = -1
+	r, err := s.restoreRemote(backend, rp)
+	if err != nil {
+		return nil, fmt.Errorf("adopt: %w", err)
+	}
+	return r, nil
+}
+
+// reconciliation returns the report of the last reconciliation
+// pass.
+func (s *Srv) reconciliation() []byte {
+	s.procmu.Lock()
+	defer s.procmu.Unlock()
+	return s.reconciled
+}
+
+// reconcileEvery runs a reconciliation pass every interval until
+// stop is closed.
+func (s *Srv) reconcileEvery(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+		s.reconcile(context.Background())
+	}
+}
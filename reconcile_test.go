@@ -0,0 +1,68 @@
+// SPDX-FileCopyrightText: 2020 jecoz
+//
+// SPDX-License-Identifier: BSD-3-Clause
+
+package flexi
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"sort"
+	"testing"
+	"time"
+)
+
+type runningSpawner struct {
+	running []*RemoteProcess
+	killed  []string
+}
+
+func (s *runningSpawner) Spawn(context.Context, io.Reader, int) (*RemoteProcess, error) {
+	return nil, io.EOF
+}
+
+func (s *runningSpawner) Kill(_ context.Context, r io.Reader) error {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	s.killed = append(s.killed, string(b))
+	return nil
+}
+
+func (s *runningSpawner) Ls() ([]*RemoteProcess, error) { return nil, nil }
+
+func (s *runningSpawner) Running(context.Context) ([]*RemoteProcess, error) {
+	return s.running, nil
+}
+
+func TestReconcile(t *testing.T) {
+	old := time.Now().Add(-time.Hour)
+	sp := &runningSpawner{running: []*RemoteProcess{
+		{ID: -1, Name: "known", StartedAt: old, Spawned: []byte("known")},
+		{ID: -1, Name: "young", StartedAt: time.Now(), Spawned: []byte("young")},
+		{ID: -1, Name: "ageless", Spawned: []byte("ageless")},
+		{ID: -1, Name: "orphan", StartedAt: old, Spawned: []byte("orphan")},
+	}}
+	s := &Srv{S: sp, Reconcile: &Reconcile{Policy: OrphanKill}}
+	s.track(&RemoteProcess{Name: "known"})
+	s.reconcile(context.Background())
+
+	if len(sp.killed) != 1 || sp.killed[0] != "orphan" {
+		t.Fatalf("killed %v, want [orphan]", sp.killed)
+	}
+	var report reconcileReport
+	if err := json.Unmarshal(s.reconciliation(), &report); err != nil {
+		t.Fatal(err)
+	}
+	actions := []string{}
+	for _, v := range report.Orphans {
+		actions = append(actions, v.Name+" "+v.Action)
+	}
+	sort.Strings(actions)
+	if want := []string{"ageless reported", "orphan killed"}; len(actions) != 2 || actions[0] != want[0] || actions[1] != want[1] {
+		t.Fatalf("have %v, want %v", actions, want)
+	}
+}
@@ -6,36 +6,141 @@ package flexi
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
+	"sync"
 	"time"
 
 	"github.com/jecoz/flexi/file"
 	"github.com/jecoz/flexi/fs"
+	"github.com/jecoz/flexi/logger"
+	"github.com/jecoz/flexi/trace"
 )
 
 type Remote struct {
 	*file.Dir
 	S    Spawner
 	Name string
+	// User is the 9p user that created the remote.
+	User string
 	Done func()
 
 	mtpt string
+	id   int
+	srv  *Srv
+	ns   *namespace
+	log  logger.Logger
+
+	// policy is set before spawning.
+	policy SpawnPolicy
+
+	mu   sync.Mutex
 	proc *RemoteProcess
+	// spawnID identifies the spawn operation of proc in the
+	// logs. Restored remotes have none.
+	spawnID string
+	path    string
+	notify  []NotifyTarget
+	dead    bool
+	probing bool
+}
+
+// process returns the remote process of r, if it was spawned.
+func (r *Remote) process() *RemoteProcess {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.proc
+}
+
+// event returns an event of type typ about r.
+func (r *Remote) event(typ string, err error) Event {
+	e := Event{Type: typ, Remote: r.Name, User: r.User}
+	if r.ns != nil {
+		e.Namespace = r.ns.Name
+	}
+	if rp := r.process(); rp != nil {
+		e.Addr = rp.Addr
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	return e
+}
+
+// targets returns the notification targets requested in the
+// spawn payload of r.
+func (r *Remote) targets() []NotifyTarget {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.notify
+}
+
+// expireAfter removes r from its namespace once ttl is over.
+func (r *Remote) expireAfter(ttl time.Duration) {
+	time.AfterFunc(ttl, func() {
+		if f, err := r.ns.dir.Find(r.Name); err != nil || f != fs.File(r) {
+			// Removed already.
+			return
+		}
+		if err := r.srv.FS.Remove(path.Join("/", r.ns.Name, r.Name)); err != nil {
+			r.log.Error("unable to remove expired remote", "error", err)
+			return
+		}
+		r.log.Info("remote expired", "ttl", ttl)
+		r.srv.notify(r.event(EventRemoteExpired, nil), r.targets())
+	})
+}
+
+// mountpoint returns the path where the remote process is, or
+// is going to be, mounted.
+func (r *Remote) mountpoint() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.path
+}
+
+func (r *Remote) setMountpoint(path string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.path = path
+}
+
+// spawnLog returns the logger of r, carrying the id of the spawn
+// operation of its remote process, if known.
+func (r *Remote) spawnLog() logger.Logger {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.spawnID == "" {
+		return r.log
+	}
+	return r.log.With("spawn", r.spawnID)
 }
 
+// Removable returns true: clients remove remotes to kill their
+// remote process.
+func (r *Remote) Removable() bool { return true }
+
 func (r *Remote) Close() error {
-	if r.proc != nil {
-		mtpt := filepath.Join(r.mtpt, r.Name)
+	if rp := r.process(); rp != nil {
+		mtpt := r.mountpoint()
 		if err := Umount(mtpt); err != nil {
-			return fmt.Errorf("unable to umount %v: %w", mtpt, err)
+			return publicError(WithCode(CodeMountFailed, fmt.Errorf("unable to umount %v: %w", mtpt, err)))
 		}
-		if err := r.S.Kill(context.Background(), r.proc.SpawnedReader()); err != nil {
-			return err
+		log := r.spawnLog()
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(r.policy.KillTimeout))
+		defer cancel()
+		ctx = logger.NewContext(ctx, log)
+		if err := killProcess(ctx, r.S, rp.SpawnedReader()); err != nil {
+			return publicError(err)
 		}
+		log.Info("remote process killed", "name", rp.Name)
+		r.srv.untrack(rp)
 	}
 	r.Dir = file.NewDirFiles("")
 	if r.Done != nil {
@@ -48,6 +153,30 @@ func Mount(addr, mtpt string) error {
 	return mount(addr, mtpt)
 }
 
+// mount9p works like Mount, tracing the operation. The mount
+// is aborted when ctx is done.
+func mount9p(ctx context.Context, addr, mtpt string) error {
+	ctx, span := trace.Start(ctx, "flexi.mount", "addr", addr, "path", mtpt)
+	defer span.Finish()
+	err := mountContext(ctx, addr, mtpt)
+	span.SetError(err)
+	return err
+}
+
+// writeTraceparent stores sc in the trace file of the remote
+// process mounted at path.
+func writeTraceparent(path string, sc trace.SpanContext) error {
+	f, err := os.Create(filepath.Join(path, "trace"))
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(f, sc.Traceparent()+"\n"); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
 func Umount(path string) error {
 	if err := umount(path); err != nil {
 		return err
@@ -55,46 +184,240 @@ func Umount(path string) error {
 	return os.RemoveAll(path)
 }
 
+// SpawnTimeout is the default maximum amount of time a spawn
+// attempt is allowed to take. The same amount of time is given
+// by default to the mount that follows a successful spawn.
+const SpawnTimeout = 2 * time.Minute
+
+// spawn spawns the remote process described by req, going
+// through the spawn queue if the remote belongs to a server
+// that has one.
+func (r *Remote) spawn(ctx context.Context, h *ProcessHelper, req *spawnRequest, id int) (*RemoteProcess, error) {
+	spawn := func(ctx context.Context) (*RemoteProcess, error) {
+		ctx, cancel := context.WithTimeout(ctx, time.Duration(r.policy.SpawnTimeout))
+		defer cancel()
+		ctx = WithSpawnPolicy(ctx, r.policy)
+		ctx, span := trace.Start(ctx, "flexi.spawner.spawn", "backend", backendName(r.S))
+		defer span.Finish()
+		rp, err := spawnProcess(ctx, r.S, req.PayloadReader(), id)
+		span.SetError(err)
+		return rp, err
+	}
+	if r.srv == nil || r.srv.Queue == nil {
+		return spawn(ctx)
+	}
+
+	ctx, span := trace.Start(ctx, "flexi.queue", "priority", req.Priority)
+	defer span.Finish()
+
+	var rp *RemoteProcess
+	report := func(pos, attempt int, err error, delay time.Duration) {
+		if err != nil {
+			h.Progress(1, "spawn attempt %d failed: %v, retrying in %v", attempt, err, delay)
+			return
+		}
+		h.Progress(1, "spawn queued at position %d", pos)
+	}
+	err := r.srv.Queue.Do(ctx, req.Priority, report, func(ctx context.Context) error {
+		// When the queue is in place the spawn rate is
+		// enforced here, so that exceeding it results
+		// in a retry instead of a rejection.
+		if err := r.ns.checkSpawn(); err != nil {
+			return err
+		}
+		var err error
+		rp, err = spawn(ctx)
+		return err
+	})
+	return rp, err
+}
+
+// takeWarm returns a pre-spawned and mounted remote process
+// matching req, if the server has a warm pool. Taking a process
+// counts as a spawn for the spawn rate.
+func (r *Remote) takeWarm(req *spawnRequest) (*RemoteProcess, string, bool) {
+	if r.srv == nil || r.srv.Warm == nil || r.ns != r.srv.root {
+		// Pooled processes are spawned for
+		// the root namespace only.
+		return nil, "", false
+	}
+	if len(req.Tags) > 0 {
+		// Pooled processes are spawned before the
+		// request, without its tags.
+		return nil, "", false
+	}
+	if r.srv.Queue == nil {
+		// The spawn rate was checked when the
+		// payload was written.
+		return r.srv.Warm.Take(req.Payload)
+	}
+	if err := r.ns.checkSpawn(); err != nil {
+		// The queue waits for the rate to allow
+		// the spawn.
+		return nil, "", false
+	}
+	rp, path, ok := r.srv.Warm.Take(req.Payload)
+	if !ok {
+		r.ns.uncheckSpawn()
+	}
+	return rp, path, ok
+}
+
+// keepWarm assigns the warm process rp to r, storing it again
+// so that it is restored instead of being killed.
+func (r *Remote) keepWarm(rp *RemoteProcess, id int) error {
+	rp.ID = id
+	rp.Warm = false
+	s, ok := r.S.(Storer)
+	if !ok {
+		return nil
+	}
+	return s.Store(rp)
+}
+
+// newSpawnID returns a random identifier used to correlate the
+// log lines produced by a spawn operation.
+func newSpawnID() string {
+	b := make([]byte, 6)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
 func (r *Remote) mirrorRemoteProcess(ctx context.Context, path string, i *Stdio, id int) {
-	ctx, cancel := context.WithTimeout(ctx, 2*time.Minute)
-	defer cancel()
+	req, reqErr := parseSpawnRequest(i.In)
+	if reqErr == nil {
+		ctx = trace.ContextWithRemote(ctx, req.Trace)
+	}
+	ctx, span := trace.Start(ctx, "flexi.spawn", "remote", r.Name, "user", r.User)
+	defer span.Finish()
+
+	spawnID := newSpawnID()
+	log := r.log.With("spawn", spawnID, "trace", span.TraceID)
+	ctx = logger.NewContext(ctx, log)
 
 	// Prepare output encoding helpers. If this is the behaviour
 	// of every flexi process, we could add one more helper layer.
 
 	h := NewProcessHelper(i, 6)
 	defer h.Done()
-	herr := func(format string, args ...interface{}) {
-		h.Errf(format, args...)
+	// herr records the failure with code, or with the code of
+	// the error it wraps if code is empty.
+	herr := func(code Code, format string, args ...interface{}) {
+		err := fmt.Errorf(format, args...)
+		if code != "" {
+			err = WithCode(code, err)
+		}
+		log.Error("spawn failed", "error", err, "code", CodeOf(err))
+		span.SetError(err)
+		h.Err(err)
+		r.srv.notify(r.event(EventSpawnFailed, err), r.targets())
 	}
 
 	h.Progress(1, "spawning remote process")
-	rp, err := r.S.Spawn(ctx, i.In, id)
-	if err != nil {
-		herr("spawn remote process: %w", err)
+	if reqErr != nil {
+		herr(CodeInvalidInput, "spawn remote process: %w", reqErr)
+		return
+	}
+	meta := Metadata{Remote: r.Name, User: r.User, Tags: req.Tags}
+	if r.ns != nil {
+		ctx = WithNamespace(ctx, r.ns.Name)
+		meta.Namespace = r.ns.Name
+	}
+	if r.srv != nil {
+		meta.Instance = r.srv.Instance
+		if r.srv.Templates != nil {
+			meta.Template = templateName(req.Payload)
+		}
+		if req.Payload, reqErr = r.srv.resolvePayload(r.ns, req.Payload); reqErr != nil {
+			herr(CodeInvalidInput, "spawn remote process: %w", reqErr)
+			return
+		}
+	}
+	ctx = WithMetadata(ctx, meta)
+	if err := validate(r.S, req.Payload); err != nil {
+		herr(CodeInvalidInput, "invalid spawn payload: %w", err)
+		return
+	}
+	if len(req.Notify) > 0 {
+		if r.srv == nil || r.srv.Notifier == nil {
+			herr(CodeInvalidInput, "spawn remote process: notifications are not enabled")
+			return
+		}
+		targets, err := r.srv.Notifier.Resolve(req.Notify)
+		if err != nil {
+			herr(CodeInvalidInput, "spawn remote process: %w", err)
+			return
+		}
+		r.mu.Lock()
+		r.notify = targets
+		r.mu.Unlock()
+	}
+	if req.TTL > 0 && r.srv == nil {
+		herr(CodeInvalidInput, "spawn remote process: ttl is not supported")
 		return
 	}
+	r.policy = r.srv.spawnPolicy(req.Policy)
+	var err error
+	rp, warmpath, warm := r.takeWarm(req)
+	span.SetAttr("warm", warm)
+	if !warm {
+		if rp, err = r.spawn(ctx, h, req, id); err != nil {
+			herr("", "spawn remote process: %w", err)
+			return
+		}
+	}
 	h.Progress(2, "remote process spawned @ %v", rp.Addr)
+	log.Info("remote process spawned", "addr", rp.Addr, "name", rp.Name, "warm", warm)
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(r.policy.MountTimeout))
+	defer cancel()
 
 	// From now on we also need to remove the spawned
 	// process in case of error to avoid resource leaks.
 	oldherr := herr
-	herr = func(format string, args ...interface{}) {
-		r.S.Kill(ctx, rp.SpawnedReader())
-		oldherr(format, args...)
+	herr = func(code Code, format string, args ...interface{}) {
+		// ctx might be expired already.
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(r.policy.KillTimeout))
+		defer cancel()
+		killProcess(ctx, r.S, rp.SpawnedReader())
+		oldherr(code, format, args...)
 	}
 
-	if err := Mount(rp.Addr, path); err != nil {
-		herr("mount remote process: %w", err)
-		return
+	if warm {
+		// Warm processes are mounted already.
+		path = warmpath
+		r.setMountpoint(path)
+	} else {
+		progress := func(format string, args ...interface{}) {
+			h.Progress(2, format, args...)
+		}
+		if err := mountReady(ctx, rp.Addr, path, r.policy, progress); err != nil {
+			herr("", "%w", err)
+			return
+		}
 	}
 	h.Progress(3, "remote process mounted @ %v", path)
+	log.Debug("remote process mounted", "path", path)
 
 	oldherr = herr
-	herr = func(format string, args ...interface{}) {
+	herr = func(code Code, format string, args ...interface{}) {
 		exec.CommandContext(ctx, "umount", path).Run()
 		os.RemoveAll(path)
-		oldherr(format, args...)
+		oldherr(code, format, args...)
+	}
+	if warm {
+		if err := r.keepWarm(rp, id); err != nil {
+			herr("", "store remote process: %w", err)
+			return
+		}
+	}
+	if warm {
+		// The pool checked the files it requires, which
+		// might not be the ones requested.
+		if err := checkFiles(path, r.policy.Probe.Files); err != nil {
+			herr(CodeMountFailed, "probe remote process: %w", err)
+			return
+		}
 	}
 
 	h.Progress(4, "storing spawn information at %v", path)
@@ -104,17 +427,32 @@ func (r *Remote) mirrorRemoteProcess(ctx context.Context, path string, i *Stdio,
 	// remote namespace w/o leaking goroutines nor locking.
 	spawned, err := os.Create(filepath.Join(path, "spawned"))
 	if err != nil {
-		herr("create back file: %w", err)
+		herr(CodeMountFailed, "create back file: %w", err)
 		return
 	}
 	defer spawned.Close()
 
 	if _, err := io.Copy(spawned, rp.SpawnedReader()); err != nil {
-		herr("copying spawn information: %w", err)
+		herr(CodeMountFailed, "copying spawn information: %w", err)
 		return
 	}
+
+	// Let the remote process know about the trace, so that
+	// its executions are part of it.
+	if err := writeTraceparent(path, span.SpanContext); err != nil {
+		log.Error("unable to store trace context", "error", err)
+	}
+	r.mu.Lock()
 	r.proc = rp
+	r.spawnID = spawnID
+	r.mu.Unlock()
+	r.srv.track(rp)
 	h.Progress(5, "remote process info encoded & saved")
+	log.Info("remote process ready", "path", path)
+	r.srv.notify(r.event(EventSpawnSucceeded, nil), r.targets())
+	if req.TTL > 0 {
+		r.expireAfter(req.TTL)
+	}
 }
 
 func RestoreRemote(mtpt string, name string, s Spawner, rp *RemoteProcess) (*Remote, error) {
@@ -133,11 +471,15 @@ func RestoreRemote(mtpt string, name string, s Spawner, rp *RemoteProcess) (*Rem
 
 	mirror := file.NewDirLs("mirror", file.LsDisk(path))
 	return &Remote{
-		mtpt: mtpt,
-		S:    s,
-		Name: name,
-		Dir:  file.NewDirFiles(name, mirror),
-		proc: rp,
+		mtpt:   mtpt,
+		S:      s,
+		Name:   name,
+		Dir:    file.NewDirFiles(name, mirror),
+		id:     rp.ID,
+		proc:   rp,
+		policy: DefaultSpawnPolicy,
+		path:   path,
+		log:    logger.Default.With("remote", name),
 	}, nil
 }
 
@@ -152,10 +494,26 @@ func NewRemote(mtpt string, name string, s Spawner, id int) (*Remote, error) {
 	}
 	os.RemoveAll(path)
 
-	r := &Remote{mtpt: mtpt, S: s, Name: name}
+	r := &Remote{
+		mtpt:   mtpt,
+		S:      s,
+		Name:   name,
+		id:     id,
+		path:   path,
+		policy: DefaultSpawnPolicy,
+		log:    logger.Default.With("remote", name),
+	}
 	errfile := file.NewMulti("err")
 	statefile := file.NewMulti("state")
-	spawn := file.NewPlumber("spawn", func(p *file.Plumber) bool {
+	check := func(*file.Plumber) error {
+		if r.srv == nil || r.srv.Queue != nil {
+			// Queued spawns check the spawn rate
+			// right before being executed.
+			return nil
+		}
+		return publicError(r.ns.checkSpawn())
+	}
+	spawn := file.NewPlumberCheck("spawn", check, func(p *file.Plumber) bool {
 		go func() {
 			defer errfile.Close()
 			defer statefile.Close()
@@ -169,7 +527,9 @@ func NewRemote(mtpt string, name string, s Spawner, id int) (*Remote, error) {
 		return true
 	})
 	static := []fs.File{spawn, errfile, statefile}
-	mirror := file.NewDirLs("mirror", file.LsDisk(path))
+	mirror := file.NewDirLs("mirror", func() []fs.File {
+		return file.LsDisk(r.mountpoint())()
+	})
 	r.Dir = file.NewDirFiles(name, append(static, mirror)...)
 	return r, nil
 }
@@ -0,0 +1,111 @@
+// SPDX-FileCopyrightText: 2020 jecoz
+//
+// SPDX-License-Identifier: BSD-3-Clause
+
+package flexi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"path"
+	"time"
+)
+
+// restoreReport describes what happened to the remote processes
+// stored by the Spawners when the server started. It is listed
+// in the restore file.
+type restoreReport struct {
+	Time     time.Time        `json:"time"`
+	Restored []restoreEntry   `json:"restored"`
+	Failed   []restoreEntry   `json:"failed"`
+	Skipped  []restoreSkipped `json:"skipped"`
+	// Killed lists the warm processes that were not assigned
+	// to a remote.
+	Killed []restoreEntry `json:"killed"`
+	// Errors lists the Spawners that could not list their
+	// remote processes at all.
+	Errors []restoreEntry `json:"errors,omitempty"`
+}
+
+type restoreEntry struct {
+	Backend   string `json:"backend,omitempty"`
+	Name      string `json:"name,omitempty"`
+	Addr      string `json:"addr,omitempty"`
+	Namespace string `json:"namespace,omitempty"`
+	// Remote is the path of the restored remote.
+	Remote string `json:"remote,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+type restoreSkipped struct {
+	Backend string `json:"backend,omitempty"`
+	Skipped
+}
+
+// restore retrieves the remote processes that are still running
+// and mounts them back. A failing Spawner or remote process does
+// not prevent the others from being restored.
+func (s *Srv) restore() {
+	report := restoreReport{
+		Time:     time.Now(),
+		Restored: []restoreEntry{},
+		Failed:   []restoreEntry{},
+		Skipped:  []restoreSkipped{},
+		Killed:   []restoreEntry{},
+	}
+	log := s.log()
+	for backend, sp := range s.spawners() {
+		rps, err := sp.Ls()
+		var serr *SkippedError
+		if errors.As(err, &serr) {
+			for _, v := range serr.Skipped {
+				log.Error("backup skipped", "backend", backend, "name", v.Name, "reason", v.Reason, "quarantine", v.Quarantine)
+				report.Skipped = append(report.Skipped, restoreSkipped{Backend: backend, Skipped: v})
+			}
+		} else if err != nil {
+			log.Error("unable to list remote processes", "backend", backend, "error", err)
+			report.Errors = append(report.Errors, restoreEntry{Backend: backend, Error: err.Error()})
+			continue
+		}
+		for _, v := range rps {
+			e := restoreEntry{Backend: backend, Name: v.Name, Addr: v.Addr, Namespace: v.Namespace}
+			if v.Warm {
+				if err := killWarm(sp, v); err != nil {
+					log.Error("unable to kill warm process", "backend", backend, "name", v.Name, "error", err)
+					e.Error = err.Error()
+				}
+				report.Killed = append(report.Killed, e)
+				continue
+			}
+			r, err := s.restoreRemote(backend, v)
+			if err != nil {
+				log.Error("restore failed", "backend", backend, "name", v.Name, "addr", v.Addr, "namespace", v.Namespace, "error", err)
+				e.Error = err.Error()
+				report.Failed = append(report.Failed, e)
+				continue
+			}
+			e.Remote = path.Join("/", r.ns.Name, r.Name)
+			report.Restored = append(report.Restored, e)
+		}
+	}
+	log.Info("remotes restored", "count", len(report.Restored), "failed", len(report.Failed), "skipped", len(report.Skipped), "killed", len(report.Killed), "mtpt", s.Mtpt)
+
+	b, err := json.MarshalIndent(report, "", "\t")
+	if err != nil {
+		log.Error("unable to encode restore report", "error", err)
+		return
+	}
+	s.restored = append(b, '\n')
+}
+
+// killWarm kills rp, a warm process left by a previous run.
+func killWarm(s Spawner, rp *RemoteProcess) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(DefaultSpawnPolicy.KillTimeout))
+	defer cancel()
+	return killProcess(ctx, s, rp.SpawnedReader())
+}
+
+// restoration returns the report of the restore performed when
+// the server started.
+func (s *Srv) restoration() []byte { return s.restored }
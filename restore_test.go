@@ -0,0 +1,56 @@
+// SPDX-FileCopyrightText: 2020 jecoz
+//
+// SPDX-License-Identifier: BSD-3-Clause
+
+package flexi
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+type lsSpawner struct {
+	runningSpawner
+	rps []*RemoteProcess
+	err error
+}
+
+func (s *lsSpawner) Ls() ([]*RemoteProcess, error) { return s.rps, s.err }
+
+func TestRestore_Partial(t *testing.T) {
+	skipped := &SkippedError{Skipped: []Skipped{{Name: "a1", Reason: "task stopped"}}}
+	s := &Srv{
+		S:        &lsSpawner{err: errors.New("backend down")},
+		Spawners: map[string]Spawner{"b": &lsSpawner{err: skipped}},
+	}
+	s.restore()
+
+	var report restoreReport
+	if err := json.Unmarshal(s.restoration(), &report); err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Errors) != 1 || report.Errors[0].Error != "backend down" {
+		t.Fatalf("unexpected errors: %+v", report.Errors)
+	}
+	if len(report.Skipped) != 1 || report.Skipped[0].Backend != "b" || report.Skipped[0].Name != "a1" {
+		t.Fatalf("unexpected skipped entries: %+v", report.Skipped)
+	}
+}
+
+func TestRestore_Warm(t *testing.T) {
+	sp := &lsSpawner{rps: []*RemoteProcess{{ID: -1, Name: "w1", Warm: true, Spawned: []byte("w1")}}}
+	s := &Srv{S: sp}
+	s.restore()
+
+	var report restoreReport
+	if err := json.Unmarshal(s.restoration(), &report); err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Killed) != 1 || len(report.Restored) != 0 {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+	if len(sp.killed) != 1 || sp.killed[0] != "w1" {
+		t.Fatalf("unexpected killed processes: %v", sp.killed)
+	}
+}
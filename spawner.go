@@ -7,13 +7,25 @@ package flexi
 import (
 	"bytes"
 	"context"
+	"fmt"
 	"io"
+	"time"
 )
 
 type RemoteProcess struct {
 	ID   int    `json:"id"`
 	Addr string `json:"addr"`
 	Name string `json:"name"`
+	// Namespace is the namespace the remote belongs to, as
+	// returned by NamespaceFromContext. Empty means the root.
+	Namespace string `json:"namespace,omitempty"`
+	// StartedAt is when the process was started on the
+	// backend, if known.
+	StartedAt time.Time `json:"started_at,omitempty"`
+	// Warm is set on the processes spawned for a warm pool,
+	// see Metadata.Pool. The ones returned by Ls are killed
+	// instead of being restored, as no remote uses them.
+	Warm bool `json:"warm,omitempty"`
 
 	// Spawned contains the payload that needs to be preserved
 	// in order to undo the Spawn operation. flexi does not
@@ -32,5 +44,64 @@ func (rp *RemoteProcess) SpawnedReader() io.Reader {
 type Spawner interface {
 	Spawn(context.Context, io.Reader, int) (*RemoteProcess, error)
 	Kill(context.Context, io.Reader) error
+	// Ls returns the remote processes that should be restored.
+	// If some of the stored ones cannot be, it returns the
+	// others along with a *SkippedError.
 	Ls() ([]*RemoteProcess, error)
 }
+
+// Skipped is an entry that Spawner.Ls did not return, because
+// it is corrupt or its process is no longer running.
+type Skipped struct {
+	// Name identifies the entry, such as its file name.
+	Name   string `json:"name"`
+	Reason string `json:"reason"`
+	// Quarantine is where the entry was moved to, if it was.
+	Quarantine string `json:"quarantine,omitempty"`
+}
+
+// SkippedError is returned by Spawner.Ls along with the remote
+// processes it could list.
+type SkippedError struct {
+	Skipped []Skipped
+}
+
+func (e *SkippedError) Error() string {
+	return fmt.Sprintf("%d entries skipped", len(e.Skipped))
+}
+
+// Validator is optionally implemented by Spawners that are able
+// to check a spawn payload without spawning anything. flexi
+// validates payloads before spawning, so that users get precise
+// errors immediately.
+type Validator interface {
+	Validate(io.Reader) error
+}
+
+// Reconciler is optionally implemented by Spawners that are able
+// to list the processes running on their backend, including the
+// ones flexi lost track of, for example because it stopped before
+// their backup was stored. The context carries the Metadata of the
+// server: only the processes spawned with the same Instance should
+// be returned, as other servers might share the backend. The
+// processes returned have a negative ID, as it is not known.
+type Reconciler interface {
+	Running(context.Context) ([]*RemoteProcess, error)
+}
+
+// Storer is optionally implemented by Spawners that store the
+// remote processes they spawn, to return them from Ls. Store
+// replaces the stored copy of rp. It is called when a warm
+// process is assigned to a remote.
+type Storer interface {
+	Store(*RemoteProcess) error
+}
+
+// validate checks payload with s, if s is a Validator.
+func validate(s Spawner, payload []byte) error {
+	v, ok := s.(Validator)
+	if !ok {
+		return nil
+	}
+	return v.Validate(bytes.NewReader(payload))
+}
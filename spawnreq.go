@@ -0,0 +1,118 @@
+// SPDX-FileCopyrightText: 2020 jecoz
+//
+// SPDX-License-Identifier: BSD-3-Clause
+
+package flexi
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/jecoz/flexi/trace"
+)
+
+// spawnRequest contains the flexi specific fields that might be
+// present in a spawn payload. They are removed from the payload
+// before handing it to the Spawner, which does not know about
+// them.
+type spawnRequest struct {
+	// Priority of the spawn within the spawn queue. Higher
+	// values are served first.
+	Priority int
+	// Trace, if valid, is the parent of the spawn trace. It is
+	// provided as a W3C traceparent string.
+	Trace trace.SpanContext
+	// Notify lists the names of the notification targets, or
+	// the webhook URLs allowed by the Notifier, that receive
+	// the events of the remote.
+	Notify []string
+	// TTL, if positive, is how long the remote lives once
+	// spawned. It is removed afterwards.
+	TTL time.Duration
+	// Tags are attached to the remote process by the
+	// Spawner, along with the flexi metadata.
+	Tags map[string]string
+	// Policy overrides the server spawn policy.
+	Policy SpawnPolicy
+	// Payload is what remains to be passed to the Spawner.
+	Payload []byte
+}
+
+func (r *spawnRequest) PayloadReader() io.Reader { return bytes.NewReader(r.Payload) }
+
+// flexiKeys lists the payload fields that are consumed by flexi.
+var flexiKeys = []string{"priority", "traceparent", "notify", "ttl", "tags", "spawn_policy"}
+
+func parseSpawnRequest(r io.Reader) (*spawnRequest, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("read spawn payload: %w", err)
+	}
+	req := &spawnRequest{Payload: b}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(b, &fields); err != nil {
+		// Not a json object, flexi has nothing to say about
+		// it. The Spawner will decide what to do with it.
+		return req, nil
+	}
+	if raw, ok := fields["priority"]; ok {
+		if err := json.Unmarshal(raw, &req.Priority); err != nil {
+			return nil, fmt.Errorf("decode priority: %w", err)
+		}
+	}
+	if raw, ok := fields["traceparent"]; ok {
+		var tp string
+		if err := json.Unmarshal(raw, &tp); err != nil {
+			return nil, fmt.Errorf("decode traceparent: %w", err)
+		}
+		if req.Trace, err = trace.ParseTraceparent(tp); err != nil {
+			return nil, err
+		}
+	}
+	if raw, ok := fields["notify"]; ok {
+		if err := json.Unmarshal(raw, &req.Notify); err != nil {
+			return nil, fmt.Errorf("decode notify: %w", err)
+		}
+	}
+	if raw, ok := fields["ttl"]; ok {
+		var ttl Duration
+		if err := json.Unmarshal(raw, &ttl); err != nil {
+			return nil, fmt.Errorf("decode ttl: %w", err)
+		}
+		req.TTL = time.Duration(ttl)
+	}
+	if raw, ok := fields["tags"]; ok {
+		if err := json.Unmarshal(raw, &req.Tags); err != nil {
+			return nil, fmt.Errorf("decode tags: %w", err)
+		}
+		if err := validTags(req.Tags); err != nil {
+			return nil, fmt.Errorf("decode tags: %w", err)
+		}
+	}
+	if raw, ok := fields["spawn_policy"]; ok {
+		dec := json.NewDecoder(bytes.NewReader(raw))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&req.Policy); err != nil {
+			return nil, fmt.Errorf("decode spawn_policy: %w", err)
+		}
+	}
+	stripped := false
+	for _, v := range flexiKeys {
+		if _, ok := fields[v]; ok {
+			delete(fields, v)
+			stripped = true
+		}
+	}
+	if !stripped {
+		return req, nil
+	}
+	if req.Payload, err = json.Marshal(fields); err != nil {
+		return nil, fmt.Errorf("encode spawn payload: %w", err)
+	}
+	return req, nil
+}
@@ -5,19 +5,20 @@
 package flexi
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"io"
-	"log"
 	"net"
 	"os"
 	"path/filepath"
 	"sort"
-	"strconv"
 	"sync"
+	"time"
 
 	"github.com/jecoz/flexi/file"
 	"github.com/jecoz/flexi/file/memfs"
 	"github.com/jecoz/flexi/fs"
+	"github.com/jecoz/flexi/logger"
 	"github.com/jecoz/flexi/styx"
 )
 
@@ -26,59 +27,137 @@ type Srv struct {
 	Ln   net.Listener
 	S    Spawner
 	FS   fs.FS
+	// Limits are enforced when remotes are created and
+	// spawned. The zero value does not limit anything.
+	Limits Limits
+	// Queue, if present, is used to order and retry
+	// spawn operations.
+	Queue *SpawnQueue
+	// Warm, if present, provides pre-spawned remote processes.
+	Warm *WarmPool
+	// Log is used to log server events. Defaults to
+	// logger.Default.
+	Log logger.Logger
+	// Files configures the files and directories created
+	// by clients.
+	Files styx.Files
+	// Spawners lists, by name, the Spawners that namespaces
+	// can use in place of S.
+	Spawners map[string]Spawner
+	// Namespaces are created when the server starts. More
+	// can be added at runtime using the ctl file or by
+	// creating directories. Limits apply to the remotes of
+	// every namespace, while the ones of a namespace apply to
+	// its remotes and children.
+	Namespaces []NamespaceSpec
+	// Templates, if present, are the named payloads spawn
+	// requests can refer to. They are listed in the templates
+	// directory.
+	Templates *Templates
+	// Jobs, if present, enables the jobs and pipelines
+	// directories.
+	Jobs *Jobs
+	// Notifier, if present, delivers the events of remotes
+	// and jobs.
+	Notifier *Notifier
+	// SpawnPolicy configures spawn timeouts and retries. Zero
+	// values are taken from DefaultSpawnPolicy.
+	SpawnPolicy SpawnPolicy
+	// Liveness is the interval between the checks of the
+	// remote processes, reported with remote.dead events when
+	// they do not answer. Zero disables the checks.
+	Liveness time.Duration
+	// Reconcile, if present, enables the reconciliation of the
+	// processes running on the backends with the known remotes,
+	// at startup and periodically. The last report is listed
+	// in the orphans file.
+	Reconcile *Reconcile
+	// Instance identifies the server in the metadata of the
+	// remote processes it spawns. Defaults to the host name.
+	Instance string
 
-	pool *idPool
+	root       *namespace
+	nsmu       sync.Mutex
+	namespaces map[string]*namespace
+
+	procmu     sync.Mutex
+	procs      map[string]bool
+	reconciled []byte
+	restored   []byte
+}
+
+func (s *Srv) log() logger.Logger {
+	if s.Log == nil {
+		return logger.Default
+	}
+	return s.Log
 }
 
 func (s *Srv) Serve() error {
-	return styx.Serve(s.Ln, s.FS)
-}
-
-func (s *Srv) addRemote(id int, f func(string, int) (*Remote, error)) (*Remote, error) {
-	if id < 0 {
-		id = s.pool.Get()
-	} else {
-		// Notify the pool that we have this id
-		// already and no other Get() call should
-		// return id till we Put it back to the pool.
-		if err := s.pool.Have(id); err != nil {
-			return nil, fmt.Errorf("add remote: invalid id requested: %w", err)
+	return styx.Serve(s.Ln, s.FS, styx.Options{Log: s.log(), Files: s.Files})
+}
+
+// NewRemote creates a new remote of the root namespace owned
+// by user. Returns an error wrapping ErrQuota if user is not
+// allowed to have more remotes.
+func (s *Srv) NewRemote(user string) (*Remote, error) {
+	return s.root.newRemote(user)
+}
+
+// RestoreRemote restores rp inside its namespace, which is
+// created using the server Spawner if it does not exist.
+func (s *Srv) RestoreRemote(rp *RemoteProcess) (*Remote, error) {
+	return s.restoreRemote("", rp)
+}
+
+func (s *Srv) restoreRemote(backend string, rp *RemoteProcess) (*Remote, error) {
+	ns := s.root
+	if rp.Namespace != "" {
+		var err error
+		if ns, err = s.ensureNamespace(rp.Namespace, backend); err != nil {
+			return nil, err
 		}
 	}
-	r, err := f(strconv.Itoa(id), id)
+	r, err := ns.restoreRemote(rp)
 	if err != nil {
-		s.pool.Put(id)
 		return nil, err
 	}
-	r.Done = func() {
-		s.pool.Put(id)
-	}
+	ns.dir.Append(r)
+	s.track(rp)
 	return r, nil
 }
 
-func (s *Srv) NewRemote() (*Remote, error) {
-	return s.addRemote(-1, func(name string, id int) (*Remote, error) {
-		return NewRemote(s.Mtpt, name, s.S, id)
-	})
+// spawners returns the distinct Spawners known by s, by name.
+// The server Spawner has no name.
+func (s *Srv) spawners() map[string]Spawner {
+	all := map[string]Spawner{"": s.S}
+	for k, v := range s.Spawners {
+		if v != s.S {
+			all[k] = v
+		}
+	}
+	return all
 }
 
-func (s *Srv) RestoreRemote(rp *RemoteProcess) (*Remote, error) {
-	return s.addRemote(rp.ID, func(name string, id int) (*Remote, error) {
-		return RestoreRemote(s.Mtpt, name, s.S, rp)
-	})
-}
+func (s *Srv) cleanupMtpt() error { return cleanupDir(s.Mtpt) }
 
-func (s *Srv) cleanupMtpt() error {
-	for i, v := range file.LsDisk(s.Mtpt)() {
+func cleanupDir(dir string) error {
+	for i, v := range file.LsDisk(dir)() {
 		info, err := v.Stat()
 		if err != nil {
 			return fmt.Errorf("clean-up mtpt (%d): %v", i, err)
 		}
-		path := filepath.Join(s.Mtpt, info.Name())
+		path := filepath.Join(dir, info.Name())
 
 		// We do not care if the operation is not successfull.
-		// It might also be that there is nothing to umount.
-		umount(path)
+		// It might also be that there is nothing to umount,
+		// as for namespace directories, which contain the
+		// mount points of their remotes.
+		if err := umount(path); err != nil && info.IsDir() {
+			if err := cleanupDir(path); err != nil {
+				return err
+			}
+		}
 		if err = os.RemoveAll(path); err != nil {
 			return fmt.Errorf("clean-up mtpt (%d): %v", i, err)
 		}
@@ -87,72 +166,110 @@ func (s *Srv) cleanupMtpt() error {
 }
 
 func ServeFlexi(ln net.Listener, mtpt string, s Spawner) error {
-	srv := &Srv{Mtpt: mtpt, Ln: ln, S: s, pool: new(idPool)}
+	srv := &Srv{Mtpt: mtpt, Ln: ln, S: s}
+	return srv.Run()
+}
+
+// Run prepares the flexi namespace at s.Mtpt, restores the
+// remotes that are still running and serves the namespace
+// on s.Ln.
+func (srv *Srv) Run() error {
+	var err error
+	if srv.root, err = srv.newNamespace(NamespaceSpec{Limits: srv.Limits}); err != nil {
+		return err
+	}
+	srv.namespaces = map[string]*namespace{"": srv.root}
+	if srv.Instance == "" {
+		srv.Instance, _ = os.Hostname()
+	}
+	if srv.Notifier != nil {
+		if err := srv.Notifier.Validate(); err != nil {
+			return err
+		}
+	}
+	if srv.Reconcile != nil {
+		if err := srv.Reconcile.Validate(); err != nil {
+			return err
+		}
+	}
+	mtpt := srv.Mtpt
+	ln := srv.Ln
+	s := srv.S
 
 	// Start from a clean state, otherwise we could encounter
 	// issues later on.
 	if err := srv.cleanupMtpt(); err != nil {
 		return err
 	}
+	for _, v := range srv.Namespaces {
+		if _, err := srv.addNamespace(v); err != nil {
+			return err
+		}
+	}
 
 	// Now retrieve remote processes that are still
 	// running and try mounting them back.
-
-	oldremotes, err := s.Ls()
-	if err != nil {
-		return err
-	}
-	remotes := make([]*Remote, 0, len(oldremotes))
-	for i, v := range oldremotes {
-		restored, err := srv.RestoreRemote(v)
-		if err != nil {
-			log.Printf("error * restore failed (%d): %v", i, err)
-			continue
-		}
-		remotes = append(remotes, restored)
+	srv.restore()
+	srv.root.dir.Append(file.NewSnapshot("restore", srv.restoration))
+	if srv.Liveness > 0 {
+		stop := make(chan struct{})
+		defer close(stop)
+		go srv.checkLiveness(srv.Liveness, stop)
 	}
-	log.Printf("*** %d remotes restored from %v", len(remotes), mtpt)
 
-	clone := file.WithRead("clone", func(p []byte) (int, error) {
-		// Users read the clone file to obtain
-		// a new remote process.
-		remote, err := srv.NewRemote()
-		if err != nil {
-			return 0, err
+	if srv.Warm != nil {
+		if err := srv.Warm.Start(mtpt, s, srv.Instance, srv.spawnPolicy(SpawnPolicy{}), srv.log().With("component", "warm")); err != nil {
+			return err
 		}
-
-		s := []byte(remote.Name + "\n")
-		if len(s) > len(p) {
-			remote.Done()
-			return 0, io.ErrShortBuffer
+		defer srv.Warm.Stop()
+		srv.root.dir.Append(file.NewSnapshot("warm", srv.Warm.Status))
+	}
+	if srv.Reconcile != nil {
+		// Restored and warm processes are known by now.
+		srv.reconcile(context.Background())
+		if srv.Reconcile.Interval > 0 {
+			stop := make(chan struct{})
+			defer close(stop)
+			go srv.reconcileEvery(srv.Reconcile.Interval, stop)
 		}
-
-		srv.FS.Create("", remote)
-		return copy(p, s), io.EOF
-	})
-	files := append(make([]fs.File, 0, len(remotes)+1), clone)
-	for _, v := range remotes {
-		files = append(files, v)
+		srv.root.dir.Append(file.NewSnapshot("orphans", srv.reconciliation))
+	}
+	if srv.Templates != nil {
+		srv.root.dir.Append(newTemplatesDir(srv.Templates))
+	}
+	if srv.Jobs != nil {
+		srv.root.dir.Append(srv.jobsDir("jobs", srv.jobRequests))
+		srv.root.dir.Append(srv.jobsDir("pipelines", srv.pipelineRequests))
 	}
-	root := file.NewDirFiles("", files...)
-	srv.FS = memfs.New(root)
+	srv.root.dir.Append(file.NewCtl("ctl", srv.execCtl))
+	srv.FS = memfs.New(srv.root.dir)
 
-	log.Printf("*** listening on %v", ln.Addr())
+	srv.log().Info("listening", "addr", ln.Addr())
 	return srv.Serve()
 }
 
 type idPool struct {
+	// dir is the path of the directory the identifiers
+	// name files of. It labels the pool size metric.
+	dir string
+
 	sync.Mutex
-	free []int
-	out  []int
+	free   []int
+	out    []int
+	closed bool
 }
 
+var errPoolClosed = errors.New("identifier pool is closed")
+
 // Get returns a unique integer. Subsequent Get calls will not
 // return the same integer unless it is returned to the pool
 // with Put.
-func (p *idPool) Get() int {
+func (p *idPool) Get() (int, error) {
 	p.Lock()
 	defer p.Unlock()
+	if p.closed {
+		return 0, errPoolClosed
+	}
 	if p.out == nil {
 		p.out = []int{}
 	}
@@ -169,7 +286,8 @@ func (p *idPool) Get() int {
 	p.free = p.free[1:]
 	p.out = append(p.out, id)
 	sort.Sort(sort.Reverse(sort.IntSlice(p.out)))
-	return id
+	idPoolSize.Set(float64(len(p.out)), p.dir)
+	return id, nil
 }
 
 // Put returns i to the pool, meaning that subsequent Get
@@ -192,6 +310,7 @@ func (p *idPool) Put(i int) {
 		return
 	}
 	p.out = append(p.out[:remove], p.out[remove+1:]...)
+	idPoolSize.Set(float64(len(p.out)), p.dir)
 
 	if p.free == nil {
 		p.free = []int{}
@@ -200,12 +319,37 @@ func (p *idPool) Put(i int) {
 	sort.Ints(p.free)
 }
 
+// Len returns the number of integers that are out.
+func (p *idPool) Len() int {
+	p.Lock()
+	defer p.Unlock()
+	return len(p.out)
+}
+
+// drain closes p and calls f if no integer is out, holding p
+// locked so that no Get or Have call happens meanwhile. Closed
+// pools do not give out integers anymore. Returns false if some
+// integer is out.
+func (p *idPool) drain(f func()) bool {
+	p.Lock()
+	defer p.Unlock()
+	if len(p.out) > 0 {
+		return false
+	}
+	p.closed = true
+	f()
+	return true
+}
+
 // Have works like Get without returning any integer.
 // Use it to let p know you have i, and no other should.
 // Returns an error if p knew already that i was out.
 func (p *idPool) Have(i int) error {
 	p.Lock()
 	defer p.Unlock()
+	if p.closed {
+		return errPoolClosed
+	}
 	if p.out == nil {
 		p.out = []int{}
 	}
@@ -216,5 +360,6 @@ func (p *idPool) Have(i int) error {
 	}
 	p.out = append(p.out, i)
 	sort.Sort(sort.Reverse(sort.IntSlice(p.out)))
+	idPoolSize.Set(float64(len(p.out)), p.dir)
 	return nil
 }
@@ -5,49 +5,199 @@
 package styx
 
 import (
-	"log"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sync"
+	"time"
 
 	"aqwari.net/net/styx"
 	"github.com/jecoz/flexi/file"
 	"github.com/jecoz/flexi/fs"
+	"github.com/jecoz/flexi/logger"
 )
 
+// LogHandler traces each 9p request at debug level.
 type LogHandler struct {
-	Log *log.Logger
+	Log logger.Logger
 }
 
 func (h *LogHandler) Serve9P(s *styx.Session) {
 	for s.Next() {
-		h.Log.Printf("%q %T %s", s.User, s.Request(), s.Request().Path())
+		t := s.Request()
+		h.Log.Debug("9p request", "user", s.User, "type", requestType(t), "path", t.Path())
 	}
 }
 
+// DefaultMaxSize is the size limit of the files created by
+// clients when Files.MaxSize is zero and no spill directory is set.
+const DefaultMaxSize = 1 << 20
+
+// DefaultSpillSize is the size after which created files are
+// moved to disk when Files.SpillSize is zero.
+const DefaultSpillSize = 1 << 20
+
+// Files configures the files created by 9p clients.
+type Files struct {
+	// MaxSize is the maximum size of a created file. Writes
+	// past it fail. Zero means DefaultMaxSize, or unlimited
+	// when SpillDir is set.
+	MaxSize int64
+	// SpillDir, if not empty, is the directory where created
+	// files are stored once they grow past SpillSize.
+	SpillDir  string
+	SpillSize int64
+}
+
+// newFile returns the file used to serve a Tcreate request.
+func (c Files) newFile(name string, mode os.FileMode) fs.File {
+	if mode.IsDir() {
+		d := file.NewDirFiles(name)
+		d.SetMode(mode)
+		return d
+	}
+	if c.SpillDir != "" {
+		threshold := c.SpillSize
+		if threshold <= 0 {
+			threshold = DefaultSpillSize
+		}
+		return file.NewSpill(name, mode, c.SpillDir, threshold, c.MaxSize)
+	}
+	max := c.MaxSize
+	if max == 0 {
+		max = DefaultMaxSize
+	}
+	return file.NewBucket(name, mode, max)
+}
+
 type FSHandler struct {
-	FS fs.FS
+	FS    fs.FS
+	Files Files
+
+	// created holds the files created by clients, which are
+	// the only ones they can chmod, touch and remove.
+	created sync.Map
+}
+
+func unsupported(op, path string) error {
+	return fmt.Errorf("%s %s: %w", op, path, fs.ErrNotSupported)
+}
+
+// writable reports whether clients are allowed to change the
+// contents of f, according to its mode.
+func writable(f fs.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&0222 != 0
+}
+
+func permissionDenied(op, path string) error {
+	return fmt.Errorf("%s %s: %w", op, path, os.ErrPermission)
+}
+
+// owned reports whether f was created by a client and can still
+// be written.
+func (h *FSHandler) owned(f fs.File) bool {
+	_, ok := h.created.Load(f)
+	return ok && writable(f)
+}
+
+func (h *FSHandler) utimes(f fs.File, p string, t time.Time) error {
+	tf, ok := f.(fs.Toucher)
+	if !ok {
+		return unsupported("utimes", p)
+	}
+	if !h.owned(f) {
+		return permissionDenied("utimes", p)
+	}
+	return tf.SetModTime(t)
+}
+
+func (h *FSHandler) chmod(f fs.File, p string, mode os.FileMode) error {
+	mf, ok := f.(fs.Moder)
+	if !ok {
+		return unsupported("chmod", p)
+	}
+	if !h.owned(f) {
+		return permissionDenied("chmod", p)
+	}
+	return mf.SetMode(mode)
+}
+
+func (h *FSHandler) remove(p string) error {
+	f, err := h.FS.Open(p)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if r, ok := f.(fs.Removable); !h.owned(f) && !(ok && r.Removable()) {
+		return permissionDenied("remove", p)
+	}
+	if err := h.FS.Remove(p); err != nil {
+		return err
+	}
+	h.created.Delete(f)
+	return nil
 }
 
-func (h *FSHandler) handleRequest(t styx.Request) {
+func (h *FSHandler) rename(msg styx.Trename) error {
+	rfs, ok := h.FS.(fs.RenameFS)
+	if !ok {
+		return unsupported("rename", msg.Path())
+	}
+	olddir, _ := path.Split(msg.OldPath)
+	newdir, name := path.Split(msg.NewPath)
+	if newdir != "" && path.Clean(newdir) != path.Clean(olddir) {
+		// Moving files across directories is not supported.
+		return unsupported("rename", msg.Path())
+	}
+	return rfs.Rename(msg.OldPath, name)
+}
+
+// create adds the file called name to the directory at dir,
+// which decides what to create if it is an fs.Creator.
+func (h *FSHandler) create(dir, name string, mode os.FileMode) (fs.File, error) {
+	parent, err := h.FS.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	if c, ok := parent.(fs.Creator); ok {
+		f, err := c.Create(name, mode)
+		if err == nil {
+			h.created.Store(f, struct{}{})
+		}
+		if !errors.Is(err, fs.ErrNotSupported) {
+			return f, err
+		}
+	}
+	f := h.Files.newFile(name, mode)
+	if err := h.FS.Create(dir, f); err != nil {
+		f.Close()
+		return nil, err
+	}
+	h.created.Store(f, struct{}{})
+	return f, nil
+}
+
+func (h *FSHandler) handleRequest(user string, t styx.Request) {
 	switch msg := t.(type) {
 	case styx.Tremove:
-		msg.Rremove(h.FS.Remove(msg.Path()))
+		msg.Rremove(h.remove(msg.Path()))
 		return
-	case styx.Ttruncate:
-		// TODO: implement if needed
-		msg.Rtruncate(nil)
-		return
-	case styx.Tutimes:
-		// TODO: implement if needed
-		msg.Rutimes(nil)
+	case styx.Trename:
+		msg.Rrename(h.rename(msg))
 		return
 	case styx.Tcreate:
-		b := file.NewBucket(msg.Name, msg.Mode, 2048)
-		if err := h.FS.Create(msg.Path(), b); err != nil {
+		f, err := h.create(msg.Path(), msg.Name, msg.Mode)
+		if err != nil {
 			msg.Rerror(err.Error())
 			return
 		}
-		msg.Rcreate(b.Open())
+		msg.Rcreate(f.Open())
 		return
-	case styx.Topen, styx.Twalk, styx.Tstat:
+	case styx.Topen, styx.Twalk, styx.Tstat, styx.Ttruncate, styx.Tutimes, styx.Tchmod:
 		// All these messages require an open first.
 		// We're taking care of it in a single place.
 	default:
@@ -61,7 +211,42 @@ func (h *FSHandler) handleRequest(t styx.Request) {
 		return
 	}
 	switch msg := t.(type) {
+	case styx.Ttruncate:
+		f, ok := file.(fs.Truncater)
+		if !ok {
+			msg.Rtruncate(unsupported("truncate", t.Path()))
+			return
+		}
+		if !writable(file) {
+			msg.Rtruncate(permissionDenied("truncate", t.Path()))
+			return
+		}
+		msg.Rtruncate(f.Truncate(msg.Size))
+	case styx.Tutimes:
+		msg.Rutimes(h.utimes(file, t.Path(), msg.Mtime))
+	case styx.Tchmod:
+		msg.Rchmod(h.chmod(file, t.Path(), msg.Mode))
 	case styx.Topen:
+		if msg.Flag&os.O_TRUNC != 0 {
+			// Opening with O_TRUNC is what shells do on
+			// redirection, hence files that cannot be
+			// truncated are opened anyway, as long as
+			// they can be written.
+			if !writable(file) {
+				msg.Rerror(permissionDenied("open", t.Path()).Error())
+				return
+			}
+			if f, ok := file.(fs.Truncater); ok {
+				if err := f.Truncate(0); err != nil {
+					msg.Rerror(err.Error())
+					return
+				}
+			}
+		}
+		if uf, ok := file.(fs.UserFile); ok {
+			msg.Ropen(uf.OpenUser(user))
+			return
+		}
 		msg.Ropen(file.Open())
 	case styx.Twalk:
 		msg.Rwalk(file.Stat())
@@ -72,6 +257,9 @@ func (h *FSHandler) handleRequest(t styx.Request) {
 
 func (h *FSHandler) Serve9P(s *styx.Session) {
 	for s.Next() {
-		h.handleRequest(s.Request())
+		t := s.Request()
+		start := time.Now()
+		h.handleRequest(s.User, t)
+		observeRequest(t, start)
 	}
 }
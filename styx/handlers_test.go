@@ -0,0 +1,198 @@
+// SPDX-FileCopyrightText: 2020 jecoz
+//
+// SPDX-License-Identifier: BSD-3-Clause
+
+package styx
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jecoz/flexi/file"
+	"github.com/jecoz/flexi/file/memfs"
+	"github.com/jecoz/flexi/fs"
+)
+
+func TestFiles_NewFile(t *testing.T) {
+	tt := []struct {
+		name  string
+		files Files
+		mode  os.FileMode
+		data  string
+		full  bool
+		// spilled is the number of files expected in
+		// the spill directory after writing data.
+		spilled int
+	}{
+		{name: "dir", mode: os.ModeDir | 0755},
+		{name: "bucket", mode: 0644, data: "hello"},
+		{name: "bucket at max size", files: Files{MaxSize: 5}, mode: 0644, data: "hello"},
+		{name: "bucket past max size", files: Files{MaxSize: 4}, mode: 0644, data: "hello", full: true},
+		{name: "spill below threshold", files: Files{SpillSize: 8}, mode: 0644, data: "hello"},
+		{name: "spill past threshold", files: Files{SpillSize: 4}, mode: 0644, data: "hello", spilled: 1},
+		{name: "spill past max size", files: Files{SpillSize: 2, MaxSize: 4}, mode: 0644, data: "hello", full: true},
+	}
+
+	for i, v := range tt {
+		spillDir := ""
+		if v.files.SpillSize > 0 {
+			dir, err := ioutil.TempDir("", "flexi-spill")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			v.files.SpillDir = dir
+			spillDir = dir
+		}
+
+		fs := memfs.New(file.NewDirFiles(""))
+		f := v.files.newFile("new", v.mode)
+		if err := fs.Create("/", f); err != nil {
+			t.Fatalf("%d (%v): %v", i, v.name, err)
+		}
+		found, err := fs.Open("/new")
+		if err != nil {
+			t.Fatalf("%d (%v): %v", i, v.name, err)
+		}
+		info, err := found.Stat()
+		if err != nil {
+			t.Fatalf("%d (%v): %v", i, v.name, err)
+		}
+		if info.IsDir() != v.mode.IsDir() {
+			t.Fatalf("%d (%v): have dir %v, want %v", i, v.name, info.IsDir(), v.mode.IsDir())
+		}
+		if v.mode.IsDir() {
+			// Files can be created inside
+			// the new directory.
+			if err := fs.Create("/new", v.files.newFile("inner", 0644)); err != nil {
+				t.Fatalf("%d (%v): %v", i, v.name, err)
+			}
+			if _, err := fs.Open("/new/inner"); err != nil {
+				t.Fatalf("%d (%v): %v", i, v.name, err)
+			}
+			continue
+		}
+
+		rwc, err := f.Open()
+		if err != nil {
+			t.Fatalf("%d (%v): %v", i, v.name, err)
+		}
+		_, err = rwc.Write([]byte(v.data))
+		if full := errors.Is(err, file.ErrFull); full != v.full {
+			t.Fatalf("%d (%v): have full %v, want %v (error: %v)", i, v.name, full, v.full, err)
+		}
+		if !v.full {
+			if err != nil {
+				t.Fatalf("%d (%v): %v", i, v.name, err)
+			}
+			r, err := f.Open()
+			if err != nil {
+				t.Fatalf("%d (%v): %v", i, v.name, err)
+			}
+			b, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Fatalf("%d (%v): %v", i, v.name, err)
+			}
+			if string(b) != v.data {
+				t.Fatalf("%d (%v): have [%s], want [%s]", i, v.name, b, v.data)
+			}
+		}
+		if spillDir != "" {
+			if n := len(file.LsDisk(spillDir)()); n != v.spilled {
+				t.Fatalf("%d (%v): have %d spilled files, want %d", i, v.name, n, v.spilled)
+			}
+			// Closing the file releases the disk.
+			f.Close()
+			if n := len(file.LsDisk(spillDir)()); n != 0 {
+				t.Fatalf("%d (%v): have %d spilled files after close", i, v.name, n)
+			}
+		}
+	}
+}
+
+func TestFiles_CreateExisting(t *testing.T) {
+	var c Files
+	fs := memfs.New(file.NewDirFiles("", c.newFile("a", 0644)))
+	for i, v := range []os.FileMode{0644, os.ModeDir | 0755} {
+		if err := fs.Create("/", c.newFile("a", v)); !os.IsExist(err) {
+			t.Fatalf("%d: have [%v], want [%v]", i, err, os.ErrExist)
+		}
+	}
+	if err := fs.Create(filepath.Join("/", "a"), c.newFile("b", 0644)); err == nil || !strings.Contains(err.Error(), "not a directory") {
+		t.Fatalf("creating inside a file: have [%v]", err)
+	}
+}
+
+type removableDir struct{ *file.Dir }
+
+func (removableDir) Removable() bool { return true }
+
+func TestFSHandler_Owned(t *testing.T) {
+	root := file.NewDirFiles(
+		"",
+		file.NewMulti("ctl"),
+		file.NewDirFiles("jobs", file.NewMulti("0")),
+		removableDir{file.NewDirFiles("0")},
+	)
+	h := &FSHandler{FS: memfs.New(root)}
+	if _, err := h.create("/", "new", 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.create("/", "ro", 0644); err != nil {
+		t.Fatal(err)
+	}
+	open := func(p string) fs.File {
+		f, err := h.FS.Open(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return f
+	}
+	// Once read-only, a created file can no longer
+	// be changed by clients.
+	if err := h.chmod(open("/ro"), "/ro", 0444); err != nil {
+		t.Fatal(err)
+	}
+
+	tt := []struct {
+		path    string
+		allowed bool
+		// removable is true when the file can be removed
+		// but not changed.
+		removable bool
+	}{
+		{path: "/"},
+		{path: "/ctl"},
+		{path: "/jobs"},
+		{path: "/jobs/0"},
+		{path: "/ro"},
+		{path: "/0", removable: true},
+		{path: "/new", allowed: true},
+	}
+	for i, v := range tt {
+		f := open(v.path)
+		// Server files that support chmod and utimes, such
+		// as directories, refuse them to clients.
+		err := h.chmod(f, v.path, 0600)
+		if (err == nil) != v.allowed {
+			t.Fatalf("%d (%v): chmod: %v", i, v.path, err)
+		}
+		err = h.utimes(f, v.path, time.Now())
+		if (err == nil) != v.allowed {
+			t.Fatalf("%d (%v): utimes: %v", i, v.path, err)
+		}
+		err = h.remove(v.path)
+		if (err == nil) != (v.allowed || v.removable) {
+			t.Fatalf("%d (%v): remove: %v", i, v.path, err)
+		}
+		_, err = h.FS.Open(v.path)
+		if exists := err == nil; exists == (v.allowed || v.removable) {
+			t.Fatalf("%d (%v): have exists %v after remove", i, v.path, exists)
+		}
+	}
+}
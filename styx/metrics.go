@@ -0,0 +1,38 @@
+// SPDX-FileCopyrightText: 2020 jecoz
+//
+// SPDX-License-Identifier: BSD-3-Clause
+
+package styx
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"aqwari.net/net/styx"
+	"github.com/jecoz/flexi/metrics"
+)
+
+var (
+	requestsTotal = metrics.Default.NewCounter(
+		"flexi_9p_requests_total",
+		"Number of 9p requests handled, by message type.",
+		"type",
+	)
+	requestDuration = metrics.Default.NewHistogram(
+		"flexi_9p_request_duration_seconds",
+		"Time spent handling 9p requests, by message type.",
+		nil,
+		"type",
+	)
+)
+
+func requestType(t styx.Request) string {
+	return strings.TrimPrefix(fmt.Sprintf("%T", t), "styx.")
+}
+
+func observeRequest(t styx.Request, start time.Time) {
+	typ := requestType(t)
+	requestsTotal.Inc(typ)
+	requestDuration.Observe(time.Since(start).Seconds(), typ)
+}
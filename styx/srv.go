@@ -5,12 +5,11 @@
 package styx
 
 import (
-	"log"
 	"net"
-	"os"
 
 	"aqwari.net/net/styx"
 	"github.com/jecoz/flexi/fs"
+	"github.com/jecoz/flexi/logger"
 )
 
 type Srv struct {
@@ -24,10 +23,18 @@ func (s *Srv) Serve(handlers ...styx.Handler) error {
 	return srv.Serve(s.Ln)
 }
 
-func Serve(ln net.Listener, fs fs.FS) error {
+// Options configure Serve.
+type Options struct {
+	// Log traces each request at debug level.
+	Log   logger.Logger
+	Files Files
+}
+
+// Serve serves fs on ln.
+func Serve(ln net.Listener, fs fs.FS, opts Options) error {
 	srv := &Srv{ln}
 	return srv.Serve(
-		&LogHandler{Log: log.New(os.Stderr, "", log.LstdFlags)},
-		&FSHandler{FS: fs},
+		&LogHandler{Log: opts.Log},
+		&FSHandler{FS: fs, Files: opts.Files},
 	)
 }
@@ -0,0 +1,186 @@
+// SPDX-FileCopyrightText: 2020 jecoz
+//
+// SPDX-License-Identifier: BSD-3-Clause
+
+package flexi
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/jecoz/flexi/file"
+	"github.com/jecoz/flexi/fs"
+)
+
+// Templates are named spawn payloads stored as name.json files
+// inside Dir. Spawn payloads can refer to them either with the
+// bare template name or with a JSON object such as
+//
+//	{"template": "echo64", "overrides": {"image": {"cluster": "dev"}}}
+//
+// where overrides are merged into the template following the
+// JSON merge patch rules (RFC 7386). Names that are valid JSON,
+// such as true or 123, are rejected as they would be taken for
+// payloads when used bare.
+type Templates struct {
+	Dir string
+}
+
+// templatesDir lists the templates to clients, who cannot
+// change them.
+type templatesDir struct {
+	*file.Dir
+}
+
+func (d templatesDir) Create(name string, mode os.FileMode) (fs.File, error) {
+	return nil, fmt.Errorf("create %v: templates are read-only: %w", name, os.ErrPermission)
+}
+
+func newTemplatesDir(t *Templates) fs.File {
+	return templatesDir{file.NewDirLs("templates", file.LsDiskReadOnly(t.Dir))}
+}
+
+var templateNameRx = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+// validTemplateName reports whether name can be used to refer
+// to a template.
+func validTemplateName(name []byte) bool {
+	return templateNameRx.Match(name) && !json.Valid(name)
+}
+
+// Load returns the template called name.
+func (t *Templates) Load(name string) ([]byte, error) {
+	if !validTemplateName([]byte(name)) {
+		return nil, fmt.Errorf("invalid template name %q", name)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(t.Dir, name+".json"))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("template %v: %w", name, os.ErrNotExist)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("template %v: %w", name, err)
+	}
+	if !json.Valid(b) {
+		return nil, fmt.Errorf("template %v: invalid json", name)
+	}
+	return b, nil
+}
+
+type templateRef struct {
+	Template  string          `json:"template"`
+	Overrides json.RawMessage `json:"overrides"`
+}
+
+// Resolve returns the payload p refers to. ok is false if p does
+// not refer to any template, in which case it is returned as is.
+func (t *Templates) Resolve(p []byte) (payload []byte, ok bool, err error) {
+	trimmed := bytes.TrimSpace(p)
+	if validTemplateName(trimmed) {
+		// A bare template name.
+		payload, err = t.Load(string(trimmed))
+		return payload, true, err
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(p, &fields); err != nil {
+		return p, false, nil
+	}
+	if _, found := fields["template"]; !found {
+		return p, false, nil
+	}
+	var ref templateRef
+	dec := json.NewDecoder(bytes.NewReader(p))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&ref); err != nil {
+		return nil, true, fmt.Errorf("decode template reference: %w", err)
+	}
+	if payload, err = t.Load(ref.Template); err != nil {
+		return nil, true, err
+	}
+	if len(ref.Overrides) == 0 {
+		return payload, true, nil
+	}
+	if payload, err = mergeJSON(payload, ref.Overrides); err != nil {
+		return nil, true, fmt.Errorf("template %v: %w", ref.Template, err)
+	}
+	return payload, true, nil
+}
+
+// templateName returns the name of the template p refers to, or
+// the empty string.
+func templateName(p []byte) string {
+	trimmed := bytes.TrimSpace(p)
+	if validTemplateName(trimmed) {
+		return string(trimmed)
+	}
+	var ref templateRef
+	if err := json.Unmarshal(p, &ref); err != nil {
+		return ""
+	}
+	return ref.Template
+}
+
+// mergeJSON applies patch to doc as a JSON merge patch: objects
+// are merged recursively, null values remove keys and any other
+// value replaces the original one.
+func mergeJSON(doc, patch []byte) ([]byte, error) {
+	var d, p interface{}
+	if err := json.Unmarshal(doc, &d); err != nil {
+		return nil, fmt.Errorf("decode document: %w", err)
+	}
+	if err := json.Unmarshal(patch, &p); err != nil {
+		return nil, fmt.Errorf("decode patch: %w", err)
+	}
+	return json.Marshal(mergePatch(d, p))
+}
+
+func mergePatch(doc, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	d, ok := doc.(map[string]interface{})
+	if !ok {
+		d = make(map[string]interface{}, len(p))
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(d, k)
+			continue
+		}
+		d[k] = mergePatch(d[k], v)
+	}
+	return d
+}
+
+// resolvePayload turns the payload written to the spawn file of
+// a remote of ns into the one handed to the Spawner, expanding
+// template references and applying the namespace template.
+func (s *Srv) resolvePayload(ns *namespace, p []byte) ([]byte, error) {
+	if s.Templates != nil {
+		payload, ok, err := s.Templates.Resolve(p)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return payload, nil
+		}
+	}
+	if ns == nil || len(ns.Template) == 0 {
+		return p, nil
+	}
+	if len(strings.TrimSpace(string(p))) == 0 {
+		return ns.Template, nil
+	}
+	if !json.Valid(p) || bytes.TrimSpace(p)[0] != '{' {
+		// Not a json object, it replaces the template.
+		return p, nil
+	}
+	return mergeJSON(ns.Template, p)
+}
@@ -0,0 +1,96 @@
+// SPDX-FileCopyrightText: 2020 jecoz
+//
+// SPDX-License-Identifier: BSD-3-Clause
+
+package flexi
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jecoz/flexi/file"
+	"github.com/jecoz/flexi/fs"
+)
+
+func TestResolvePayload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "templates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	echo64 := `{"image":{"cluster":"prod","service":"564"},"caps":{}}`
+	if err := ioutil.WriteFile(filepath.Join(dir, "echo64.json"), []byte(echo64), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "true.json"), []byte(echo64), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &Srv{Templates: &Templates{Dir: dir}}
+	ns := &namespace{NamespaceSpec: NamespaceSpec{
+		Template: []byte(`{"image":{"cluster":"dev"},"cpu":1}`),
+	}}
+	tt := []struct {
+		in   string
+		want string
+		err  bool
+	}{
+		{in: "echo64\n", want: echo64},
+		{in: `{"template":"echo64"}`, want: echo64},
+		{
+			in:   `{"template":"echo64","overrides":{"image":{"cluster":"dev"},"caps":null}}`,
+			want: `{"image":{"cluster":"dev","service":"564"}}`,
+		},
+		{in: "missing", err: true},
+		{in: "../echo64", want: "../echo64"},
+		{in: `{"template":"echo64","other":1}`, err: true},
+		{in: "", want: `{"image":{"cluster":"dev"},"cpu":1}`},
+		{in: `{"cpu":2,"image":{"service":"80"}}`, want: `{"cpu":2,"image":{"cluster":"dev","service":"80"}}`},
+		{in: "not json", want: "not json"},
+		{in: "true", want: "true"},
+		{in: `{"template":"true"}`, err: true},
+	}
+	for i, v := range tt {
+		have, err := srv.resolvePayload(ns, []byte(v.in))
+		if (err != nil) != v.err {
+			t.Fatalf("%d: unexpected error: %v", i, err)
+		}
+		if !v.err && string(have) != v.want {
+			t.Fatalf("%d: have [%s], want [%s]", i, have, v.want)
+		}
+	}
+}
+
+func TestTemplatesDir_ReadOnly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "templates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "echo.json"), []byte(`{}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	d := newTemplatesDir(&Templates{Dir: dir})
+	if _, err := d.(fs.Creator).Create("x.json", 0644); !errors.Is(err, os.ErrPermission) {
+		t.Fatalf("have [%v], want [%v]", err, os.ErrPermission)
+	}
+	f, err := d.(templatesDir).Find("echo.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := f.(fs.Truncater); ok {
+		t.Fatal("templates can be truncated")
+	}
+	rwc, err := f.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rwc.Close()
+	if _, err := rwc.Write([]byte("x")); !errors.Is(err, file.ErrNotAllowed) {
+		t.Fatalf("have [%v], want [%v]", err, file.ErrNotAllowed)
+	}
+}
@@ -0,0 +1,278 @@
+// SPDX-FileCopyrightText: 2020 jecoz
+//
+// SPDX-License-Identifier: BSD-3-Clause
+
+package trace
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jecoz/flexi/logger"
+)
+
+// JSONExporter writes each span as a JSON object on its own line.
+// Use it to inspect traces offline.
+type JSONExporter struct {
+	sync.Mutex
+	W io.Writer
+}
+
+type jsonSpan struct {
+	TraceID  string                 `json:"trace_id"`
+	SpanID   string                 `json:"span_id"`
+	ParentID string                 `json:"parent_span_id,omitempty"`
+	Name     string                 `json:"name"`
+	Start    time.Time              `json:"start"`
+	End      time.Time              `json:"end"`
+	Duration string                 `json:"duration"`
+	Attrs    map[string]interface{} `json:"attributes,omitempty"`
+	Err      string                 `json:"error,omitempty"`
+}
+
+func (e *JSONExporter) Export(s *Span) {
+	s.Lock()
+	js := jsonSpan{
+		TraceID:  s.TraceID.String(),
+		SpanID:   s.SpanID.String(),
+		Name:     s.Name,
+		Start:    s.Start,
+		End:      s.End,
+		Duration: s.End.Sub(s.Start).String(),
+		Attrs:    s.Attrs,
+		Err:      s.Err,
+	}
+	if s.Parent.IsValid() {
+		js.ParentID = s.Parent.String()
+	}
+	b, err := json.Marshal(&js)
+	s.Unlock()
+	if err != nil {
+		return
+	}
+
+	e.Lock()
+	defer e.Unlock()
+	e.W.Write(append(b, '\n'))
+}
+
+// OTLPExporter sends spans in batches to an OpenTelemetry
+// collector, using the OTLP/HTTP protocol with JSON encoding.
+type OTLPExporter struct {
+	// Endpoint is the collector traces endpoint, usually
+	// http://host:4318/v1/traces.
+	Endpoint string
+	// Service is reported as the service.name resource attribute.
+	Service string
+	Client  *http.Client
+	// Log is used to report failed exports. Defaults to
+	// logger.Default.
+	Log logger.Logger
+
+	once   sync.Once
+	spans  chan *Span
+	done   chan struct{}
+	mu     sync.Mutex
+	closed bool
+}
+
+func (e *OTLPExporter) log() logger.Logger {
+	if e.Log == nil {
+		return logger.Default
+	}
+	return e.Log
+}
+
+const (
+	otlpBatchSize     = 64
+	otlpFlushInterval = 5 * time.Second
+)
+
+func (e *OTLPExporter) start() {
+	e.once.Do(func() {
+		e.spans = make(chan *Span, otlpBatchSize*4)
+		e.done = make(chan struct{})
+		go e.loop()
+	})
+}
+
+// Export queues s for sending. Spans exported after Close are
+// dropped.
+func (e *OTLPExporter) Export(s *Span) {
+	e.start()
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.closed {
+		return
+	}
+	select {
+	case e.spans <- s:
+	default:
+		// Drop the span instead of blocking the
+		// traced operation.
+	}
+}
+
+// Close flushes the pending spans.
+func (e *OTLPExporter) Close() error {
+	e.start()
+	e.mu.Lock()
+	if !e.closed {
+		e.closed = true
+		close(e.spans)
+	}
+	e.mu.Unlock()
+	<-e.done
+	return nil
+}
+
+func (e *OTLPExporter) loop() {
+	defer close(e.done)
+	ticker := time.NewTicker(otlpFlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]*Span, 0, otlpBatchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := e.send(batch); err != nil {
+			e.log().Error("otlp export failed", "spans", len(batch), "error", err)
+		}
+		batch = batch[:0]
+	}
+	for {
+		select {
+		case s, ok := <-e.spans:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, s)
+			if len(batch) >= otlpBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+type otlpValue map[string]interface{}
+
+type otlpAttr struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+func otlpAttrs(attrs map[string]interface{}) []otlpAttr {
+	list := make([]otlpAttr, 0, len(attrs))
+	for k, v := range attrs {
+		var value otlpValue
+		switch t := v.(type) {
+		case string:
+			value = otlpValue{"stringValue": t}
+		case bool:
+			value = otlpValue{"boolValue": t}
+		case int:
+			value = otlpValue{"intValue": strconv.Itoa(t)}
+		case int64:
+			value = otlpValue{"intValue": strconv.FormatInt(t, 10)}
+		case float64:
+			value = otlpValue{"doubleValue": t}
+		default:
+			value = otlpValue{"stringValue": fmt.Sprint(t)}
+		}
+		list = append(list, otlpAttr{Key: k, Value: value})
+	}
+	return list
+}
+
+func (e *OTLPExporter) send(batch []*Span) error {
+	spans := make([]map[string]interface{}, len(batch))
+	for i, s := range batch {
+		s.Lock()
+		span := map[string]interface{}{
+			"traceId":           s.TraceID.String(),
+			"spanId":            s.SpanID.String(),
+			"name":              s.Name,
+			"kind":              1,
+			"startTimeUnixNano": strconv.FormatInt(s.Start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.End.UnixNano(), 10),
+			"attributes":        otlpAttrs(s.Attrs),
+		}
+		if s.Parent.IsValid() {
+			span["parentSpanId"] = s.Parent.String()
+		}
+		if s.Err != "" {
+			span["status"] = map[string]interface{}{"code": 2, "message": s.Err}
+		}
+		s.Unlock()
+		spans[i] = span
+	}
+	service := e.Service
+	if service == "" {
+		service = "flexi"
+	}
+	payload := map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": otlpAttrs(map[string]interface{}{"service.name": service}),
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]interface{}{"name": "github.com/jecoz/flexi"},
+				"spans": spans,
+			}},
+		}},
+	}
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	client := e.Client
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	resp, err := client.Post(e.Endpoint, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector replied with %v", resp.Status)
+	}
+	return nil
+}
+
+type nopCloser struct{}
+
+func (nopCloser) Close() error { return nil }
+
+// Open returns the exporter described by spec, which can be
+// "stdout", an http(s) OTLP traces endpoint or the path of a file
+// where JSON lines are appended. service is used to identify the
+// process in OTLP exports, and log to report their failures.
+// Close the returned Closer to release the exporter resources.
+func Open(spec, service string, log logger.Logger) (Exporter, io.Closer, error) {
+	switch {
+	case spec == "stdout":
+		return &JSONExporter{W: os.Stdout}, nopCloser{}, nil
+	case strings.HasPrefix(spec, "http://"), strings.HasPrefix(spec, "https://"):
+		e := &OTLPExporter{Endpoint: spec, Service: service, Log: log}
+		return e, e, nil
+	default:
+		f, err := os.OpenFile(spec, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, nil, err
+		}
+		return &JSONExporter{W: f}, f, nil
+	}
+}
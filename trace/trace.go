@@ -0,0 +1,196 @@
+// SPDX-FileCopyrightText: 2020 jecoz
+//
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package trace implements a minimal tracing facility compatible
+// with OpenTelemetry: span contexts are propagated using the W3C
+// Trace Context format and finished spans can be exported either
+// as JSON lines or to an OTLP/HTTP collector.
+package trace
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+type TraceID [16]byte
+type SpanID [8]byte
+
+func (t TraceID) String() string { return hex.EncodeToString(t[:]) }
+func (s SpanID) String() string  { return hex.EncodeToString(s[:]) }
+func (t TraceID) IsValid() bool  { return t != TraceID{} }
+func (s SpanID) IsValid() bool   { return s != SpanID{} }
+
+// SpanContext identifies a span across process boundaries.
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+}
+
+func (sc SpanContext) IsValid() bool { return sc.TraceID.IsValid() && sc.SpanID.IsValid() }
+
+// Traceparent encodes sc as a W3C traceparent header value.
+func (sc SpanContext) Traceparent() string {
+	return fmt.Sprintf("00-%s-%s-01", sc.TraceID, sc.SpanID)
+}
+
+// ParseTraceparent decodes a W3C traceparent header value.
+func ParseTraceparent(s string) (SpanContext, error) {
+	var sc SpanContext
+	fields := strings.Split(strings.TrimSpace(s), "-")
+	if len(fields) != 4 || fields[0] != "00" {
+		return sc, fmt.Errorf("invalid traceparent %q", s)
+	}
+	tid, err := hex.DecodeString(fields[1])
+	if err != nil || len(tid) != len(sc.TraceID) {
+		return sc, fmt.Errorf("invalid trace id in traceparent %q", s)
+	}
+	sid, err := hex.DecodeString(fields[2])
+	if err != nil || len(sid) != len(sc.SpanID) {
+		return sc, fmt.Errorf("invalid span id in traceparent %q", s)
+	}
+	copy(sc.TraceID[:], tid)
+	copy(sc.SpanID[:], sid)
+	if !sc.IsValid() {
+		return sc, fmt.Errorf("invalid traceparent %q", s)
+	}
+	return sc, nil
+}
+
+// Span describes an operation. Spans are safe for concurrent use.
+type Span struct {
+	Name   string
+	Parent SpanID
+	SpanContext
+
+	sync.Mutex
+	Start time.Time
+	End   time.Time
+	Attrs map[string]interface{}
+	Err   string
+	ended bool
+}
+
+// SetAttr records an attribute, such as a remote identifier.
+func (s *Span) SetAttr(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.Attrs[key] = value
+}
+
+// SetError marks the span as failed, if err is not nil.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.Err = err.Error()
+}
+
+// Finish ends the span and hands it to the exporter. Calling
+// Finish more than once has no effect.
+func (s *Span) Finish() {
+	if s == nil {
+		return
+	}
+	s.Lock()
+	if s.ended {
+		s.Unlock()
+		return
+	}
+	s.ended = true
+	s.End = time.Now()
+	s.Unlock()
+	export(s)
+}
+
+// Exporter receives finished spans.
+type Exporter interface {
+	Export(*Span)
+}
+
+var (
+	mu       sync.RWMutex
+	exporter Exporter
+)
+
+// SetExporter configures where finished spans are sent. Spans
+// are discarded when no exporter is set.
+func SetExporter(e Exporter) {
+	mu.Lock()
+	defer mu.Unlock()
+	exporter = e
+}
+
+func export(s *Span) {
+	mu.RLock()
+	e := exporter
+	mu.RUnlock()
+	if e != nil {
+		e.Export(s)
+	}
+}
+
+type spanKey struct{}
+type remoteKey struct{}
+
+// ContextWithRemote returns a context which spans will be
+// children of sc, a span living in another process.
+func ContextWithRemote(ctx context.Context, sc SpanContext) context.Context {
+	if !sc.IsValid() {
+		return ctx
+	}
+	return context.WithValue(ctx, remoteKey{}, sc)
+}
+
+// FromContext returns the span carried by ctx, if any.
+func FromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
+
+// SpanContextFromContext returns the context of the current span,
+// either local or remote.
+func SpanContextFromContext(ctx context.Context) SpanContext {
+	if s := FromContext(ctx); s != nil {
+		return s.SpanContext
+	}
+	sc, _ := ctx.Value(remoteKey{}).(SpanContext)
+	return sc
+}
+
+func randomID(b []byte) {
+	rand.Read(b)
+}
+
+// Start creates a new span, child of the span carried by ctx,
+// if any. kv is a list of attribute key value pairs. Call
+// Finish on the returned span when the operation is over.
+func Start(ctx context.Context, name string, kv ...interface{}) (context.Context, *Span) {
+	s := &Span{
+		Name:  name,
+		Start: time.Now(),
+		Attrs: make(map[string]interface{}, len(kv)/2),
+	}
+	parent := SpanContextFromContext(ctx)
+	if parent.IsValid() {
+		s.TraceID = parent.TraceID
+		s.Parent = parent.SpanID
+	} else {
+		randomID(s.TraceID[:])
+	}
+	randomID(s.SpanID[:])
+	for i := 0; i+1 < len(kv); i += 2 {
+		s.Attrs[fmt.Sprint(kv[i])] = kv[i+1]
+	}
+	return context.WithValue(ctx, spanKey{}, s), s
+}
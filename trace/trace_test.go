@@ -0,0 +1,61 @@
+// SPDX-FileCopyrightText: 2020 jecoz
+//
+// SPDX-License-Identifier: BSD-3-Clause
+
+package trace
+
+import (
+	"context"
+	"testing"
+)
+
+func TestTraceparent(t *testing.T) {
+	tp := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	sc, err := ParseTraceparent(tp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have := sc.Traceparent(); have != tp {
+		t.Fatalf("have [%v], want [%v]", have, tp)
+	}
+
+	for i, v := range []string{
+		"",
+		"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+	} {
+		if _, err := ParseTraceparent(v); err == nil {
+			t.Fatalf("%d: expected error parsing [%v]", i, v)
+		}
+	}
+}
+
+func TestStart_Remote(t *testing.T) {
+	sc, _ := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	ctx := ContextWithRemote(context.Background(), sc)
+	ctx, parent := Start(ctx, "parent")
+	_, child := Start(ctx, "child")
+
+	if parent.TraceID != sc.TraceID || child.TraceID != sc.TraceID {
+		t.Fatalf("trace id was not propagated")
+	}
+	if parent.Parent != sc.SpanID {
+		t.Fatalf("have parent [%v], want [%v]", parent.Parent, sc.SpanID)
+	}
+	if child.Parent != parent.SpanID {
+		t.Fatalf("have parent [%v], want [%v]", child.Parent, parent.SpanID)
+	}
+}
+
+func TestOTLPExporter_ExportAfterClose(t *testing.T) {
+	e := &OTLPExporter{Endpoint: "http://127.0.0.1:0/v1/traces"}
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Must not panic on the closed channel.
+	e.Export(&Span{})
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
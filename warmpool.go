@@ -0,0 +1,290 @@
+// SPDX-FileCopyrightText: 2020 jecoz
+//
+// SPDX-License-Identifier: BSD-3-Clause
+
+package flexi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/jecoz/flexi/logger"
+)
+
+// WarmSpec describes a set of remote processes that are spawned
+// and mounted in advance, ready to be assigned to a remote as
+// soon as a matching spawn request arrives.
+type WarmSpec struct {
+	// Name identifies the set. It is used to name the
+	// mount points of the pooled processes.
+	Name string `json:"name"`
+	// Payload is the spawn payload used to spawn the pooled
+	// processes. Spawn requests which payload is equivalent
+	// to this one are served from the pool.
+	Payload json.RawMessage `json:"payload"`
+	// Size is the number of processes kept ready.
+	Size int `json:"size"`
+	// Idle is the amount of time after which the pooled
+	// processes are evicted if no one used the pool. Evicted
+	// pools are filled again on the next matching spawn. Zero
+	// means never.
+	Idle Duration `json:"idle"`
+}
+
+// WarmPool keeps pre-spawned and pre-mounted remote processes,
+// to hide the latency of cold starts from users.
+//
+// Pooled processes are spawned with a negative id and the Pool
+// Metadata set. If flexi is restarted, the ones that were not
+// assigned to a remote are killed.
+type WarmPool struct {
+	Specs []WarmSpec
+
+	sync.Mutex
+	mtpt     string
+	s        Spawner
+	instance string
+	policy   SpawnPolicy
+	log      logger.Logger
+	sets     map[string]*warmSet
+	seq      int
+	done     chan struct{}
+}
+
+type warmProcess struct {
+	rp   *RemoteProcess
+	path string
+}
+
+type warmSet struct {
+	spec     WarmSpec
+	key      string
+	ready    []*warmProcess
+	filling  int
+	lastUsed time.Time
+	evicted  bool
+}
+
+// warmKey returns a representation of payload that does not
+// depend on keys order or formatting.
+func warmKey(payload []byte) (string, error) {
+	req, err := parseSpawnRequest(bytes.NewReader(payload))
+	if err != nil {
+		return "", err
+	}
+	var v interface{}
+	if err := json.Unmarshal(req.Payload, &v); err != nil {
+		return string(req.Payload), nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// Start fills the pool, spawning the processes with s and
+// mounting them under mtpt. instance is the Srv.Instance the
+// processes are spawned for, and policy is applied to them.
+func (p *WarmPool) Start(mtpt string, s Spawner, instance string, policy SpawnPolicy, log logger.Logger) error {
+	p.Lock()
+	defer p.Unlock()
+	p.mtpt = mtpt
+	p.s = s
+	p.instance = instance
+	p.policy = policy
+	p.log = log
+	p.sets = make(map[string]*warmSet, len(p.Specs))
+	p.done = make(chan struct{})
+	for _, v := range p.Specs {
+		key, err := warmKey(v.Payload)
+		if err != nil {
+			return fmt.Errorf("warm pool %v: %w", v.Name, err)
+		}
+		if err := validate(s, []byte(key)); err != nil {
+			return fmt.Errorf("warm pool %v: %w", v.Name, err)
+		}
+		if _, ok := p.sets[key]; ok {
+			return fmt.Errorf("warm pool %v: payload is already pooled", v.Name)
+		}
+		set := &warmSet{spec: v, key: key, lastUsed: time.Now()}
+		p.sets[key] = set
+		p.fill(set)
+	}
+	go p.evictLoop()
+	return nil
+}
+
+// Stop stops the eviction loop and kills the pooled processes.
+func (p *WarmPool) Stop() {
+	p.Lock()
+	defer p.Unlock()
+	if p.done == nil {
+		return
+	}
+	close(p.done)
+	p.done = nil
+	for _, v := range p.sets {
+		p.evict(v)
+	}
+}
+
+// fill spawns the processes that are missing from set.
+// Call with p locked.
+func (p *WarmPool) fill(set *warmSet) {
+	missing := set.spec.Size - len(set.ready) - set.filling
+	for i := 0; i < missing; i++ {
+		set.filling++
+		p.seq++
+		path := filepath.Join(p.mtpt, fmt.Sprintf("warm.%s.%d", set.spec.Name, p.seq))
+		go p.spawn(set, path)
+	}
+}
+
+func (p *WarmPool) spawn(set *warmSet, path string) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(p.policy.SpawnTimeout))
+	defer cancel()
+	ctx = WithSpawnPolicy(ctx, p.policy)
+	ctx = WithMetadata(ctx, Metadata{Instance: p.instance, Pool: set.spec.Name})
+
+	wp, err := func() (*warmProcess, error) {
+		rp, err := spawnProcess(ctx, p.s, bytes.NewReader([]byte(set.key)), -1)
+		if err != nil {
+			return nil, fmt.Errorf("spawn: %w", err)
+		}
+		mctx, cancel := context.WithTimeout(context.Background(), time.Duration(p.policy.MountTimeout))
+		defer cancel()
+		mctx = logger.NewContext(mctx, p.log.With("pool", set.spec.Name))
+		if err := mountReady(mctx, rp.Addr, path, p.policy, func(string, ...interface{}) {}); err != nil {
+			kctx, cancel := context.WithTimeout(context.Background(), time.Duration(p.policy.KillTimeout))
+			defer cancel()
+			killProcess(kctx, p.s, rp.SpawnedReader())
+			return nil, err
+		}
+		return &warmProcess{rp: rp, path: path}, nil
+	}()
+
+	p.Lock()
+	defer p.Unlock()
+	set.filling--
+	if err != nil {
+		p.log.Error("unable to fill warm pool", "pool", set.spec.Name, "error", err)
+		return
+	}
+	if set.evicted || p.done == nil {
+		// The pool is no longer interested
+		// in this process.
+		go p.kill(wp)
+		return
+	}
+	set.ready = append(set.ready, wp)
+}
+
+func (p *WarmPool) kill(wp *warmProcess) {
+	ctx, cancel := context.WithTimeout(context.Background(), SpawnTimeout)
+	defer cancel()
+	if err := Umount(wp.path); err != nil {
+		p.log.Error("umount warm process", "path", wp.path, "error", err)
+	}
+	if err := killProcess(ctx, p.s, wp.rp.SpawnedReader()); err != nil {
+		p.log.Error("kill warm process", "name", wp.rp.Name, "error", err)
+	}
+}
+
+// evict kills every ready process of set. Call with p locked.
+func (p *WarmPool) evict(set *warmSet) {
+	for _, v := range set.ready {
+		go p.kill(v)
+	}
+	set.ready = nil
+	set.evicted = true
+}
+
+func (p *WarmPool) evictLoop() {
+	ticker := time.NewTicker(time.Second * 10)
+	defer ticker.Stop()
+
+	p.Lock()
+	done := p.done
+	p.Unlock()
+	for {
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+		p.Lock()
+		for _, v := range p.sets {
+			idle := time.Duration(v.spec.Idle)
+			if idle > 0 && !v.evicted && time.Since(v.lastUsed) > idle {
+				p.log.Info("evicting idle warm pool", "pool", v.spec.Name, "idle", idle)
+				p.evict(v)
+			}
+		}
+		p.Unlock()
+	}
+}
+
+// processes returns the names of the ready processes.
+func (p *WarmPool) processes() []string {
+	p.Lock()
+	defer p.Unlock()
+	var names []string
+	for _, set := range p.sets {
+		for _, v := range set.ready {
+			names = append(names, v.rp.Name)
+		}
+	}
+	return names
+}
+
+// Take returns a ready process matching payload, if any. The
+// pool is filled again in the background.
+func (p *WarmPool) Take(payload []byte) (rp *RemoteProcess, path string, ok bool) {
+	key, err := warmKey(payload)
+	if err != nil {
+		return nil, "", false
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	set, found := p.sets[key]
+	if !found || p.done == nil {
+		return nil, "", false
+	}
+	set.lastUsed = time.Now()
+	set.evicted = false
+	defer p.fill(set)
+
+	if len(set.ready) == 0 {
+		return nil, "", false
+	}
+	wp := set.ready[0]
+	set.ready = set.ready[1:]
+	return wp.rp, wp.path, true
+}
+
+// Status returns a human readable report of the pool state.
+func (p *WarmPool) Status() []byte {
+	p.Lock()
+	defer p.Unlock()
+	b := new(bytes.Buffer)
+	for _, v := range p.Specs {
+		key, _ := warmKey(v.Payload)
+		set, ok := p.sets[key]
+		if !ok {
+			continue
+		}
+		state := "active"
+		if set.evicted {
+			state = "evicted"
+		}
+		fmt.Fprintf(b, "%s ready=%d filling=%d size=%d %s\n", v.Name, len(set.ready), set.filling, v.Size, state)
+	}
+	return b.Bytes()
+}
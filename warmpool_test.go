@@ -0,0 +1,213 @@
+// SPDX-FileCopyrightText: 2020 jecoz
+//
+// SPDX-License-Identifier: BSD-3-Clause
+
+package flexi
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jecoz/flexi/logger"
+)
+
+// warmSpawner spawns processes that cannot be mounted, and reports
+// the processes it kills on a channel.
+type warmSpawner struct {
+	meta   chan Metadata
+	killed chan string
+}
+
+func (s *warmSpawner) Spawn(ctx context.Context, _ io.Reader, id int) (*RemoteProcess, error) {
+	s.meta <- MetadataFromContext(ctx)
+	return &RemoteProcess{ID: id, Addr: "127.0.0.1:0", Name: "w", Spawned: []byte("w")}, nil
+}
+
+func (s *warmSpawner) Kill(_ context.Context, r io.Reader) error {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	s.killed <- string(b)
+	return nil
+}
+
+func (s *warmSpawner) Ls() ([]*RemoteProcess, error) { return nil, nil }
+
+func newWarmSpawner() *warmSpawner {
+	return &warmSpawner{meta: make(chan Metadata, 8), killed: make(chan string, 8)}
+}
+
+func receive(t *testing.T, c chan string) string {
+	t.Helper()
+	select {
+	case v := <-c:
+		return v
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+	return ""
+}
+
+// newWarmPool returns a pool that was not started, holding a set
+// for payload with the ready processes named after names.
+func newWarmPool(t *testing.T, s Spawner, payload string, size int, names ...string) *WarmPool {
+	key, err := warmKey([]byte(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	set := &warmSet{spec: WarmSpec{Name: "test", Payload: json.RawMessage(payload), Size: size}, key: key}
+	for _, v := range names {
+		set.ready = append(set.ready, &warmProcess{
+			rp:   &RemoteProcess{ID: -1, Name: v, Warm: true, Spawned: []byte(v)},
+			path: filepath.Join(t.TempDir(), v),
+		})
+	}
+	return &WarmPool{
+		Specs: []WarmSpec{set.spec},
+		mtpt:  t.TempDir(),
+		s:     s,
+		policy: SpawnPolicy{
+			MountTimeout: Duration(time.Second),
+			KillTimeout:  Duration(time.Second),
+			Probe:        Probe{Timeout: Duration(100 * time.Millisecond), Interval: Duration(10 * time.Millisecond)},
+		},
+		log:  logger.New(ioutil.Discard, logger.Debug, false),
+		sets: map[string]*warmSet{key: set},
+		done: make(chan struct{}),
+	}
+}
+
+func TestWarmKey(t *testing.T) {
+	a, err := warmKey([]byte(`{"image": "echo", "cpu": 256}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := warmKey([]byte(`{"cpu":256,"image":"echo"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a != b {
+		t.Fatalf("have different keys [%v] and [%v]", a, b)
+	}
+}
+
+func TestWarmPool_Take(t *testing.T) {
+	s := newWarmSpawner()
+	p := newWarmPool(t, s, `{"image":"echo"}`, 1, "w1")
+
+	for i, tt := range []struct {
+		payload string
+		name    string
+		ok      bool
+	}{
+		{payload: `{"image":"other"}`},
+		{payload: `{ "image": "echo" }`, name: "w1", ok: true},
+		// The pool is being filled again.
+		{payload: `{"image":"echo"}`},
+	} {
+		rp, _, ok := p.Take([]byte(tt.payload))
+		if ok != tt.ok {
+			t.Fatalf("%d: have ok %v, want %v", i, ok, tt.ok)
+		}
+		if ok && rp.Name != tt.name {
+			t.Fatalf("%d: have [%v], want [%v]", i, rp.Name, tt.name)
+		}
+	}
+
+	// The refill is spawned for the pool and, as it cannot be
+	// mounted, killed.
+	select {
+	case meta := <-s.meta:
+		if meta.Pool != "test" {
+			t.Fatalf("have pool [%v], want [test]", meta.Pool)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+	if have := receive(t, s.killed); have != "w" {
+		t.Fatalf("have killed [%v], want [w]", have)
+	}
+}
+
+func TestWarmPool_Stop(t *testing.T) {
+	s := newWarmSpawner()
+	p := newWarmPool(t, s, `{"image":"echo"}`, 2, "w1", "w2")
+	p.Stop()
+
+	killed := map[string]bool{receive(t, s.killed): true, receive(t, s.killed): true}
+	if !killed["w1"] || !killed["w2"] {
+		t.Fatalf("unexpected killed processes: %v", killed)
+	}
+	if _, _, ok := p.Take([]byte(`{"image":"echo"}`)); ok {
+		t.Fatal("took a process from a stopped pool")
+	}
+}
+
+func TestKeepWarm(t *testing.T) {
+	s := &storeSpawner{}
+	r := &Remote{S: s}
+	rp := &RemoteProcess{ID: -1, Warm: true}
+	if err := r.keepWarm(rp, 4); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.stored) != 1 || s.stored[0].ID != 4 || s.stored[0].Warm {
+		t.Fatalf("unexpected stored processes: %+v", s.stored)
+	}
+}
+
+type storeSpawner struct {
+	runningSpawner
+	stored []RemoteProcess
+}
+
+func (s *storeSpawner) Store(rp *RemoteProcess) error {
+	s.stored = append(s.stored, *rp)
+	return nil
+}
+
+func TestTakeWarm_SpawnRate(t *testing.T) {
+	srv := newTestSrv(t)
+	srv.root.quota.Limits = Limits{SpawnsPerMinute: 1}
+	srv.Queue = &SpawnQueue{}
+	srv.Warm = newWarmPool(t, newWarmSpawner(), `{"image":"echo"}`, 0, "w1", "w2")
+	r := &Remote{srv: srv, ns: srv.root}
+	req := &spawnRequest{Payload: []byte(`{"image":"echo"}`)}
+
+	if _, _, ok := r.takeWarm(&spawnRequest{Payload: []byte(`{"image":"other"}`)}); ok {
+		t.Fatal("took a process for a payload that is not pooled")
+	}
+	// Missing the pool does not count as a spawn.
+	if _, _, ok := r.takeWarm(req); !ok {
+		t.Fatal("no warm process taken")
+	}
+	// The queue waits for the spawn rate to allow
+	// the next spawn.
+	if _, _, ok := r.takeWarm(req); ok {
+		t.Fatal("took a warm process past the spawn rate")
+	}
+}
+
+func TestTakeWarm_Tags(t *testing.T) {
+	srv := newTestSrv(t)
+	srv.Warm = newWarmPool(t, newWarmSpawner(), `{"image":"echo"}`, 0, "w1")
+	r := &Remote{srv: srv, ns: srv.root}
+
+	req, err := parseSpawnRequest(strings.NewReader(`{"image":"echo","tags":{"team":"a"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, ok := r.takeWarm(req); ok {
+		t.Fatal("took a warm process for a tagged spawn")
+	}
+	req.Tags = nil
+	if _, _, ok := r.takeWarm(req); !ok {
+		t.Fatal("no warm process taken")
+	}
+}